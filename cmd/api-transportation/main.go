@@ -3,13 +3,20 @@ package main
 import (
 	"flag"
 	"os"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/diwise/api-transportation/internal/pkg/alerts"
+	"github.com/diwise/api-transportation/internal/pkg/anomaly"
 	"github.com/diwise/api-transportation/internal/pkg/database"
+	fiwarecontext "github.com/diwise/api-transportation/internal/pkg/fiware/context"
+	"github.com/diwise/api-transportation/internal/pkg/fusion"
+	"github.com/diwise/api-transportation/internal/pkg/importer"
 	intmsg "github.com/diwise/api-transportation/internal/pkg/messaging"
 	"github.com/diwise/api-transportation/internal/pkg/messaging/commands"
 	"github.com/diwise/api-transportation/internal/pkg/messaging/events"
+	"github.com/diwise/api-transportation/internal/pkg/retention"
 	"github.com/diwise/api-transportation/pkg/handler"
 	"github.com/diwise/messaging-golang/pkg/messaging"
 )
@@ -41,12 +48,55 @@ func main() {
 	defer messenger.Close()
 
 	datafile := openSegmentsFile(segmentsFileName)
-	db, _ := database.NewDatabaseConnection(database.NewPostgreSQLConnector(), datafile)
+	db, err := database.NewDatabaseConnection(database.NewPostgreSQLConnector(), datafile)
+	if err != nil {
+		log.Fatalf("Failed to set up the datastore: %s", err.Error())
+	}
 	defer datafile.Close()
 
 	messenger.RegisterTopicMessageHandler((&events.RoadSegmentSurfaceUpdated{}).TopicName(), intmsg.CreateRoadSegmentSurfaceUpdatedReceiver(db))
 
-	messenger.RegisterCommandHandler(commands.UpdateRoadSegmentSurfaceContentType, intmsg.CreateUpdateRoadSegmentSurfaceCommandHandler(db, messenger))
+	alertConfig, err := alerts.LoadConfiguration()
+	if err != nil {
+		log.Fatalf("Failed to load alert configuration: %s", err.Error())
+	}
+	alertEngine := alerts.NewEngine(db, messenger, *alertConfig)
+
+	messenger.RegisterCommandHandler(commands.UpdateRoadSegmentSurfaceContentType, intmsg.CreateUpdateRoadSegmentSurfaceCommandHandler(db, messenger, alertEngine))
+
+	// The background jobs run for as long as the service does, since serving never returns
+	intmsg.StartRoadSegmentSurfaceExpiryWatcher(db, messenger, alertEngine, time.Minute)
+
+	anomalyConfig, err := anomaly.LoadConfiguration()
+	if err != nil {
+		log.Fatalf("Failed to load anomaly configuration: %s", err.Error())
+	}
+
+	anomaly.StartDetector(anomaly.NewDetector(db, messenger, *anomalyConfig), anomalyConfig.Interval)
+
+	retentionConfig, err := retention.LoadConfiguration()
+	if err != nil {
+		log.Fatalf("Failed to load retention configuration: %s", err.Error())
+	}
+
+	retention.StartJob(db, *retentionConfig)
+
+	fusionConfig, err := fusion.LoadConfiguration()
+	if err != nil {
+		log.Fatalf("Failed to load fusion configuration: %s", err.Error())
+	}
+
+	importConfig, err := importer.LoadConfiguration()
+	if err != nil {
+		log.Fatalf("Failed to load import configuration: %s", err.Error())
+	}
+
+	ctxSource := fiwarecontext.CreateSource(db, messenger, fusion.NewFuser(db, messenger, *fusionConfig))
+
+	messenger.RegisterCommandHandler(commands.CreateTrafficFlowObservedContentType, intmsg.CreateObservationCommandHandler(ctxSource, "TrafficFlowObserved"))
+	messenger.RegisterCommandHandler(commands.CreateRoadSurfaceObservedContentType, intmsg.CreateObservationCommandHandler(ctxSource, "RoadSurfaceObserved"))
+	messenger.RegisterTopicMessageHandler(intmsg.TrafficFlowObservedTopic, intmsg.CreateObservationReceiver(db, ctxSource, "TrafficFlowObserved"))
+	messenger.RegisterTopicMessageHandler(intmsg.RoadSurfaceObservedTopic, intmsg.CreateObservationReceiver(db, ctxSource, "RoadSurfaceObserved"))
 
-	handler.CreateRouterAndStartServing(messenger, db)
+	handler.CreateRouterAndStartServing(ctxSource, db, importer.NewImporter(db, *importConfig))
 }
@@ -0,0 +1,150 @@
+package accuracy
+
+import (
+	"math"
+	"sort"
+)
+
+//Sample is a surface prediction that has been matched with a verified ground-truth label
+type Sample struct {
+	Source       string
+	Model        string
+	ModelVersion string
+
+	Predicted   string
+	Probability float64
+	Label       string
+}
+
+//Report describes how well the predictions of a single source and model matched the labels
+type Report struct {
+	Source       string `json:"source"`
+	Model        string `json:"model,omitempty"`
+	ModelVersion string `json:"modelVersion,omitempty"`
+
+	Samples  int     `json:"samples"`
+	Accuracy float64 `json:"accuracy"`
+	// ConfusionMatrix counts the predicted surface types of every labelled surface type
+	ConfusionMatrix map[string]map[string]int `json:"confusionMatrix"`
+	Calibration     []CalibrationBin          `json:"calibration"`
+	// CalibrationError is the expected calibration error, i.e. the weighted mean of the
+	// differences between the accuracy and the mean probability of each calibration bin
+	CalibrationError float64 `json:"calibrationError"`
+}
+
+//CalibrationBin compares the mean probability of the predictions within a probability range
+//with how often those predictions were correct
+type CalibrationBin struct {
+	MinProbability  float64 `json:"minProbability"`
+	MaxProbability  float64 `json:"maxProbability"`
+	Samples         int     `json:"samples"`
+	MeanProbability float64 `json:"meanProbability"`
+	Accuracy        float64 `json:"accuracy"`
+}
+
+//NumberOfCalibrationBins is the number of equally wide probability ranges that the
+//predictions are divided into when their calibration is computed
+const NumberOfCalibrationBins int = 10
+
+type groupKey struct {
+	source       string
+	model        string
+	modelVersion string
+}
+
+//NewReports groups the samples by source, model and model version and returns a report for
+//each group, ordered by source, model and model version
+func NewReports(samples []Sample) []Report {
+	groups := map[groupKey][]Sample{}
+
+	for _, s := range samples {
+		key := groupKey{source: s.Source, model: s.Model, modelVersion: s.ModelVersion}
+		groups[key] = append(groups[key], s)
+	}
+
+	reports := []Report{}
+	for key, groupSamples := range groups {
+		reports = append(reports, newReport(key, groupSamples))
+	}
+
+	sort.Slice(reports, func(i, j int) bool {
+		if reports[i].Source != reports[j].Source {
+			return reports[i].Source < reports[j].Source
+		}
+		if reports[i].Model != reports[j].Model {
+			return reports[i].Model < reports[j].Model
+		}
+		return reports[i].ModelVersion < reports[j].ModelVersion
+	})
+
+	return reports
+}
+
+func newReport(key groupKey, samples []Sample) Report {
+	report := Report{
+		Source:          key.source,
+		Model:           key.model,
+		ModelVersion:    key.modelVersion,
+		Samples:         len(samples),
+		ConfusionMatrix: map[string]map[string]int{},
+		Calibration:     []CalibrationBin{},
+	}
+
+	correct := 0
+	bins := make([]CalibrationBin, NumberOfCalibrationBins)
+	binCorrect := make([]int, NumberOfCalibrationBins)
+
+	for _, s := range samples {
+		if _, ok := report.ConfusionMatrix[s.Label]; !ok {
+			report.ConfusionMatrix[s.Label] = map[string]int{}
+		}
+		report.ConfusionMatrix[s.Label][s.Predicted]++
+
+		idx := calibrationBinIndex(s.Probability)
+		bins[idx].Samples++
+		bins[idx].MeanProbability += s.Probability
+
+		if s.Predicted == s.Label {
+			correct++
+			binCorrect[idx]++
+		}
+	}
+
+	if len(samples) == 0 {
+		return report
+	}
+
+	report.Accuracy = float64(correct) / float64(len(samples))
+
+	for idx := range bins {
+		if bins[idx].Samples == 0 {
+			continue
+		}
+
+		bin := bins[idx]
+		bin.MinProbability = float64(idx) / float64(NumberOfCalibrationBins)
+		bin.MaxProbability = float64(idx+1) / float64(NumberOfCalibrationBins)
+		bin.MeanProbability = bin.MeanProbability / float64(bin.Samples)
+		bin.Accuracy = float64(binCorrect[idx]) / float64(bin.Samples)
+
+		report.CalibrationError += float64(bin.Samples) / float64(len(samples)) * math.Abs(bin.Accuracy-bin.MeanProbability)
+		report.Calibration = append(report.Calibration, bin)
+	}
+
+	return report
+}
+
+//calibrationBinIndex returns the index of the bin that a probability belongs to. Every bin
+//includes its upper bound, except for the first bin that also includes zero.
+func calibrationBinIndex(probability float64) int {
+	// Allow for rounding errors, e.g. 0.7 * 10 = 7.000000000000001
+	idx := int(math.Ceil(probability*float64(NumberOfCalibrationBins)-1e-9)) - 1
+
+	if idx < 0 {
+		return 0
+	} else if idx >= NumberOfCalibrationBins {
+		return NumberOfCalibrationBins - 1
+	}
+
+	return idx
+}
@@ -0,0 +1,55 @@
+package accuracy_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/diwise/api-transportation/internal/pkg/accuracy"
+
+	"github.com/matryer/is"
+)
+
+func TestThatReportsAreGroupedBySourceAndModel(t *testing.T) {
+	is := is.New(t)
+
+	reports := accuracy.NewReports([]accuracy.Sample{
+		{Source: "model", Model: "roadcam", Predicted: "snow", Probability: 0.9, Label: "snow"},
+		{Source: "model", Model: "roadcam", Predicted: "snow", Probability: 0.8, Label: "ice"},
+		{Source: "model", Model: "roadcam", Predicted: "ice", Probability: 0.7, Label: "ice"},
+		{Source: "fusion", Model: "weighted", Predicted: "ice", Probability: 0.6, Label: "ice"},
+	})
+
+	is.Equal(len(reports), 2)             // expected a report per source and model
+	is.Equal(reports[0].Source, "fusion") // reports should be ordered by source
+
+	camera := reports[1]
+	is.Equal(camera.Samples, 3)
+	is.Equal(camera.Accuracy, 2.0/3.0)
+	is.Equal(camera.ConfusionMatrix["ice"]["snow"], 1) // one ice label was predicted as snow
+	is.Equal(camera.ConfusionMatrix["ice"]["ice"], 1)
+	is.Equal(camera.ConfusionMatrix["snow"]["snow"], 1)
+}
+
+func TestThatPredictionsAreCalibratedPerProbabilityRange(t *testing.T) {
+	is := is.New(t)
+
+	reports := accuracy.NewReports([]accuracy.Sample{
+		{Source: "model", Predicted: "snow", Probability: 0.85, Label: "snow"},
+		{Source: "model", Predicted: "snow", Probability: 0.85, Label: "ice"},
+		{Source: "model", Predicted: "ice", Probability: 0.3, Label: "ice"},
+	})
+
+	calibration := reports[0].Calibration
+	is.Equal(len(calibration), 2) // only bins with samples should be reported
+
+	is.Equal(calibration[0].Samples, 1)
+	is.Equal(calibration[0].MaxProbability, 0.3) // 0.3 belongs to the bin (0.2, 0.3]
+	is.Equal(calibration[0].Accuracy, 1.0)
+
+	is.Equal(calibration[1].Samples, 2)
+	is.Equal(calibration[1].MeanProbability, 0.85)
+	is.Equal(calibration[1].Accuracy, 0.5)
+
+	expectedError := 1.0/3.0*0.7 + 2.0/3.0*0.35
+	is.True(math.Abs(reports[0].CalibrationError-expectedError) < 1e-9) // unexpected calibration error
+}
@@ -0,0 +1,226 @@
+package alerts
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/diwise/api-transportation/internal/pkg/database"
+	"github.com/diwise/api-transportation/internal/pkg/env"
+	"github.com/diwise/api-transportation/internal/pkg/messaging/events"
+	"github.com/diwise/api-transportation/internal/pkg/persistence"
+	"github.com/diwise/api-transportation/internal/pkg/surface"
+	"github.com/diwise/messaging-golang/pkg/messaging"
+	"github.com/google/uuid"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	//SubCategorySlipperyRoad is the sub category of alerts about icy or snowy road surfaces
+	SubCategorySlipperyRoad string = "hazardOnRoad"
+	//Category is the category of all alerts issued by this service
+	Category string = "traffic"
+	//Name is the name of all alerts issued by this service
+	Name string = "slippery road"
+)
+
+//validSeverities are the severities that an Alert may have
+var validSeverities = []string{"informational", "low", "medium", "high", "critical"}
+
+//Config controls which surface types cause alerts and how severe those alerts are
+type Config struct {
+	// Severities maps the surface types that cause alerts to the severity of the alerts
+	Severities map[string]string
+	// MinProbability is the probability that a surface type must have to cause an alert
+	MinProbability float64
+}
+
+//LoadConfiguration reads the alert rules from the environment variables
+//TRANSPORTATION_ALERT_RULES, a comma separated list of surfacetype:severity pairs, and
+//TRANSPORTATION_ALERT_MIN_PROBABILITY, falling back to alerts for ice and snow above 0.7
+func LoadConfiguration() (*Config, error) {
+	minProbability, err := strconv.ParseFloat(env.GetVariableOrDefault("TRANSPORTATION_ALERT_MIN_PROBABILITY", "0.7"), 64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse alert min probability: %s", err.Error())
+	}
+
+	return NewConfiguration(env.GetVariableOrDefault("TRANSPORTATION_ALERT_RULES", "ice:high,snow:medium"), minProbability)
+}
+
+//NewConfiguration parses a comma separated list of rules, e.g. ice:high,snow:medium
+func NewConfiguration(rules string, minProbability float64) (*Config, error) {
+	config := &Config{Severities: map[string]string{}, MinProbability: minProbability}
+
+	for _, rule := range strings.Split(rules, ",") {
+		if strings.TrimSpace(rule) == "" {
+			continue
+		}
+
+		parts := strings.Split(rule, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("alert rule %s should be formatted as surfacetype:severity", rule)
+		}
+
+		severity := strings.TrimSpace(parts[1])
+		if !isValidSeverity(severity) {
+			return nil, fmt.Errorf("alert rule %s has an unknown severity", rule)
+		}
+
+		config.Severities[surface.Normalize(parts[0])] = severity
+	}
+
+	return config, nil
+}
+
+func isValidSeverity(severity string) bool {
+	for _, s := range validSeverities {
+		if s == severity {
+			return true
+		}
+	}
+
+	return false
+}
+
+//MessagingContext is an interface that allows mocking of messaging.Context parameters
+type MessagingContext interface {
+	PublishOnTopic(message messaging.TopicMessage) error
+}
+
+//Engine evaluates the alert rules when the surface of a road segment changes. It issues
+//alerts when a segment becomes hazardous and closes them when the conditions clear.
+type Engine interface {
+	SurfaceUpdated(evt *events.RoadSegmentSurfaceUpdated) error
+	SurfaceExpired(evt *events.RoadSegmentSurfaceExpired) error
+}
+
+type engineImpl struct {
+	db     database.Datastore
+	msg    MessagingContext
+	config Config
+}
+
+//NewEngine creates an Engine that publishes AlertUpdated events to msg
+func NewEngine(db database.Datastore, msg MessagingContext, config Config) Engine {
+	return &engineImpl{db: db, msg: msg, config: config}
+}
+
+func (e *engineImpl) SurfaceUpdated(evt *events.RoadSegmentSurfaceUpdated) error {
+	timestamp := parseTimestamp(evt.Timestamp)
+	surfaceType := surface.Normalize(evt.SurfaceType)
+
+	severity, hazardous := e.config.Severities[surfaceType]
+	hazardous = hazardous && evt.Probability >= e.config.MinProbability
+
+	active, err := e.db.GetActiveAlertForSegment(evt.ID)
+	if err != nil {
+		return err
+	}
+
+	if active != nil {
+		if hazardous && active.SurfaceType == surfaceType && active.Severity == severity {
+			return nil
+		}
+
+		// The conditions have either cleared or changed into another hazard that
+		// replaces the current alert
+		err = e.close(active, timestamp)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !hazardous {
+		return nil
+	}
+
+	return e.issue(evt.ID, surfaceType, evt.Probability, severity, timestamp)
+}
+
+func (e *engineImpl) SurfaceExpired(evt *events.RoadSegmentSurfaceExpired) error {
+	active, err := e.db.GetActiveAlertForSegment(evt.ID)
+	if err != nil || active == nil {
+		return err
+	}
+
+	// A hazard that nobody has confirmed in a while should not be reported forever
+	return e.close(active, parseTimestamp(evt.Timestamp))
+}
+
+func (e *engineImpl) issue(segmentID, surfaceType string, probability float64, severity string, timestamp time.Time) error {
+	segment, err := e.db.GetRoadSegmentByID(segmentID)
+	if err != nil {
+		return err
+	}
+
+	coords := segment.Coordinates()
+	start, end := coords[0], coords[len(coords)-1]
+
+	alert, err := e.db.CreateAlert(persistence.Alert{
+		AlertID:     uuid.New().String(),
+		SegmentID:   segmentID,
+		SubCategory: SubCategorySlipperyRoad,
+		Severity:    severity,
+		Description: fmt.Sprintf("%s: %s", Name, surfaceType),
+		SurfaceType: surfaceType,
+		Probability: probability,
+		Latitude:    (start[1] + end[1]) / 2,
+		Longitude:   (start[0] + end[0]) / 2,
+		DateIssued:  time.Now().UTC(),
+		ValidFrom:   timestamp,
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Infof("issued %s alert %s for road segment %s", severity, alert.AlertID, segmentID)
+
+	return e.publish(alert)
+}
+
+func (e *engineImpl) close(alert *persistence.Alert, timestamp time.Time) error {
+	closed, ok, err := e.db.CloseAlert(alert.AlertID, timestamp)
+	if err != nil {
+		return err
+	} else if !ok {
+		log.Debugf("alert %s for road segment %s has already been closed", closed.AlertID, closed.SegmentID)
+		return nil
+	}
+
+	log.Infof("closed alert %s for road segment %s", closed.AlertID, closed.SegmentID)
+
+	return e.publish(closed)
+}
+
+func (e *engineImpl) publish(alert *persistence.Alert) error {
+	event := &events.AlertUpdated{
+		ID:          alert.AlertID,
+		RoadSegment: alert.SegmentID,
+		Status:      alert.Status,
+		Severity:    alert.Severity,
+		SubCategory: alert.SubCategory,
+		Description: alert.Description,
+		SurfaceType: alert.SurfaceType,
+		Probability: alert.Probability,
+		ValidFrom:   alert.ValidFrom.UTC().Format(time.RFC3339),
+		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+	}
+
+	if alert.ValidTo != nil {
+		event.ValidTo = alert.ValidTo.UTC().Format(time.RFC3339)
+	}
+
+	return e.msg.PublishOnTopic(event)
+}
+
+//parseTimestamp parses the timestamp of an event, falling back to the current time
+func parseTimestamp(timestamp string) time.Time {
+	ts, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return time.Now().UTC()
+	}
+
+	return ts.UTC()
+}
@@ -0,0 +1,100 @@
+package alerts_test
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diwise/api-transportation/internal/pkg/alerts"
+	"github.com/diwise/api-transportation/internal/pkg/database"
+	"github.com/diwise/api-transportation/internal/pkg/messaging/events"
+	"github.com/diwise/messaging-golang/pkg/messaging"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/matryer/is"
+)
+
+func TestMain(m *testing.M) {
+	log.SetFormatter(&log.JSONFormatter{})
+	os.Exit(m.Run())
+}
+
+const seedData string = "21277:153930;21277:153930;62.389109;17.310863;62.389084;17.310852\n"
+
+func TestThatHazardousSurfacesIssueAlertsThatAreClosedWhenConditionsClear(t *testing.T) {
+	is := is.New(t)
+
+	db, err := database.NewDatabaseConnection(database.NewSQLiteConnector(), strings.NewReader(seedData))
+	is.NoErr(err)
+
+	config, err := alerts.NewConfiguration("ice:high,snow:medium", 0.7)
+	is.NoErr(err)
+
+	msg := &messagingMock{}
+	engine := alerts.NewEngine(db, msg, *config)
+
+	is.NoErr(engine.SurfaceUpdated(surfaceUpdated("snow", 0.5)))
+	is.Equal(len(msg.events), 0) // snow with a low probability should not cause an alert
+
+	is.NoErr(engine.SurfaceUpdated(surfaceUpdated("ice", 0.9)))
+	is.Equal(len(msg.events), 1) // expected an alert to be issued
+	issued := msg.events[0].(*events.AlertUpdated)
+	is.Equal(issued.Status, database.AlertStatusActive)
+	is.Equal(issued.Severity, "high")
+
+	is.NoErr(engine.SurfaceUpdated(surfaceUpdated("ice", 0.8)))
+	is.Equal(len(msg.events), 1) // an ongoing hazard should not issue more alerts
+
+	is.NoErr(engine.SurfaceUpdated(surfaceUpdated("dry", 0.9)))
+	is.Equal(len(msg.events), 2) // expected the alert to be closed
+	closed := msg.events[1].(*events.AlertUpdated)
+	is.Equal(closed.ID, issued.ID)
+	is.Equal(closed.Status, database.AlertStatusClosed)
+	is.True(closed.ValidTo != "") // a closed alert should have an end of validity
+
+	active, err := db.GetActiveAlertForSegment("21277:153930")
+	is.NoErr(err)
+	is.True(active == nil) // no alert should remain active
+}
+
+func TestThatAlertsAreReplacedWhenTheHazardChanges(t *testing.T) {
+	is := is.New(t)
+
+	db, _ := database.NewDatabaseConnection(database.NewSQLiteConnector(), strings.NewReader(seedData))
+	config, _ := alerts.NewConfiguration("ice:high,snow:medium", 0.7)
+	msg := &messagingMock{}
+	engine := alerts.NewEngine(db, msg, *config)
+
+	is.NoErr(engine.SurfaceUpdated(surfaceUpdated("snow", 0.9)))
+	is.NoErr(engine.SurfaceUpdated(surfaceUpdated("ice", 0.9)))
+
+	is.Equal(len(msg.events), 3) // expected the snow alert to be replaced by an ice alert
+	is.Equal(msg.events[1].(*events.AlertUpdated).Status, database.AlertStatusClosed)
+	is.Equal(msg.events[2].(*events.AlertUpdated).Severity, "high")
+}
+
+func TestThatUnknownSeveritiesAreRejected(t *testing.T) {
+	is := is.New(t)
+
+	_, err := alerts.NewConfiguration("ice:extreme", 0.7)
+	is.True(err != nil) // extreme is not a valid severity
+}
+
+func surfaceUpdated(surfaceType string, probability float64) *events.RoadSegmentSurfaceUpdated {
+	return &events.RoadSegmentSurfaceUpdated{
+		ID:          "21277:153930",
+		SurfaceType: surfaceType,
+		Probability: probability,
+		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+	}
+}
+
+type messagingMock struct {
+	events []messaging.TopicMessage
+}
+
+func (m *messagingMock) PublishOnTopic(message messaging.TopicMessage) error {
+	m.events = append(m.events, message)
+	return nil
+}
@@ -0,0 +1,231 @@
+package anomaly
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/diwise/api-transportation/internal/pkg/database"
+	"github.com/diwise/api-transportation/internal/pkg/env"
+	"github.com/diwise/api-transportation/internal/pkg/messaging/events"
+	"github.com/diwise/api-transportation/internal/pkg/persistence"
+	"github.com/diwise/messaging-golang/pkg/messaging"
+	"github.com/diwise/ngsi-ld-golang/pkg/datamodels/fiware"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	//KindDrop is an intensity far below the baseline, e.g. due to an incident or a stuck sensor
+	KindDrop string = "drop"
+	//KindSpike is an intensity far above the baseline
+	KindSpike string = "spike"
+)
+
+//Config controls how baselines are learned and how far from them an observation must be
+//to be flagged as an anomaly
+type Config struct {
+	// Interval is how often new observations are checked
+	Interval time.Duration
+	// Period is how far back in time observations are used to learn the baselines
+	Period time.Duration
+	// Threshold is the number of standard deviations that an observation must deviate from
+	// its baseline to be flagged
+	Threshold float64
+	// MinSamples is the number of observations a baseline must have learned from to be used
+	MinSamples int64
+}
+
+//recentHistory is the most recent part of the history, which is not learned from so that
+//new anomalies do not become a part of the baselines that they are compared with
+const recentHistory time.Duration = 24 * time.Hour
+
+//LoadConfiguration reads the anomaly detection configuration from the environment, falling
+//back to checking every five minutes for observations more than three standard deviations
+//from baselines learned from at least four observations during the last four weeks
+func LoadConfiguration() (*Config, error) {
+	interval, err := time.ParseDuration(env.GetVariableOrDefault("TRANSPORTATION_ANOMALY_INTERVAL", "5m"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse anomaly interval: %s", err.Error())
+	}
+
+	period, err := time.ParseDuration(env.GetVariableOrDefault("TRANSPORTATION_ANOMALY_PERIOD", "672h"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse anomaly period: %s", err.Error())
+	}
+
+	threshold, err := strconv.ParseFloat(env.GetVariableOrDefault("TRANSPORTATION_ANOMALY_THRESHOLD", "3"), 64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse anomaly threshold: %s", err.Error())
+	}
+
+	minSamples, err := strconv.ParseInt(env.GetVariableOrDefault("TRANSPORTATION_ANOMALY_MIN_SAMPLES", "4"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse anomaly min samples: %s", err.Error())
+	}
+
+	if period <= recentHistory {
+		return nil, fmt.Errorf("the anomaly period must be longer than %s", recentHistory)
+	}
+
+	return &Config{Interval: interval, Period: period, Threshold: threshold, MinSamples: minSamples}, nil
+}
+
+//MessagingContext is an interface that allows mocking of messaging.Context parameters
+type MessagingContext interface {
+	PublishOnTopic(message messaging.TopicMessage) error
+}
+
+//Detector compares new traffic flow observations with the baselines of their road segments
+//and lanes, and publishes TrafficFlowAnomalyDetected events for those that deviate strongly
+type Detector interface {
+	Detect(since, now time.Time) ([]persistence.TrafficFlowAnomaly, error)
+}
+
+type detectorImpl struct {
+	db     database.Datastore
+	msg    MessagingContext
+	config Config
+}
+
+//NewDetector creates a Detector that publishes its findings to msg
+func NewDetector(db database.Datastore, msg MessagingContext, config Config) Detector {
+	return &detectorImpl{db: db, msg: msg, config: config}
+}
+
+type baselineKey struct {
+	segmentID string
+	laneID    int
+	weekday   time.Weekday
+	hour      int
+}
+
+//Detect checks the observations that were stored from since until now and returns the
+//anomalies that were found among them. Anomalies that have already been found, e.g. by
+//another instance of this service, are neither returned nor published again. Observations
+//that were made before the recent history, e.g. imported ones, are history and not checked.
+func (d *detectorImpl) Detect(since, now time.Time) ([]persistence.TrafficFlowAnomaly, error) {
+	observations, err := d.db.QueryTrafficFlowsObserved(database.ObservationQuery{
+		From:         since,
+		To:           now,
+		TimeProperty: "dateCreated",
+	})
+	if err != nil || len(observations) == 0 {
+		return nil, err
+	}
+
+	learned, err := d.db.GetTrafficFlowBaselines(now.Add(-d.config.Period), now.Add(-recentHistory))
+	if err != nil {
+		return nil, err
+	}
+
+	baselines := map[baselineKey]database.TrafficFlowBaseline{}
+	for _, b := range learned {
+		baselines[baselineKey{b.SegmentID, b.LaneID, b.Weekday, b.Hour}] = b
+	}
+
+	anomalies := []persistence.TrafficFlowAnomaly{}
+
+	recent := now.Add(-recentHistory)
+
+	for _, obs := range observations {
+		if obs.SegmentID == "" || obs.DateObserved.Before(recent) {
+			continue
+		}
+
+		observedAt := obs.DateObserved.UTC()
+		baseline, ok := baselines[baselineKey{obs.SegmentID, obs.LaneID, observedAt.Weekday(), observedAt.Hour()}]
+		if !ok || baseline.Samples < d.config.MinSamples {
+			continue
+		}
+
+		score := Score(float64(obs.Intensity), baseline)
+		if math.Abs(score) < d.config.Threshold {
+			continue
+		}
+
+		kind := KindSpike
+		if score < 0 {
+			kind = KindDrop
+		}
+
+		anomaly, created, err := d.db.CreateTrafficFlowAnomaly(persistence.TrafficFlowAnomaly{
+			TrafficFlowObservedID: obs.TrafficFlowObservedID,
+			SegmentID:             obs.SegmentID,
+			LaneID:                obs.LaneID,
+			DateObserved:          observedAt,
+			Kind:                  kind,
+			Intensity:             obs.Intensity,
+			Expected:              baseline.Mean,
+			StdDev:                baseline.StdDev,
+			Score:                 score,
+			Samples:               int(baseline.Samples),
+		})
+		if err != nil {
+			log.Errorf("failed to store anomaly of %s: %s", obs.TrafficFlowObservedID, err.Error())
+			continue
+		} else if !created {
+			continue
+		}
+
+		log.Infof("detected a %s in lane %d of road segment %s: %d vehicles where %.1f were expected", kind, obs.LaneID, obs.SegmentID, obs.Intensity, baseline.Mean)
+
+		err = d.msg.PublishOnTopic(&events.TrafficFlowAnomalyDetected{
+			ID:           anomaly.TrafficFlowObservedID,
+			RoadSegment:  fiware.RoadSegmentIDPrefix + anomaly.SegmentID,
+			LaneID:       anomaly.LaneID,
+			Kind:         anomaly.Kind,
+			Intensity:    anomaly.Intensity,
+			Expected:     anomaly.Expected,
+			Score:        anomaly.Score,
+			DateObserved: observedAt.Format(time.RFC3339),
+			Timestamp:    now.UTC().Format(time.RFC3339),
+		})
+		if err != nil {
+			log.Errorf("failed to publish anomaly of %s: %s", obs.TrafficFlowObservedID, err.Error())
+		}
+
+		anomalies = append(anomalies, *anomaly)
+	}
+
+	return anomalies, nil
+}
+
+//Score returns how many standard deviations an intensity is above (or below, if negative) its
+//baseline. Counts vary at least as much as a Poisson process, so the standard deviation is never
+//assumed to be less than the square root of the mean, or one.
+func Score(intensity float64, baseline database.TrafficFlowBaseline) float64 {
+	stdDev := math.Max(baseline.StdDev, math.Max(math.Sqrt(baseline.Mean), 1))
+	return (intensity - baseline.Mean) / stdDev
+}
+
+//StartDetector checks for anomalies among new observations at the configured interval,
+//until the returned stop function is called
+func StartDetector(detector Detector, interval time.Duration) func() {
+	ticker := time.NewTicker(interval)
+	done := make(chan bool)
+
+	go func() {
+		since := time.Now().UTC()
+
+		for {
+			select {
+			case <-done:
+				return
+			case t := <-ticker.C:
+				now := t.UTC()
+				if _, err := detector.Detect(since, now); err != nil {
+					log.Errorf("failed to detect traffic flow anomalies: %s", err.Error())
+					continue
+				}
+				since = now
+			}
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		done <- true
+	}
+}
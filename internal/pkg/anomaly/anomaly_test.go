@@ -0,0 +1,122 @@
+package anomaly_test
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diwise/api-transportation/internal/pkg/anomaly"
+	"github.com/diwise/api-transportation/internal/pkg/database"
+	"github.com/diwise/api-transportation/internal/pkg/messaging/events"
+	"github.com/diwise/messaging-golang/pkg/messaging"
+	"github.com/diwise/ngsi-ld-golang/pkg/datamodels/fiware"
+	ngsitypes "github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/types"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/matryer/is"
+)
+
+func TestMain(m *testing.M) {
+	log.SetFormatter(&log.JSONFormatter{})
+	os.Exit(m.Run())
+}
+
+const seedData string = "21277:153930;21277:153930;62.389109;17.310863;62.389084;17.310852\n"
+
+var testConfig = anomaly.Config{Interval: time.Minute, Period: 5 * 7 * 24 * time.Hour, Threshold: 3, MinSamples: 4}
+
+func TestThatSuddenDropsAreDetectedAndPublishedOnce(t *testing.T) {
+	is := is.New(t)
+
+	db, err := database.NewDatabaseConnection(database.NewSQLiteConnector(), strings.NewReader(seedData))
+	is.NoErr(err)
+
+	now := time.Now().UTC()
+
+	// The same hour of the same weekday during the four previous weeks
+	for week, intensity := range []int{98, 100, 102, 100} {
+		_, err := db.CreateTrafficFlowObserved(trafficFlow(fmt.Sprintf("history%d", week), now.Add(-time.Duration(week+1)*7*24*time.Hour-time.Minute), 1, intensity))
+		is.NoErr(err)
+	}
+
+	since := time.Now().UTC()
+
+	db.CreateTrafficFlowObserved(trafficFlow("stuck", now.Add(-time.Minute), 1, 5))
+	db.CreateTrafficFlowObserved(trafficFlow("normal", now.Add(-time.Minute), 1, 100))
+	db.CreateTrafficFlowObserved(trafficFlow("unknownlane", now.Add(-time.Minute), 2, 5))
+
+	msg := &messagingMock{}
+	detector := anomaly.NewDetector(db, msg, testConfig)
+
+	anomalies, err := detector.Detect(since, time.Now().UTC())
+	is.NoErr(err)
+	is.Equal(len(anomalies), 1) // only the stuck sensor deviates from a known baseline
+	is.Equal(anomalies[0].Kind, anomaly.KindDrop)
+	is.Equal(anomalies[0].Samples, 4)
+
+	is.Equal(len(msg.events), 1) // expected the anomaly to be published
+	detected := msg.events[0].(*events.TrafficFlowAnomalyDetected)
+	is.True(strings.HasSuffix(detected.ID, "stuck"))
+	is.Equal(detected.RoadSegment, fiware.RoadSegmentIDPrefix+"21277:153930")
+	is.Equal(detected.Expected, 100.0)
+
+	anomalies, err = detector.Detect(since, time.Now().UTC())
+	is.NoErr(err)
+	is.Equal(len(anomalies), 0)  // anomalies should only be detected once
+	is.Equal(len(msg.events), 1) // and only be published once
+
+	stored, err := db.GetTrafficFlowAnomalies(now.Add(-time.Hour), now, "21277:153930")
+	is.NoErr(err)
+	is.Equal(len(stored), 1)
+}
+
+func TestThatStoredHistoricalObservationsAreNotDetected(t *testing.T) {
+	is := is.New(t)
+
+	db, err := database.NewDatabaseConnection(database.NewSQLiteConnector(), strings.NewReader(seedData))
+	is.NoErr(err)
+
+	now := time.Now().UTC()
+
+	for week, intensity := range []int{98, 100, 102, 100} {
+		_, err := db.CreateTrafficFlowObserved(trafficFlow(fmt.Sprintf("history%d", week), now.Add(-time.Duration(week+1)*7*24*time.Hour-time.Minute), 1, intensity))
+		is.NoErr(err)
+	}
+
+	since := time.Now().UTC()
+
+	// An observation from before the learned period, that is stored now, e.g. by an import
+	db.CreateTrafficFlowObserved(trafficFlow("imported", now.Add(-6*7*24*time.Hour-time.Minute), 1, 5))
+
+	msg := &messagingMock{}
+	anomalies, err := anomaly.NewDetector(db, msg, testConfig).Detect(since, time.Now().UTC())
+	is.NoErr(err)
+	is.Equal(len(anomalies), 0) // historical observations should not be reported as anomalies
+	is.Equal(len(msg.events), 0)
+}
+
+func TestThatSpikesAreScoredAgainstAtLeastPoissonVariation(t *testing.T) {
+	is := is.New(t)
+
+	baseline := database.TrafficFlowBaseline{Samples: 4, Mean: 100, StdDev: 1}
+
+	is.Equal(anomaly.Score(150, baseline), 5.0) // a std dev below sqrt(100) should not exaggerate the score
+	is.Equal(anomaly.Score(0, database.TrafficFlowBaseline{Samples: 4}), 0.0)
+}
+
+func trafficFlow(id string, observedAt time.Time, lane, intensity int) *fiware.TrafficFlowObserved {
+	tfo := fiware.NewTrafficFlowObserved(id, observedAt.Format(time.RFC3339), lane, intensity)
+	tfo.RefRoadSegment = ngsitypes.NewSingleObjectRelationship(fiware.RoadSegmentIDPrefix + "21277:153930")
+	return tfo
+}
+
+type messagingMock struct {
+	events []messaging.TopicMessage
+}
+
+func (m *messagingMock) PublishOnTopic(message messaging.TopicMessage) error {
+	m.events = append(m.events, message)
+	return nil
+}
@@ -0,0 +1,136 @@
+package congestion
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/diwise/api-transportation/internal/pkg/env"
+)
+
+const (
+	//FreeFlow is the level of a road segment where vehicles travel close to the speed limit
+	FreeFlow string = "freeFlow"
+	//Dense is the level of a road segment where traffic is slowed down but still flowing
+	Dense string = "dense"
+	//Congested is the level of a road segment where traffic is queueing
+	Congested string = "congested"
+)
+
+//Thresholds decides the congestion level of a road segment from the ratio of the average
+//vehicle speed to the speed limit, and from the traffic density that follows from the intensity
+type Thresholds struct {
+	// Window is how far back from the most recent observation of a segment that traffic flows
+	// are included when its level is decided
+	Window time.Duration
+	// MinIntensity is the number of vehicles that must have passed during the window for the
+	// speed to be trusted, so that a single slow vehicle does not make a road congested
+	MinIntensity int
+	// DenseRatio and CongestedRatio are the ratios of the speed limit below which traffic is
+	// dense or congested
+	DenseRatio     float64
+	CongestedRatio float64
+	// DenseDensity and CongestedDensity are the number of vehicles per kilometer and lane at
+	// and above which traffic is dense or congested
+	DenseDensity     float64
+	CongestedDensity float64
+}
+
+//Traffic summarizes the traffic flows observed on a road segment during a window
+type Traffic struct {
+	Intensity int
+	Lanes     int
+	// AverageVehicleSpeed is the intensity weighted average speed in km/h
+	AverageVehicleSpeed float64
+	SpeedLimit          float64
+	Window              time.Duration
+}
+
+//SpeedRatio returns the ratio of the average vehicle speed to the speed limit
+func (t Traffic) SpeedRatio() float64 {
+	return t.AverageVehicleSpeed / t.SpeedLimit
+}
+
+//Density returns the number of vehicles per kilometer and lane, i.e. the hourly flow per lane
+//divided by the speed
+func (t Traffic) Density() float64 {
+	if t.Lanes == 0 || t.AverageVehicleSpeed <= 0 || t.Window <= 0 {
+		return 0
+	}
+
+	flow := float64(t.Intensity) / float64(t.Lanes) / t.Window.Hours()
+	return flow / t.AverageVehicleSpeed
+}
+
+//LoadThresholds reads the congestion thresholds from the environment variables that start
+//with TRANSPORTATION_CONGESTION_
+func LoadThresholds() (*Thresholds, error) {
+	window, err := time.ParseDuration(env.GetVariableOrDefault("TRANSPORTATION_CONGESTION_WINDOW", "15m"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse congestion window: %s", err.Error())
+	}
+
+	minIntensity, err := strconv.Atoi(env.GetVariableOrDefault("TRANSPORTATION_CONGESTION_MIN_INTENSITY", "5"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse congestion min intensity: %s", err.Error())
+	}
+
+	values := map[string]float64{}
+	for key, fallback := range map[string]string{
+		"DENSE_RATIO":       "0.8",
+		"CONGESTED_RATIO":   "0.5",
+		"DENSE_DENSITY":     "20",
+		"CONGESTED_DENSITY": "40",
+	} {
+		values[key], err = strconv.ParseFloat(env.GetVariableOrDefault("TRANSPORTATION_CONGESTION_"+key, fallback), 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse congestion %s: %s", key, err.Error())
+		}
+	}
+
+	return NewThresholds(window, minIntensity, values["DENSE_RATIO"], values["CONGESTED_RATIO"], values["DENSE_DENSITY"], values["CONGESTED_DENSITY"])
+}
+
+//NewThresholds validates a set of congestion thresholds
+func NewThresholds(window time.Duration, minIntensity int, denseRatio, congestedRatio, denseDensity, congestedDensity float64) (*Thresholds, error) {
+	if window <= 0 {
+		return nil, fmt.Errorf("the congestion window must be positive")
+	}
+
+	if congestedRatio <= 0 || congestedRatio > denseRatio || denseRatio > 1 {
+		return nil, fmt.Errorf("the congestion speed ratios must satisfy 0 < congested <= dense <= 1")
+	}
+
+	if denseDensity <= 0 || congestedDensity < denseDensity {
+		return nil, fmt.Errorf("the congestion densities must satisfy 0 < dense <= congested")
+	}
+
+	return &Thresholds{
+		Window:           window,
+		MinIntensity:     minIntensity,
+		DenseRatio:       denseRatio,
+		CongestedRatio:   congestedRatio,
+		DenseDensity:     denseDensity,
+		CongestedDensity: congestedDensity,
+	}, nil
+}
+
+//Level returns the congestion level of the observed traffic. Too few vehicles to trust the
+//speed means that traffic is flowing freely.
+func (t *Thresholds) Level(traffic Traffic) string {
+	if traffic.Intensity < t.MinIntensity || traffic.SpeedLimit <= 0 {
+		return FreeFlow
+	}
+
+	ratio, density := traffic.SpeedRatio(), traffic.Density()
+
+	if ratio < t.CongestedRatio || density >= t.CongestedDensity {
+		return Congested
+	}
+
+	if ratio < t.DenseRatio || density >= t.DenseDensity {
+		return Dense
+	}
+
+	return FreeFlow
+}
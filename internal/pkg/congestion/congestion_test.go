@@ -0,0 +1,37 @@
+package congestion_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/diwise/api-transportation/internal/pkg/congestion"
+	"github.com/matryer/is"
+)
+
+func TestThatTheLevelFollowsTheSpeedRatioAndDensity(t *testing.T) {
+	is := is.New(t)
+
+	thresholds, err := congestion.LoadThresholds()
+	is.NoErr(err)
+
+	traffic := func(intensity, lanes int, speed float64) congestion.Traffic {
+		return congestion.Traffic{Intensity: intensity, Lanes: lanes, AverageVehicleSpeed: speed, SpeedLimit: 50, Window: 15 * time.Minute}
+	}
+
+	is.Equal(thresholds.Level(traffic(20, 1, 48)), congestion.FreeFlow)  // close to the speed limit
+	is.Equal(thresholds.Level(traffic(20, 1, 35)), congestion.Dense)     // 70% of the speed limit
+	is.Equal(thresholds.Level(traffic(20, 1, 20)), congestion.Congested) // 40% of the speed limit
+	is.Equal(thresholds.Level(traffic(3, 1, 10)), congestion.FreeFlow)   // too few vehicles to trust the speed
+	is.Equal(thresholds.Level(traffic(250, 1, 45)), congestion.Dense)    // 1000 vehicles per hour at 45 km/h is 22 per km
+	is.Equal(thresholds.Level(traffic(250, 2, 45)), congestion.FreeFlow) // but only 11 per km and lane on two lanes
+}
+
+func TestThatInconsistentThresholdsAreRejected(t *testing.T) {
+	is := is.New(t)
+
+	_, err := congestion.NewThresholds(15*time.Minute, 5, 0.5, 0.8, 20, 40)
+	is.True(err != nil) // traffic can not be congested at a higher speed than it is dense
+
+	_, err = congestion.NewThresholds(15*time.Minute, 5, 0.8, 0.5, 40, 20)
+	is.True(err != nil) // traffic can not be congested at a lower density than it is dense
+}
@@ -0,0 +1,208 @@
+package database
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+//TimeBucket is the size of the time intervals that observations are grouped into
+type TimeBucket string
+
+const (
+	//Bucket15Minutes groups observations into quarters of an hour
+	Bucket15Minutes TimeBucket = "15min"
+	//BucketHour groups observations by hour
+	BucketHour TimeBucket = "hour"
+	//BucketDay groups observations by (UTC) day
+	BucketDay TimeBucket = "day"
+	//BucketWeek groups observations by ISO week, i.e. weeks that start on a monday
+	BucketWeek TimeBucket = "week"
+)
+
+//bucketSizes maps the time buckets to their length and offset from the unix epoch, in seconds.
+//The epoch is a thursday, so weeks are offset by four days to make them start on mondays.
+var bucketSizes = map[TimeBucket][2]int64{
+	Bucket15Minutes: {15 * 60, 0},
+	BucketHour:      {60 * 60, 0},
+	BucketDay:       {24 * 60 * 60, 0},
+	BucketWeek:      {7 * 24 * 60 * 60, 4 * 24 * 60 * 60},
+}
+
+//ParseTimeBucket returns the TimeBucket with the given name
+func ParseTimeBucket(name string) (TimeBucket, error) {
+	bucket := TimeBucket(name)
+	if _, ok := bucketSizes[bucket]; !ok {
+		return "", fmt.Errorf("unknown time bucket %s", name)
+	}
+
+	return bucket, nil
+}
+
+//End returns the end of the bucket that starts at start
+func (b TimeBucket) End(start time.Time) time.Time {
+	return start.Add(time.Duration(bucketSizes[b][0]) * time.Second)
+}
+
+//TrafficFlowAggregation describes how traffic flow observations should be aggregated
+type TrafficFlowAggregation struct {
+	Bucket TimeBucket
+	// GroupByLane and GroupByRoadSegment split every time bucket into one aggregate per lane
+	// and/or road segment
+	GroupByLane        bool
+	GroupByRoadSegment bool
+	// Percentiles are the (nearest rank) percentiles of the intensity, between 0 and 100,
+	// that should be computed for each aggregate
+	Percentiles []float64
+}
+
+//TrafficFlowAggregate summarizes the traffic flow observations within a time bucket
+type TrafficFlowAggregate struct {
+	BucketStart time.Time
+	// LaneID and RoadSegmentID are only set when the aggregation is grouped by them
+	LaneID        *int
+	RoadSegmentID *string
+
+	Observations  int64
+	IntensitySum  int64
+	IntensityMean float64
+	// AverageSpeed is the mean of the average vehicle speeds weighted by intensity, or nil
+	// if none of the observations in the bucket had a speed
+	AverageSpeed *float64
+	// Percentiles has one value per requested percentile, in the same order
+	Percentiles []int64
+}
+
+//epochSQL returns an expression that converts the observation time of a row to seconds since
+//the unix epoch, since the date functions of the supported databases have nothing in common
+func (db *myDB) epochSQL(column string) string {
+	if db.impl.Dialector.Name() == "postgres" {
+		return fmt.Sprintf("CAST(EXTRACT(EPOCH FROM %s) AS BIGINT)", column)
+	}
+
+	return fmt.Sprintf("CAST(strftime('%%s', %s) AS INTEGER)", column)
+}
+
+//AggregateTrafficFlowsObserved groups the traffic flow observations that match the query by
+//time bucket and, optionally, lane and road segment. Everything is computed by the database.
+//Observations that have been rolled up by the retention policy are aggregated through their
+//hourly aggregates, which count as one observation each.
+func (db *myDB) AggregateTrafficFlowsObserved(query ObservationQuery, aggregation TrafficFlowAggregation) ([]TrafficFlowAggregate, error) {
+	size, ok := bucketSizes[aggregation.Bucket]
+	if !ok {
+		return nil, fmt.Errorf("unknown time bucket %s", aggregation.Bucket)
+	}
+
+	for _, p := range aggregation.Percentiles {
+		if math.IsNaN(p) || p <= 0 || p > 100 {
+			return nil, fmt.Errorf("percentile %g is not within (0, 100]", p)
+		}
+	}
+
+	bucketSQL := fmt.Sprintf(
+		"((%s - %d) / %d) * %d + %d",
+		db.epochSQL("date_observed"), size[1], size[0], size[0], size[1],
+	)
+
+	partition := []string{bucketSQL}
+	groups := []string{"t.bucket"}
+	laneSQL, segmentSQL := "NULL", "NULL"
+
+	if aggregation.GroupByLane {
+		partition = append(partition, "lane_id")
+		groups = append(groups, "t.lane_id")
+		laneSQL = "t.lane_id"
+	}
+
+	if aggregation.GroupByRoadSegment {
+		partition = append(partition, "road_segment_id")
+		groups = append(groups, "road_segments.segment_id")
+		segmentSQL = "road_segments.segment_id"
+	}
+
+	partitionSQL := strings.Join(partition, ", ")
+
+	// The rows within each group are ranked by intensity, so that the percentiles can be
+	// picked with plain aggregate functions in the outer query
+	inner := db.trafficFlowsObservedSource().Select(fmt.Sprintf(
+		"%s AS bucket, lane_id, road_segment_id, intensity, average_vehicle_speed, "+
+			"ROW_NUMBER() OVER (PARTITION BY %s ORDER BY intensity) AS intensity_rank, "+
+			"COUNT(*) OVER (PARTITION BY %s) AS group_size",
+		bucketSQL, partitionSQL, partitionSQL,
+	))
+
+	inner, err := insertObservationFilterSQL(inner, trafficFlowObservedTable, query)
+	if err != nil {
+		return nil, err
+	}
+
+	columns := []string{
+		"t.bucket",
+		laneSQL,
+		segmentSQL,
+		"COUNT(*)",
+		"SUM(t.intensity)",
+		"AVG(t.intensity * 1.0)",
+		"SUM(CASE WHEN t.average_vehicle_speed > 0 THEN t.average_vehicle_speed * t.intensity END) / " +
+			"NULLIF(SUM(CASE WHEN t.average_vehicle_speed > 0 THEN t.intensity END), 0)",
+	}
+
+	// The nearest rank percentile is the smallest value whose rank is at least p percent of the group
+	for _, p := range aggregation.Percentiles {
+		columns = append(columns, fmt.Sprintf("MIN(CASE WHEN t.intensity_rank * 100 >= %g * t.group_size THEN t.intensity END)", p))
+	}
+
+	outer := db.impl.Table("(?) AS t", inner).
+		Select(strings.Join(columns, ", ")).
+		Joins("LEFT JOIN road_segments ON road_segments.id = t.road_segment_id").
+		Group(strings.Join(groups, ", ")).
+		Order(strings.Join(groups, ", "))
+
+	rows, err := outer.Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	aggregates := []TrafficFlowAggregate{}
+
+	for rows.Next() {
+		var bucket int64
+		var laneID *int
+		var segmentID *string
+
+		aggregate := TrafficFlowAggregate{Percentiles: make([]int64, len(aggregation.Percentiles))}
+
+		values := []interface{}{
+			&bucket, &laneID, &segmentID,
+			&aggregate.Observations, &aggregate.IntensitySum, &aggregate.IntensityMean, &aggregate.AverageSpeed,
+		}
+		for idx := range aggregate.Percentiles {
+			values = append(values, &aggregate.Percentiles[idx])
+		}
+
+		err = rows.Scan(values...)
+		if err != nil {
+			return nil, err
+		}
+
+		aggregate.BucketStart = time.Unix(bucket, 0).UTC()
+
+		if aggregation.GroupByLane {
+			aggregate.LaneID = laneID
+		}
+
+		if aggregation.GroupByRoadSegment {
+			// Observations without a road segment are grouped together under an empty id
+			if segmentID == nil {
+				segmentID = new(string)
+			}
+			aggregate.RoadSegmentID = segmentID
+		}
+
+		aggregates = append(aggregates, aggregate)
+	}
+
+	return aggregates, rows.Err()
+}
@@ -0,0 +1,132 @@
+package database
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/diwise/api-transportation/internal/pkg/persistence"
+)
+
+//TrafficFlowBaseline is the normal intensity of a lane of a road segment during one hour of
+//the week. Weekdays and hours are in UTC.
+type TrafficFlowBaseline struct {
+	SegmentID string
+	LaneID    int
+	Weekday   time.Weekday
+	Hour      int
+
+	Samples int64
+	Mean    float64
+	StdDev  float64
+}
+
+//GetTrafficFlowBaselines learns the baselines of all lanes of all road segments from the traffic
+//flows that were observed within a time range. Observations without a road segment are ignored.
+//Only raw observations are used, since the intensity of an hourly aggregate is not comparable
+//with the intensity of the single observations that are checked against the baselines.
+func (db *myDB) GetTrafficFlowBaselines(from, to time.Time) ([]TrafficFlowBaseline, error) {
+	epoch := db.epochSQL("date_observed")
+	// The unix epoch is a thursday, i.e. four days after the sunday that starts a time.Weekday
+	weekdaySQL := fmt.Sprintf("((%s / 86400) + 4) %% 7", epoch)
+	hourSQL := fmt.Sprintf("(%s / 3600) %% 24", epoch)
+
+	rows := []struct {
+		SegmentID  string
+		LaneID     int
+		Weekday    int
+		Hour       int
+		Samples    int64
+		Mean       float64
+		MeanSquare float64
+	}{}
+
+	gorm := insertTemporalSQL(db.impl.Model(&persistence.TrafficFlowObserved{}), "date_observed", from, to)
+	result := gorm.
+		Select(fmt.Sprintf(
+			"road_segments.segment_id AS segment_id, lane_id, %s AS weekday, %s AS hour, COUNT(*) AS samples, "+
+				"AVG(intensity * 1.0) AS mean, AVG(intensity * intensity * 1.0) AS mean_square",
+			weekdaySQL, hourSQL,
+		)).
+		Joins("JOIN road_segments ON road_segments.id = traffic_flow_observeds.road_segment_id").
+		Group(fmt.Sprintf("road_segments.segment_id, lane_id, %s, %s", weekdaySQL, hourSQL)).
+		Scan(&rows)
+
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	baselines := []TrafficFlowBaseline{}
+	for _, r := range rows {
+		baselines = append(baselines, TrafficFlowBaseline{
+			SegmentID: r.SegmentID,
+			LaneID:    r.LaneID,
+			Weekday:   time.Weekday(r.Weekday),
+			Hour:      r.Hour,
+			Samples:   r.Samples,
+			Mean:      r.Mean,
+			// The variance may end up slightly negative due to rounding errors
+			StdDev: math.Sqrt(math.Max(r.MeanSquare-r.Mean*r.Mean, 0)),
+		})
+	}
+
+	return baselines, nil
+}
+
+//CreateTrafficFlowAnomaly stores an anomaly, unless an anomaly has already been stored for the
+//same observation. It returns the stored anomaly and a flag indicating if it was created.
+func (db *myDB) CreateTrafficFlowAnomaly(anomaly persistence.TrafficFlowAnomaly) (*persistence.TrafficFlowAnomaly, bool, error) {
+	if anomaly.TrafficFlowObservedID == "" {
+		return nil, false, fmt.Errorf("an anomaly must refer to a traffic flow observation")
+	}
+
+	existing, err := db.findTrafficFlowAnomaly(anomaly.TrafficFlowObservedID)
+	if err != nil || existing != nil {
+		return existing, false, err
+	}
+
+	result := db.impl.Create(&anomaly)
+	if result.Error != nil {
+		// Another instance may have stored the same anomaly after we looked for it
+		existing, err = db.findTrafficFlowAnomaly(anomaly.TrafficFlowObservedID)
+		if err != nil || existing == nil {
+			return nil, false, result.Error
+		}
+		return existing, false, nil
+	}
+
+	return &anomaly, true, nil
+}
+
+func (db *myDB) findTrafficFlowAnomaly(observationID string) (*persistence.TrafficFlowAnomaly, error) {
+	anomalies := []persistence.TrafficFlowAnomaly{}
+
+	result := db.impl.Where("traffic_flow_observed_id = ?", observationID).Limit(1).Find(&anomalies)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	if len(anomalies) == 0 {
+		return nil, nil
+	}
+
+	return &anomalies[0], nil
+}
+
+//GetTrafficFlowAnomalies returns the anomalies among the traffic flows that were observed within
+//a time range, optionally limited to a single road segment, with the most recent first
+func (db *myDB) GetTrafficFlowAnomalies(from, to time.Time, segmentID string) ([]persistence.TrafficFlowAnomaly, error) {
+	anomalies := []persistence.TrafficFlowAnomaly{}
+
+	gorm := insertTemporalSQL(db.impl, "date_observed", from, to)
+	if segmentID != "" {
+		gorm = gorm.Where("segment_id = ?", segmentID)
+	}
+
+	result := gorm.Order("date_observed desc").Order("id").Find(&anomalies)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return anomalies, nil
+}
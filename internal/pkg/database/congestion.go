@@ -0,0 +1,146 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/diwise/api-transportation/internal/pkg/congestion"
+	"github.com/diwise/api-transportation/internal/pkg/persistence"
+)
+
+//RoadSegmentTraffic holds the speed limit of a road segment and its most recent congestion
+//level, if any
+type RoadSegmentTraffic struct {
+	SpeedLimit *float64
+	Congestion *persistence.RoadSegmentCongestion
+}
+
+//SetRoadSegmentSpeedLimit sets the speed limit of a road segment in km/h
+func (db *myDB) SetRoadSegmentSpeedLimit(segmentID string, speedLimit float64) error {
+	if speedLimit <= 0 {
+		return fmt.Errorf("the speed limit %g of road segment %s must be positive", speedLimit, segmentID)
+	}
+
+	segment := &persistence.RoadSegment{SegmentID: segmentID}
+	result := db.impl.Where(segment).First(segment)
+
+	if result.RowsAffected == 0 {
+		_, err := db.addNewRoadSegment(segmentID)
+		if err != nil {
+			return err
+		}
+		_ = db.impl.Where(segment).First(segment)
+	}
+
+	result = db.impl.Model(segment).Update("maximum_allowed_speed", speedLimit)
+	return result.Error
+}
+
+//roadSegmentTrafficBatchSize limits the number of segment ids in each query, so that the
+//queries stay within the number of parameters that the databases accept
+const roadSegmentTrafficBatchSize int = 500
+
+//GetRoadSegmentTraffic returns the speed limits and congestion levels of those of the given road
+//segments that have either, keyed by segment id
+func (db *myDB) GetRoadSegmentTraffic(segmentIDs []string) (map[string]RoadSegmentTraffic, error) {
+	traffic := map[string]RoadSegmentTraffic{}
+
+	for first := 0; first < len(segmentIDs); first += roadSegmentTrafficBatchSize {
+		last := first + roadSegmentTrafficBatchSize
+		if last > len(segmentIDs) {
+			last = len(segmentIDs)
+		}
+		ids := segmentIDs[first:last]
+
+		segments := []persistence.RoadSegment{}
+		result := db.impl.Where("segment_id IN ? AND maximum_allowed_speed IS NOT NULL", ids).Find(&segments)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+
+		for _, s := range segments {
+			traffic[s.SegmentID] = RoadSegmentTraffic{SpeedLimit: s.MaximumAllowedSpeed}
+		}
+
+		congestions := []persistence.RoadSegmentCongestion{}
+		result = db.impl.Where("segment_id IN ?", ids).Find(&congestions)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+
+		for idx := range congestions {
+			t := traffic[congestions[idx].SegmentID]
+			t.Congestion = &congestions[idx]
+			traffic[congestions[idx].SegmentID] = t
+		}
+	}
+
+	return traffic, nil
+}
+
+//UpdateRoadSegmentCongestion decides the congestion level of a road segment from the traffic
+//flows observed on it during the window that ends at observedAt. It returns the stored level
+//together with the level it replaced, or nil if the segment lacks a speed limit, the observations
+//lack speeds or a more recent level has already been stored. Only raw observations are read,
+//since the window is far shorter than the time that raw observations are kept.
+func (db *myDB) UpdateRoadSegmentCongestion(segmentID string, observedAt time.Time) (*persistence.RoadSegmentCongestion, string, error) {
+	segment := &persistence.RoadSegment{}
+	result := db.impl.Where("segment_id = ?", segmentID).Limit(1).Find(segment)
+	if result.Error != nil || result.RowsAffected == 0 || segment.MaximumAllowedSpeed == nil {
+		return nil, "", result.Error
+	}
+
+	current := persistence.RoadSegmentCongestion{SegmentID: segmentID}
+	result = db.impl.Where("segment_id = ?", segmentID).Limit(1).Find(&current)
+	if result.Error != nil {
+		return nil, "", result.Error
+	}
+
+	previousLevel := current.Level
+	if previousLevel != "" && observedAt.Before(current.ObservedAt) {
+		return nil, "", nil
+	}
+
+	summary := struct {
+		Intensity      int
+		Lanes          int
+		SpeedSum       *float64
+		SpeedIntensity *int
+	}{}
+
+	result = db.impl.Model(&persistence.TrafficFlowObserved{}).
+		Select("COALESCE(SUM(intensity), 0) AS intensity, COUNT(DISTINCT lane_id) AS lanes, "+
+			"SUM(CASE WHEN average_vehicle_speed > 0 THEN average_vehicle_speed * intensity END) AS speed_sum, "+
+			"SUM(CASE WHEN average_vehicle_speed > 0 THEN intensity END) AS speed_intensity").
+		Where("road_segment_id = ?", segment.ID).
+		Where("date_observed > ? AND date_observed <= ?", observedAt.Add(-db.thresholds.Window), observedAt).
+		Scan(&summary)
+	if result.Error != nil {
+		return nil, "", result.Error
+	}
+
+	if summary.SpeedIntensity == nil || *summary.SpeedIntensity == 0 {
+		return nil, "", nil
+	}
+
+	traffic := congestion.Traffic{
+		Intensity:           summary.Intensity,
+		Lanes:               summary.Lanes,
+		AverageVehicleSpeed: *summary.SpeedSum / float64(*summary.SpeedIntensity),
+		SpeedLimit:          *segment.MaximumAllowedSpeed,
+		Window:              db.thresholds.Window,
+	}
+
+	current.Level = db.thresholds.Level(traffic)
+	current.AverageVehicleSpeed = traffic.AverageVehicleSpeed
+	current.SpeedRatio = traffic.SpeedRatio()
+	current.Intensity = traffic.Intensity
+	current.ObservedAt = observedAt.UTC()
+
+	result = db.impl.Save(&current)
+	if result.Error != nil {
+		return nil, "", result.Error
+	}
+
+	return &current, previousLevel, nil
+}
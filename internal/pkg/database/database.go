@@ -6,11 +6,16 @@ import (
 	"io"
 	"math"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/diwise/api-transportation/internal/pkg/congestion"
+	"github.com/diwise/api-transportation/internal/pkg/env"
 	"github.com/diwise/api-transportation/internal/pkg/persistence"
+	"github.com/diwise/api-transportation/internal/pkg/surface"
 	"github.com/diwise/ngsi-ld-golang/pkg/datamodels/diwise"
 	"github.com/diwise/ngsi-ld-golang/pkg/datamodels/fiware"
 	log "github.com/sirupsen/logrus"
@@ -35,6 +40,16 @@ func NewPoint(lat, lon float64) Point {
 	return Point{lat: lat, lon: lon}
 }
 
+//Latitude returns the latitude of the point
+func (p Point) Latitude() float64 {
+	return p.lat
+}
+
+//Longitude returns the longitude of the point
+func (p Point) Longitude() float64 {
+	return p.lon
+}
+
 //IsBoundedBy returns true if the point is bounded by the provided bounding box
 func (p Point) IsBoundedBy(box *Rectangle) bool {
 	if box.northWest.lon < p.lon && box.southEast.lon > p.lon &&
@@ -62,6 +77,16 @@ func NewRectangle(pt1 Point, pt2 Point) Rectangle {
 	return Rectangle{northWest: nw, southEast: se}
 }
 
+//NorthWest returns the north western corner of the rectangle
+func (r Rectangle) NorthWest() Point {
+	return r.northWest
+}
+
+//SouthEast returns the south eastern corner of the rectangle
+func (r Rectangle) SouthEast() Point {
+	return r.southEast
+}
+
 //NewBoundingBoxFromRectangles creates a new instance of a Rectangle by creating a union of two others
 func NewBoundingBoxFromRectangles(rect1, rect2 Rectangle) Rectangle {
 
@@ -117,8 +142,10 @@ type Road interface {
 	GetSegmentsWithinRect(Rectangle) ([]RoadSegment, uint64)
 
 	BoundingBox() Rectangle
+	DistanceFromPoint(pt Point) uint64
 	IsWithinDistanceFromPoint(maxDistance uint64, pt Point) bool
 
+	DateModified() *time.Time
 	setLastModified(timestamp *time.Time)
 }
 
@@ -127,7 +154,11 @@ type roadImpl struct {
 
 	segments []RoadSegment
 
-	bbox     Rectangle
+	bbox Rectangle
+
+	// mu guards the time of modification, which is updated by the messaging handlers while
+	// the road is read by the API
+	mu       sync.RWMutex
 	modified *time.Time
 }
 
@@ -186,6 +217,26 @@ func (r *roadImpl) GetSegmentsWithinRect(rect Rectangle) ([]RoadSegment, uint64)
 	return matchingSegments, count
 }
 
+func (r *roadImpl) DateModified() *time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.modified
+}
+
+func (r *roadImpl) DistanceFromPoint(pt Point) uint64 {
+	distance := uint64(math.MaxUint64)
+
+	for _, segment := range r.segments {
+		segmentDistance := segment.DistanceFromPoint(pt)
+		if segmentDistance < distance {
+			distance = segmentDistance
+		}
+	}
+
+	return distance
+}
+
 func (r *roadImpl) ID() string {
 	return r.id
 }
@@ -195,7 +246,12 @@ func (r *roadImpl) IsWithinDistanceFromPoint(maxDistance uint64, pt Point) bool
 }
 
 func (r *roadImpl) setLastModified(timestamp *time.Time) {
-	r.modified = timestamp
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.modified == nil || r.modified.Before(*timestamp) {
+		r.modified = timestamp
+	}
 }
 
 func newRoad(id string, segment RoadSegment) Road {
@@ -212,10 +268,17 @@ type RoadSegment interface {
 	RoadID() string
 	BoundingBox() Rectangle
 	Coordinates() [][2]float64
+	DistanceFromPoint(Point) uint64
 	IsWithinDistanceFromPoint(uint64, Point) bool
 	SurfaceType() (string, float64)
+	SurfacePrediction() *SurfacePrediction
+	SurfaceMaterial() *SurfacePrediction
+	SurfaceCondition() *SurfacePrediction
+	SurfaceDatasets() []*SurfacePrediction
+	SurfaceDataset(datasetID string) *SurfacePrediction
 
-	setSurfaceType(surfaceType string, probability float64)
+	setSurfaceType(prediction SurfacePrediction, policy DatasetPolicy)
+	expireCondition(freshness *surface.Freshness, now time.Time) bool
 
 	DateModified() *time.Time
 	IsModified() bool
@@ -229,12 +292,95 @@ type roadSegmentImpl struct {
 	lines []RoadSegmentLine
 	bbox  Rectangle
 
-	surfaceType            string
-	surfaceTypeProbability float64
+	// mu guards the surface predictions and the time of modification, which are updated by
+	// the messaging handlers and the expiry watcher while the segment is read by the API
+	mu sync.RWMutex
+
+	// surface is the default prediction, picked among the most recent prediction of each
+	// dataset by the datastore's dataset policy
+	surface  *SurfacePrediction
+	datasets map[string]*SurfacePrediction
+
+	// The most recent surface material and condition are kept apart, so that a change of
+	// the weather does not hide what the road is paved with and vice versa
+	surfaceMaterial  *SurfacePrediction
+	surfaceCondition *SurfacePrediction
+	// conditionExpired is set when the expiry of the current condition has been reported
+	conditionExpired bool
 
 	modified *time.Time
 }
 
+//SurfacePrediction is a prediction of the surface type of a road segment at a certain time.
+//SurfaceType and Probability holds the most probable surface type of the distribution.
+type SurfacePrediction struct {
+	SurfaceType  string
+	Kind         string
+	Probability  float64
+	Timestamp    time.Time
+	Distribution map[string]float64
+	Provenance   Provenance
+}
+
+const (
+	//SourceModel is the source of predictions made by a classifier, e.g. a camera model
+	SourceModel string = "model"
+	//SourceManual is the source of predictions that have been entered by a person
+	SourceManual string = "manual"
+	//SourceFusion is the source of predictions that have been fused from observations
+	SourceFusion string = "fusion"
+)
+
+//Provenance describes where a prediction came from: the kind of source, the name and version
+//of the model that made it, if any, and the client that submitted it
+type Provenance struct {
+	Source       string
+	Model        string
+	ModelVersion string
+	Client       string
+}
+
+//DatasetID returns an identity of the source, model and model version of a prediction that
+//can be used as an NGSI-LD datasetId, or an empty string if the source is unknown
+func (p Provenance) DatasetID() string {
+	if p.Source == "" {
+		return ""
+	}
+
+	datasetID := "urn:ngsi-ld:Dataset:" + p.Source
+	if p.Model != "" {
+		datasetID = datasetID + ":" + p.Model
+		if p.ModelVersion != "" {
+			datasetID = datasetID + ":" + p.ModelVersion
+		}
+	}
+
+	return datasetID
+}
+
+//NewSurfacePrediction creates a prediction with a single surface type
+func NewSurfacePrediction(surfaceType string, probability float64, timestamp time.Time) SurfacePrediction {
+	return SurfacePrediction{
+		SurfaceType:  surfaceType,
+		Probability:  probability,
+		Timestamp:    timestamp,
+		Distribution: map[string]float64{surfaceType: probability},
+	}
+}
+
+//NewSurfacePredictionFromDistribution creates a prediction from a distribution of surface
+//types and their probabilities
+func NewSurfacePredictionFromDistribution(distribution map[string]float64, timestamp time.Time) SurfacePrediction {
+	surfaceType, probability := surface.MostProbable(distribution)
+
+	return SurfacePrediction{
+		SurfaceType:  surfaceType,
+		Probability:  probability,
+		Timestamp:    timestamp,
+		Distribution: distribution,
+	}
+}
+
 func (seg *roadSegmentImpl) ID() string {
 	return seg.id
 }
@@ -257,6 +403,19 @@ func (seg *roadSegmentImpl) Coordinates() [][2]float64 {
 	return coords
 }
 
+func (seg *roadSegmentImpl) DistanceFromPoint(pt Point) uint64 {
+	distance := uint64(math.MaxUint64)
+
+	for _, line := range seg.lines {
+		lineDistance := line.BoundingBox().DistanceFromPoint(pt)
+		if lineDistance < distance {
+			distance = lineDistance
+		}
+	}
+
+	return distance
+}
+
 func (seg *roadSegmentImpl) IsWithinDistanceFromPoint(maxDistance uint64, pt Point) bool {
 
 	for _, line := range seg.lines {
@@ -269,23 +428,131 @@ func (seg *roadSegmentImpl) IsWithinDistanceFromPoint(maxDistance uint64, pt Poi
 }
 
 func (seg *roadSegmentImpl) SurfaceType() (string, float64) {
-	return seg.surfaceType, seg.surfaceTypeProbability
+	seg.mu.RLock()
+	defer seg.mu.RUnlock()
+
+	if seg.surface == nil {
+		return "", 0
+	}
+
+	return seg.surface.SurfaceType, seg.surface.Probability
 }
 
-func (seg *roadSegmentImpl) setSurfaceType(surfaceType string, probability float64) {
-	seg.surfaceType = surfaceType
-	seg.surfaceTypeProbability = probability
+func (seg *roadSegmentImpl) SurfacePrediction() *SurfacePrediction {
+	seg.mu.RLock()
+	defer seg.mu.RUnlock()
+
+	return seg.surface
+}
+
+func (seg *roadSegmentImpl) SurfaceMaterial() *SurfacePrediction {
+	seg.mu.RLock()
+	defer seg.mu.RUnlock()
+
+	return seg.surfaceMaterial
+}
+
+func (seg *roadSegmentImpl) SurfaceCondition() *SurfacePrediction {
+	seg.mu.RLock()
+	defer seg.mu.RUnlock()
+
+	return seg.surfaceCondition
+}
+
+//SurfaceDatasets returns the most recent prediction of every dataset, ordered by dataset id
+func (seg *roadSegmentImpl) SurfaceDatasets() []*SurfacePrediction {
+	seg.mu.RLock()
+	defer seg.mu.RUnlock()
+
+	return seg.surfaceDatasets()
+}
+
+func (seg *roadSegmentImpl) surfaceDatasets() []*SurfacePrediction {
+	predictions := []*SurfacePrediction{}
+	for _, prediction := range seg.datasets {
+		predictions = append(predictions, prediction)
+	}
+
+	sort.Slice(predictions, func(i, j int) bool {
+		return predictions[i].Provenance.DatasetID() < predictions[j].Provenance.DatasetID()
+	})
+
+	return predictions
+}
+
+//SurfaceDataset returns the most recent prediction of a dataset, or nil if the dataset has
+//not made any predictions for this segment
+func (seg *roadSegmentImpl) SurfaceDataset(datasetID string) *SurfacePrediction {
+	seg.mu.RLock()
+	defer seg.mu.RUnlock()
+
+	return seg.datasets[datasetID]
+}
+
+//setSurfaceType stores the prediction of a dataset and selects the surface type of the segment
+//anew. Events may arrive out of order, so a prediction that is older than the one already stored
+//for its dataset is ignored.
+func (seg *roadSegmentImpl) setSurfaceType(prediction SurfacePrediction, policy DatasetPolicy) {
+	seg.mu.Lock()
+	defer seg.mu.Unlock()
+
+	if seg.datasets == nil {
+		seg.datasets = map[string]*SurfacePrediction{}
+	}
+
+	datasetID := prediction.Provenance.DatasetID()
+	if stored, ok := seg.datasets[datasetID]; ok && prediction.Timestamp.Before(stored.Timestamp) {
+		return
+	}
+
+	seg.datasets[datasetID] = &prediction
+	seg.surface = policy.Select(seg.surfaceDatasets())
+
+	if prediction.Kind == surface.Material && !isOlderPrediction(prediction, seg.surfaceMaterial) {
+		seg.surfaceMaterial = &prediction
+	} else if prediction.Kind == surface.Condition && !isOlderPrediction(prediction, seg.surfaceCondition) {
+		seg.surfaceCondition = &prediction
+		seg.conditionExpired = false
+	}
+}
+
+func isOlderPrediction(prediction SurfacePrediction, current *SurfacePrediction) bool {
+	return current != nil && prediction.Timestamp.Before(current.Timestamp)
+}
+
+//expireCondition returns true if the current surface condition has become stale since the
+//last time this segment was checked
+func (seg *roadSegmentImpl) expireCondition(freshness *surface.Freshness, now time.Time) bool {
+	seg.mu.Lock()
+	defer seg.mu.Unlock()
+
+	if seg.surfaceCondition == nil || seg.conditionExpired {
+		return false
+	}
+
+	if freshness.IsStale(surface.Condition, seg.surfaceCondition.Timestamp, now) {
+		seg.conditionExpired = true
+		return true
+	}
+
+	return false
 }
 
 func (seg *roadSegmentImpl) DateModified() *time.Time {
+	seg.mu.RLock()
+	defer seg.mu.RUnlock()
+
 	return seg.modified
 }
 
 func (seg *roadSegmentImpl) IsModified() bool {
-	return seg.modified != nil
+	return seg.DateModified() != nil
 }
 
 func (seg *roadSegmentImpl) setLastModified(timestamp *time.Time) {
+	seg.mu.Lock()
+	defer seg.mu.Unlock()
+
 	if seg.modified == nil || seg.modified.Before(*timestamp) {
 		seg.modified = timestamp
 	}
@@ -353,18 +620,84 @@ type Datastore interface {
 	GetRoadsWithinRect(lat0, lon0, lat1, lon1 float64) ([]Road, error)
 
 	GetRoadSegmentByID(id string) (RoadSegment, error)
+	GetRoadSegmentCount() int
 
 	GetSegmentsNearPoint(lat, lon float64, maxDistance uint64) ([]RoadSegment, error)
 	GetSegmentsWithinRect(lat0, lon0, lat1, lon1 float64) ([]RoadSegment, error)
 
 	RoadSegmentSurfaceUpdated(segmentID, surfaceType string, probability float64, timestamp time.Time) error
+	RoadSegmentSurfacePredictionUpdated(segmentID string, prediction SurfacePrediction) error
 	UpdateRoadSegmentSurface(segmentID, surfaceType string, probability float64, timestamp time.Time) error
+	UpdateRoadSegmentSurfacePrediction(segmentID string, prediction SurfacePrediction) error
+	SelectRoadSegmentSurfacePrediction(segmentID string, prediction SurfacePrediction) (*SurfacePrediction, error)
 
 	CreateRoadSurfaceObserved(src *diwise.RoadSurfaceObserved) (*persistence.RoadSurfaceObserved, error)
 	GetRoadSurfacesObserved() ([]persistence.RoadSurfaceObserved, error)
+	QueryRoadSurfacesObserved(query ObservationQuery) ([]persistence.RoadSurfaceObserved, error)
+	CountRoadSurfacesObserved(query ObservationQuery) (uint64, error)
 
 	CreateTrafficFlowObserved(src *fiware.TrafficFlowObserved) (*persistence.TrafficFlowObserved, error)
 	GetTrafficFlowsObserved(from, to time.Time, limit int) ([]persistence.TrafficFlowObserved, error)
+	QueryTrafficFlowsObserved(query ObservationQuery) ([]persistence.TrafficFlowObserved, error)
+	CountTrafficFlowsObserved(query ObservationQuery) (uint64, error)
+	AggregateTrafficFlowsObserved(query ObservationQuery, aggregation TrafficFlowAggregation) ([]TrafficFlowAggregate, error)
+	UpsertTrafficFlowObserved(src *fiware.TrafficFlowObserved, details TrafficFlowObservedDetails) (*persistence.TrafficFlowObserved, bool, error)
+	ImportTrafficFlowsObserved(batch []ImportedTrafficFlowObserved) (*TrafficFlowImportResult, error)
+	GetTrafficFlowDuplicates(from, to time.Time) ([]TrafficFlowDuplicates, error)
+	GetTrafficFlowBaselines(from, to time.Time) ([]TrafficFlowBaseline, error)
+
+	CreateTrafficFlowAnomaly(anomaly persistence.TrafficFlowAnomaly) (*persistence.TrafficFlowAnomaly, bool, error)
+	GetTrafficFlowAnomalies(from, to time.Time, segmentID string) ([]persistence.TrafficFlowAnomaly, error)
+
+	DownsampleTrafficFlowsObserved(before time.Time) (int64, error)
+	DownsampleRoadSurfacesObserved(before time.Time) (int64, error)
+	PurgeObservationAggregates(before time.Time) (int64, error)
+
+	ClaimMessage(messageKey string) (bool, error)
+	ReleaseMessage(messageKey string) error
+	PurgeMessageClaims(before time.Time) (int64, error)
+
+	CreateSurfaceLabel(label SurfaceLabel) (*persistence.SurfaceLabel, error)
+	GetLabelledSurfacePredictions(from, to time.Time) ([]LabelledSurfacePrediction, error)
+
+	CreateAlert(alert persistence.Alert) (*persistence.Alert, error)
+	CloseAlert(alertID string, validTo time.Time) (*persistence.Alert, bool, error)
+	GetActiveAlertForSegment(segmentID string) (*persistence.Alert, error)
+	QueryAlerts(query ObservationQuery) ([]persistence.Alert, error)
+	CountAlerts(query ObservationQuery) (uint64, error)
+
+	GetEntityStatistics(typeName string) (*EntityStatistics, error)
+
+	SurfaceVocabulary() *surface.Vocabulary
+	SurfaceFreshness() *surface.Freshness
+	ExpireRoadSegmentSurfaces(now time.Time) []RoadSegment
+
+	SetRoadSegmentSpeedLimit(segmentID string, speedLimit float64) error
+	GetRoadSegmentTraffic(segmentIDs []string) (map[string]RoadSegmentTraffic, error)
+	UpdateRoadSegmentCongestion(segmentID string, observedAt time.Time) (*persistence.RoadSegmentCongestion, string, error)
+}
+
+//SurfaceLabel is a verified ground-truth surface type of a road segment at a certain time
+type SurfaceLabel struct {
+	SegmentID   string
+	SurfaceType string
+	Timestamp   time.Time
+	// Source tells how the label was verified, e.g. by an inspection
+	Source string
+	Client string
+}
+
+//LabelledSurfacePrediction is a surface prediction that was valid when a road segment was labelled
+type LabelledSurfacePrediction struct {
+	Label      persistence.SurfaceLabel
+	Prediction persistence.SurfaceTypePrediction
+}
+
+//EntityStatistics contains the number of stored entities of a certain type, and the
+//bounds of their locations if any of them has a location
+type EntityStatistics struct {
+	Count  uint64
+	Bounds *Rectangle
 }
 
 //InitFromReader takes a reader interface and initialises the datastore
@@ -435,13 +768,6 @@ func initFromReader(db *myDB, rd io.Reader) error {
 	return nil
 }
 
-func getEnv(key, fallback string) string {
-	if value, ok := os.LookupEnv(key); ok {
-		return value
-	}
-	return fallback
-}
-
 //ConnectorFunc is used to inject a database connection method into NewDatabaseConnection
 type ConnectorFunc func() (*gorm.DB, error)
 
@@ -451,7 +777,7 @@ func NewPostgreSQLConnector() ConnectorFunc {
 	username := os.Getenv("TRANSPORTATION_DB_USER")
 	dbName := os.Getenv("TRANSPORTATION_DB_NAME")
 	password := os.Getenv("TRANSPORTATION_DB_PASSWORD")
-	sslMode := getEnv("TRANSPORTATION_DB_SSLMODE", "require")
+	sslMode := env.GetVariableOrDefault("TRANSPORTATION_DB_SSLMODE", "require")
 
 	dbURI := fmt.Sprintf("host=%s user=%s dbname=%s sslmode=%s password=%s", dbHost, username, dbName, sslMode, password)
 
@@ -491,13 +817,37 @@ func NewDatabaseConnection(connect ConnectorFunc, datafile io.Reader) (Datastore
 		return nil, err
 	}
 
+	vocabulary, err := surface.LoadVocabulary()
+	if err != nil {
+		return nil, err
+	}
+
+	freshness, err := surface.LoadFreshness()
+	if err != nil {
+		return nil, err
+	}
+
+	policy, err := LoadDatasetPolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	thresholds, err := congestion.LoadThresholds()
+	if err != nil {
+		return nil, err
+	}
+
 	db := &myDB{
-		impl:     impl.Debug(),
-		roads:    map[string]Road{},
-		seg2road: map[string]string{},
+		impl:       impl.Debug(),
+		roads:      map[string]Road{},
+		seg2road:   map[string]string{},
+		vocabulary: vocabulary,
+		freshness:  freshness,
+		policy:     policy,
+		thresholds: thresholds,
 	}
 
-	db.impl.AutoMigrate(&persistence.Road{}, &persistence.RoadSegment{}, &persistence.SurfaceTypePrediction{}, &persistence.RoadSurfaceObserved{}, &persistence.TrafficFlowObserved{})
+	db.impl.AutoMigrate(&persistence.Road{}, &persistence.RoadSegment{}, &persistence.SurfaceTypePrediction{}, &persistence.SurfaceTypeProbability{}, &persistence.SurfaceLabel{}, &persistence.Alert{}, &persistence.RoadSurfaceObserved{}, &persistence.TrafficFlowObserved{}, &persistence.TrafficFlowAnomaly{}, &persistence.HourlyTrafficFlowObserved{}, &persistence.HourlyRoadSurfaceObserved{}, &persistence.RoadSegmentCongestion{}, &persistence.MessageClaim{})
 
 	if datafile != nil {
 		err := initFromReader(db, datafile)
@@ -518,32 +868,55 @@ func NewDatabaseConnection(connect ConnectorFunc, datafile io.Reader) (Datastore
 		log.Info("Reading and annotating surfaceType predictions ...")
 
 		persistedRoads := []persistence.Road{}
-		result := db.impl.Preload("RoadSegments").Preload("RoadSegments.SurfaceTypePredictions").Find(&persistedRoads)
+		result := db.impl.Preload("RoadSegments").Preload("RoadSegments.SurfaceTypePredictions").Preload("RoadSegments.SurfaceTypePredictions.Distribution").Find(&persistedRoads)
 		if result.Error != nil {
 			log.Errorf("Restore of surfaceType predictions failed with error %s", result.Error.Error())
 		} else {
 			for _, r := range persistedRoads {
 				for _, rs := range r.RoadSegments {
-					if len(rs.SurfaceTypePredictions) > 0 {
-						mostRecentPrediction := rs.SurfaceTypePredictions[0]
-
-						for _, stp := range rs.SurfaceTypePredictions {
-							if stp.Timestamp.After(mostRecentPrediction.Timestamp) {
-								mostRecentPrediction = stp
-							}
+					// Surface materials and conditions, as well as the datasets, are tracked separately,
+					// so we need the most recent prediction of each kind and dataset, replayed in
+					// chronological order
+					mostRecentPredictions := map[string]persistence.SurfaceTypePrediction{}
+
+					for _, stp := range rs.SurfaceTypePredictions {
+						provenance := Provenance{Source: stp.Source, Model: stp.ModelName, ModelVersion: stp.ModelVersion}
+						key := db.vocabulary.Kind(stp.SurfaceType) + "|" + provenance.DatasetID()
+						if mrp, ok := mostRecentPredictions[key]; !ok || stp.Timestamp.After(mrp.Timestamp) {
+							mostRecentPredictions[key] = stp
 						}
+					}
 
+					predictions := []persistence.SurfaceTypePrediction{}
+					for _, stp := range mostRecentPredictions {
+						predictions = append(predictions, stp)
+					}
+					sort.Slice(predictions, func(i, j int) bool {
+						return predictions[i].Timestamp.Before(predictions[j].Timestamp)
+					})
+
+					for _, stp := range predictions {
 						log.Infof("Annotating road segment %s: surface was %s with probability %f at %s",
-							rs.SegmentID, mostRecentPrediction.SurfaceType, mostRecentPrediction.Probability,
-							mostRecentPrediction.Timestamp.Format(time.RFC3339),
+							rs.SegmentID, stp.SurfaceType, stp.Probability,
+							stp.Timestamp.Format(time.RFC3339),
 						)
 
-						err = db.RoadSegmentSurfaceUpdated(
-							rs.SegmentID,
-							mostRecentPrediction.SurfaceType,
-							mostRecentPrediction.Probability,
-							mostRecentPrediction.Timestamp,
-						)
+						prediction := NewSurfacePrediction(stp.SurfaceType, stp.Probability, stp.Timestamp)
+						prediction.Provenance = Provenance{
+							Source:       stp.Source,
+							Model:        stp.ModelName,
+							ModelVersion: stp.ModelVersion,
+							Client:       stp.Client,
+						}
+
+						if len(stp.Distribution) > 0 {
+							prediction.Distribution = map[string]float64{}
+							for _, p := range stp.Distribution {
+								prediction.Distribution[p.SurfaceType] = p.Probability
+							}
+						}
+
+						err = db.RoadSegmentSurfacePredictionUpdated(rs.SegmentID, prediction)
 						if err != nil {
 							log.Errorf("Failed to annotate road segment %s: %s", rs.SegmentID, err.Error())
 						}
@@ -625,6 +998,14 @@ func (db *myDB) GetRoadSegmentByID(id string) (RoadSegment, error) {
 	return nil, fmt.Errorf("unable to find RoadSegment with id %s", id)
 }
 
+func (db *myDB) GetRoadSegmentCount() int {
+	count := 0
+	for _, road := range db.roads {
+		count += len(road.GetSegmentIdentities())
+	}
+	return count
+}
+
 func (db *myDB) GetSegmentsNearPoint(lat, lon float64, maxDistance uint64) ([]RoadSegment, error) {
 	segments := []RoadSegment{}
 
@@ -662,11 +1043,17 @@ func (db *myDB) GetSegmentsWithinRect(lat0, lon0, lat1, lon1 float64) ([]RoadSeg
 }
 
 func (db *myDB) RoadSegmentSurfaceUpdated(segmentID, surfaceType string, probability float64, timestamp time.Time) error {
+	return db.RoadSegmentSurfacePredictionUpdated(segmentID, NewSurfacePrediction(surfaceType, probability, timestamp))
+}
+
+func (db *myDB) RoadSegmentSurfacePredictionUpdated(segmentID string, prediction SurfacePrediction) error {
+	prediction.Kind = db.vocabulary.Kind(prediction.SurfaceType)
+	timestamp := prediction.Timestamp
 
 	for idx := range db.roads {
 		segment, err := db.roads[idx].GetSegment(segmentID)
 		if err == nil {
-			segment.setSurfaceType(surfaceType, probability)
+			segment.setSurfaceType(prediction, db.policy)
 			segment.setLastModified(&timestamp)
 			db.roads[idx].setLastModified(&timestamp)
 			return nil
@@ -676,15 +1063,32 @@ func (db *myDB) RoadSegmentSurfaceUpdated(segmentID, surfaceType string, probabi
 	return fmt.Errorf("unable to update non existing RoadSegment %s", segmentID)
 }
 
-func (db *myDB) CreateRoadSurfaceObserved(src *diwise.RoadSurfaceObserved) (*persistence.RoadSurfaceObserved, error) {
-
-	err := validateSurfaceType(src.SurfaceType.Value)
+//SelectRoadSegmentSurfacePrediction returns the prediction that the dataset policy selects for a
+//road segment once it has been updated with a prediction, without updating the segment
+func (db *myDB) SelectRoadSegmentSurfacePrediction(segmentID string, prediction SurfacePrediction) (*SurfacePrediction, error) {
+	segment, err := db.GetRoadSegmentByID(segmentID)
 	if err != nil {
 		return nil, err
 	}
 
-	if src.SurfaceType.Probability <= 0 || src.SurfaceType.Probability > 1 {
-		return nil, fmt.Errorf("probability %f is not within acceptable range: (0, 1.0]", src.SurfaceType.Probability)
+	predictions := []*SurfacePrediction{&prediction}
+	for _, p := range segment.SurfaceDatasets() {
+		if p.Provenance.DatasetID() != prediction.Provenance.DatasetID() {
+			predictions = append(predictions, p)
+		} else if prediction.Timestamp.Before(p.Timestamp) {
+			// A late prediction does not replace the more recent one of its dataset
+			predictions[0] = p
+		}
+	}
+
+	return db.policy.Select(predictions), nil
+}
+
+func (db *myDB) CreateRoadSurfaceObserved(src *diwise.RoadSurfaceObserved) (*persistence.RoadSurfaceObserved, error) {
+
+	err := db.vocabulary.Validate(src.SurfaceType.Value, src.SurfaceType.Probability)
+	if err != nil {
+		return nil, err
 	}
 
 	pt := src.Location.GetAsPoint()
@@ -699,13 +1103,37 @@ func (db *myDB) CreateRoadSurfaceObserved(src *diwise.RoadSurfaceObserved) (*per
 		return nil, fmt.Errorf("latitude %f is out of bounds: [62.042301, 62.648987]", lat)
 	}
 
+	// Devices may buffer their observations and upload them later, so we only fall back
+	// to the time of ingestion if the observation lacks a dateObserved of its own
+	dateObserved := time.Now().UTC()
+	if src.DateObserved != nil {
+		dateObserved, err = time.Parse(time.RFC3339, src.DateObserved.Value.Value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse dateObserved %s: %s", src.DateObserved.Value.Value, err.Error())
+		}
+		dateObserved = dateObserved.UTC()
+	}
+
 	rso := &persistence.RoadSurfaceObserved{
 		RoadSurfaceObservedID: src.ID,
-		SurfaceType:           src.SurfaceType.Value,
+		SurfaceType:           surface.Normalize(src.SurfaceType.Value),
 		Probability:           src.SurfaceType.Probability,
 		Latitude:              lat,
 		Longitude:             lon,
-		Timestamp:             time.Now().UTC(),
+		Timestamp:             dateObserved,
+	}
+
+	if src.RefRoadSegment != nil && len(src.RefRoadSegment.Object) > 0 {
+		segmentID := strings.TrimPrefix(src.RefRoadSegment.Object[0], fiware.RoadSegmentIDPrefix)
+		segment := &persistence.RoadSegment{SegmentID: segmentID}
+		result := db.impl.Where(segment).First(segment)
+
+		if result.RowsAffected == 0 {
+			db.addNewRoadSegment(segmentID)
+			_ = db.impl.Where(segment).First(segment)
+		}
+
+		rso.RoadSegmentID = segment.ID
 	}
 
 	result := db.impl.Create(rso)
@@ -716,9 +1144,46 @@ func (db *myDB) CreateRoadSurfaceObserved(src *diwise.RoadSurfaceObserved) (*per
 	return rso, nil
 }
 
+//GetRoadSurfacesObserved returns all road surface observations, including the hourly aggregates
+//of the observations that have been rolled up by the retention policy
 func (db *myDB) GetRoadSurfacesObserved() ([]persistence.RoadSurfaceObserved, error) {
 	rso := []persistence.RoadSurfaceObserved{}
-	result := db.impl.Find(&rso)
+	result := db.roadSurfacesObservedSource().Find(&rso)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return rso, nil
+}
+
+//roadSurfaceObservedTable maps the properties of a RoadSurfaceObserved to their columns
+var roadSurfaceObservedTable = observationTable{
+	columns: map[string]string{
+		"id":           "road_surface_observed_id",
+		"dateObserved": "timestamp",
+		"dateCreated":  "created_at",
+		"surfaceType":  "surface_type",
+		"probability":  "probability",
+	},
+	timeColumn: "timestamp",
+}
+
+func (db *myDB) QueryRoadSurfacesObserved(query ObservationQuery) ([]persistence.RoadSurfaceObserved, error) {
+	rso := []persistence.RoadSurfaceObserved{}
+
+	gorm, err := insertOrderSQL(db.roadSurfacesObservedSource(), roadSurfaceObservedTable.columns, query.OrderBy, query.ReferencePoint)
+	if err != nil {
+		return nil, err
+	}
+
+	gorm, err = insertObservationFilterSQL(gorm, roadSurfaceObservedTable, query)
+	if err != nil {
+		return nil, err
+	}
+
+	gorm = insertPaginationSQL(gorm, query)
+
+	result := gorm.Find(&rso)
 	if result.Error != nil {
 		return nil, result.Error
 	}
@@ -726,7 +1191,27 @@ func (db *myDB) GetRoadSurfacesObserved() ([]persistence.RoadSurfaceObserved, er
 	return rso, nil
 }
 
+func (db *myDB) CountRoadSurfacesObserved(query ObservationQuery) (uint64, error) {
+	var count int64
+
+	gorm, err := insertObservationFilterSQL(db.roadSurfacesObservedSource(), roadSurfaceObservedTable, query)
+	if err != nil {
+		return 0, err
+	}
+
+	result := gorm.Count(&count)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+
+	return uint64(count), nil
+}
+
 func (db *myDB) UpdateRoadSegmentSurface(segmentID, surfaceType string, probability float64, timestamp time.Time) error {
+	return db.UpdateRoadSegmentSurfacePrediction(segmentID, NewSurfacePrediction(surfaceType, probability, timestamp))
+}
+
+func (db *myDB) UpdateRoadSegmentSurfacePrediction(segmentID string, prediction SurfacePrediction) error {
 	// Find the segment to be updated in the database
 	segment := &persistence.RoadSegment{SegmentID: segmentID}
 	result := db.impl.Where(segment).First(segment)
@@ -738,38 +1223,99 @@ func (db *myDB) UpdateRoadSegmentSurface(segmentID, surfaceType string, probabil
 
 	stp := &persistence.SurfaceTypePrediction{
 		RoadSegmentID: segment.ID,
-		SurfaceType:   surfaceType,
-		Probability:   probability,
-		Timestamp:     timestamp,
+		SurfaceType:   prediction.SurfaceType,
+		Probability:   prediction.Probability,
+		Timestamp:     prediction.Timestamp,
+		Source:        prediction.Provenance.Source,
+		ModelName:     prediction.Provenance.Model,
+		ModelVersion:  prediction.Provenance.ModelVersion,
+		Client:        prediction.Provenance.Client,
+	}
+
+	for surfaceType, probability := range prediction.Distribution {
+		stp.Distribution = append(stp.Distribution, persistence.SurfaceTypeProbability{
+			SurfaceType: surfaceType,
+			Probability: probability,
+		})
 	}
+
 	result = db.impl.Create(stp)
 
 	return result.Error
 }
 
-func (db *myDB) CreateTrafficFlowObserved(src *fiware.TrafficFlowObserved) (*persistence.TrafficFlowObserved, error) {
+//TrafficFlowObservedDetails holds the Smart Data Models attributes of a traffic flow observation
+//that the fiware model lacks, and the device that made the observation
+type TrafficFlowObservedDetails struct {
+	SourceDevice string
+
+	Occupancy            *float64
+	Congested            *bool
+	AverageHeadwayTime   *float64
+	AverageGapDistance   *float64
+	AverageVehicleLength *float64
+	VehicleType          string
+	VehicleSubType       string
+	LaneDirection        string
+	ReversedLane         *bool
+}
+
+//validLaneDirections are the directions that a lane may have relative to its road segment
+var validLaneDirections = []string{"forward", "backward"}
+
+func (d TrafficFlowObservedDetails) validate() error {
+	if d.Occupancy != nil && (*d.Occupancy < 0 || *d.Occupancy > 1) {
+		return fmt.Errorf("occupancy %f is out of bounds: [0, 1]", *d.Occupancy)
+	}
+
+	for _, value := range []*float64{d.AverageHeadwayTime, d.AverageGapDistance, d.AverageVehicleLength} {
+		if value != nil && *value < 0 {
+			return fmt.Errorf("averages of times and distances must not be negative")
+		}
+	}
+
+	if d.LaneDirection != "" {
+		for _, direction := range validLaneDirections {
+			if d.LaneDirection == direction {
+				return nil
+			}
+		}
+		return fmt.Errorf("unknown lane direction %s", d.LaneDirection)
+	}
+
+	return nil
+}
+
+//newTrafficFlowObserved validates a traffic flow observation and converts it into its persisted
+//form. The id of the road segment that the observation refers to, if any, is returned separately
+//since it has to be looked up (or added) before the observation can be stored.
+func newTrafficFlowObserved(src *fiware.TrafficFlowObserved, details TrafficFlowObservedDetails) (*persistence.TrafficFlowObserved, string, error) {
+	err := details.validate()
+	if err != nil {
+		return nil, "", err
+	}
 
 	var lon float64
 	var lat float64
 
 	if src.Location != nil {
 		pt := src.Location.GetAsPoint()
-		lon := pt.Longitude()
-		lat := pt.Latitude()
+		lon = pt.Longitude()
+		lat = pt.Latitude()
 
 		if lon < 15.516210 || lon > 17.975816 {
-			return nil, fmt.Errorf("longitude %f is out of bounds: [15.516210, 17.975816]", lon)
+			return nil, "", fmt.Errorf("longitude %f is out of bounds: [15.516210, 17.975816]", lon)
 		}
 
 		if lat < 62.042301 || lat > 62.648987 {
-			return nil, fmt.Errorf("latitude %f is out of bounds: [62.042301, 62.648987]", lat)
+			return nil, "", fmt.Errorf("latitude %f is out of bounds: [62.042301, 62.648987]", lat)
 		}
 	}
 
 	layout := "2006-01-02T15:04:05Z"
 	dateObserved, err := time.Parse(layout, src.DateObserved.Value)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse DateObserved into string: %s", err)
+		return nil, "", fmt.Errorf("failed to parse DateObserved into string: %s", err)
 	}
 
 	tfo := &persistence.TrafficFlowObserved{
@@ -779,18 +1325,20 @@ func (db *myDB) CreateTrafficFlowObserved(src *fiware.TrafficFlowObserved) (*per
 		Longitude:             lon,
 		LaneID:                int(src.LaneID.Value),
 		Intensity:             int(src.Intensity.Value),
+		Occupancy:             details.Occupancy,
+		Congested:             details.Congested,
+		AverageHeadwayTime:    details.AverageHeadwayTime,
+		AverageGapDistance:    details.AverageGapDistance,
+		AverageVehicleLength:  details.AverageVehicleLength,
+		VehicleType:           details.VehicleType,
+		VehicleSubType:        details.VehicleSubType,
+		LaneDirection:         details.LaneDirection,
+		ReversedLane:          details.ReversedLane,
 	}
 
+	segmentID := ""
 	if src.RefRoadSegment != nil {
-		segment := &persistence.RoadSegment{SegmentID: src.RefRoadSegment.Object}
-		result := db.impl.Where(segment).First(segment)
-
-		if result.RowsAffected == 0 {
-			db.addNewRoadSegment(src.RefRoadSegment.Object)
-			_ = db.impl.Where(segment).First(segment)
-		}
-
-		tfo.RoadSegmentID = segment.ID
+		segmentID = strings.TrimPrefix(src.RefRoadSegment.Object, fiware.RoadSegmentIDPrefix)
 	}
 
 	if src.DateObservedTo != nil {
@@ -807,12 +1355,124 @@ func (db *myDB) CreateTrafficFlowObserved(src *fiware.TrafficFlowObserved) (*per
 		tfo.AverageVehicleSpeed = src.AverageVehicleSpeed.Value
 	}
 
-	result := db.impl.Create(tfo)
-	if result.RowsAffected != 1 {
+	// An observation of an instant has no interval, so its time is used as the interval
+	if tfo.DateObservedFrom.IsZero() && tfo.DateObservedTo.IsZero() {
+		tfo.DateObservedFrom = tfo.DateObserved
+		tfo.DateObservedTo = tfo.DateObserved
+	}
+
+	if details.SourceDevice != "" {
+		tfo.SourceDevice = &details.SourceDevice
+	}
+
+	return tfo, segmentID, nil
+}
+
+//roadSegmentKey returns the primary key of a persisted road segment, adding the segment if it
+//has not been persisted yet. Zero is returned if the segment could not be added.
+func (db *myDB) roadSegmentKey(segmentID string) uint {
+	segment := &persistence.RoadSegment{SegmentID: segmentID}
+	result := db.impl.Where(segment).First(segment)
+
+	if result.RowsAffected == 0 {
+		db.addNewRoadSegment(segmentID)
+		_ = db.impl.Where(segment).First(segment)
+	}
+
+	return segment.ID
+}
+
+func (db *myDB) CreateTrafficFlowObserved(src *fiware.TrafficFlowObserved) (*persistence.TrafficFlowObserved, error) {
+	tfo, _, err := db.UpsertTrafficFlowObserved(src, TrafficFlowObservedDetails{})
+	return tfo, err
+}
+
+//UpsertTrafficFlowObserved stores a traffic flow observation, unless an observation with the same
+//natural key (source device, lane, dateObservedFrom and dateObservedTo) has already been stored.
+//The stored observation is then updated instead and reported as a duplicate. Observations of an
+//hour that has already been rolled up into an hourly aggregate are not stored, but reported as
+//duplicates as well. Observations without a source device can not be recognized and are always
+//stored as new observations.
+func (db *myDB) UpsertTrafficFlowObserved(src *fiware.TrafficFlowObserved, details TrafficFlowObservedDetails) (*persistence.TrafficFlowObserved, bool, error) {
+	tfo, segmentID, err := newTrafficFlowObserved(src, details)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if segmentID != "" {
+		tfo.RoadSegmentID = db.roadSegmentKey(segmentID)
+		if tfo.RoadSegmentID != 0 {
+			tfo.SegmentID = segmentID
+		}
+	}
+
+	existing, err := findTrafficFlowObservedByNaturalKey(db.impl, tfo)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if existing == nil && tfo.SourceDevice != nil {
+		// The raw observations of an aggregated hour have been purged, so a replayed observation
+		// would otherwise be counted twice in that hour
+		aggregated, err := isTrafficFlowObservedAggregated(db.impl, tfo)
+		if err != nil {
+			return nil, false, err
+		}
+
+		if aggregated {
+			log.Infof("suppressed duplicate %s from %s of an aggregated hour", tfo.TrafficFlowObservedID, details.SourceDevice)
+			return tfo, true, nil
+		}
+	}
+
+	if existing == nil {
+		result := db.impl.Create(tfo)
+		if result.RowsAffected == 1 {
+			return tfo, false, nil
+		}
+
+		// A concurrent request may have stored the same observation after we looked for it
+		existing, err = findTrafficFlowObservedByNaturalKey(db.impl, tfo)
+		if err != nil || existing == nil {
+			return nil, false, result.Error
+		}
+	}
+
+	// Keep the identity of the stored observation, so that a replayed observation does not
+	// change the id of the entity that clients already know about
+	tfo.ID = existing.ID
+	tfo.CreatedAt = existing.CreatedAt
+	tfo.TrafficFlowObservedID = existing.TrafficFlowObservedID
+	tfo.Duplicates = existing.Duplicates + 1
+
+	result := db.impl.Save(tfo)
+	if result.Error != nil {
+		return nil, false, result.Error
+	}
+
+	log.Infof("suppressed duplicate %s from %s", tfo.TrafficFlowObservedID, details.SourceDevice)
+
+	return tfo, true, nil
+}
+
+func findTrafficFlowObservedByNaturalKey(tx *gorm.DB, tfo *persistence.TrafficFlowObserved) (*persistence.TrafficFlowObserved, error) {
+	if tfo.SourceDevice == nil {
+		return nil, nil
+	}
+
+	existing := &persistence.TrafficFlowObserved{}
+	result := tx.Where(
+		"source_device = ? AND lane_id = ? AND date_observed_from = ? AND date_observed_to = ?",
+		*tfo.SourceDevice, tfo.LaneID, tfo.DateObservedFrom, tfo.DateObservedTo,
+	).Limit(1).Find(existing)
+
+	if result.Error != nil {
 		return nil, result.Error
+	} else if result.RowsAffected == 0 {
+		return nil, nil
 	}
 
-	return tfo, nil
+	return existing, nil
 }
 
 func insertTemporalSQL(gorm *gorm.DB, property string, from, to time.Time) *gorm.DB {
@@ -831,35 +1491,450 @@ func insertTemporalSQL(gorm *gorm.DB, property string, from, to time.Time) *gorm
 }
 
 func (db *myDB) GetTrafficFlowsObserved(from, to time.Time, limit int) ([]persistence.TrafficFlowObserved, error) {
+	return db.QueryTrafficFlowsObserved(ObservationQuery{
+		From:  from,
+		To:    to,
+		Limit: limit,
+		OrderBy: []OrderBy{
+			{Property: "dateObserved", Descending: true},
+			{Property: "laneID", Descending: true},
+		},
+	})
+}
+
+//trafficFlowObservedTable maps the properties of a TrafficFlowObserved to their columns
+var trafficFlowObservedTable = observationTable{
+	columns: map[string]string{
+		"id":                  "traffic_flow_observed_id",
+		"dateObserved":        "date_observed",
+		"dateObservedFrom":    "date_observed_from",
+		"dateObservedTo":      "date_observed_to",
+		"dateCreated":         "created_at",
+		"dateModified":        "updated_at",
+		"laneID":              "lane_id",
+		"intensity":           "intensity",
+		"averageVehicleSpeed": "average_vehicle_speed",
+
+		"occupancy":            "occupancy",
+		"congested":            "congested",
+		"averageHeadwayTime":   "average_headway_time",
+		"averageGapDistance":   "average_gap_distance",
+		"averageVehicleLength": "average_vehicle_length",
+		"vehicleType":          "vehicle_type",
+		"vehicleSubType":       "vehicle_sub_type",
+		"laneDirection":        "lane_direction",
+		"reversedLane":         "reversed_lane",
+	},
+	timeColumn: "date_observed",
+}
+
+func (db *myDB) QueryTrafficFlowsObserved(query ObservationQuery) ([]persistence.TrafficFlowObserved, error) {
 	tfo := []persistence.TrafficFlowObserved{}
-	gorm := db.impl.Order("date_observed desc, lane_id desc")
 
-	if !from.IsZero() || !to.IsZero() {
-		gorm = insertTemporalSQL(gorm, "date_observed", from, to)
-		if gorm.Error != nil {
-			return nil, gorm.Error
-		}
+	gorm, err := insertOrderSQL(db.trafficFlowsObservedSource(), trafficFlowObservedTable.columns, query.OrderBy, query.ReferencePoint)
+	if err != nil {
+		return nil, err
 	}
 
-	result := gorm.Limit(limit).Find(&tfo)
+	gorm, err = insertObservationFilterSQL(gorm, trafficFlowObservedTable, query)
+	if err != nil {
+		return nil, err
+	}
+
+	gorm = insertPaginationSQL(gorm, query)
+
+	result := gorm.Find(&tfo)
 	if result.Error != nil {
 		return nil, result.Error
 	}
 
+	err = db.resolveTrafficFlowSegments(tfo)
+	if err != nil {
+		return nil, err
+	}
+
 	return tfo, nil
 }
 
-func validateSurfaceType(surfaceType string) error {
+//resolveTrafficFlowSegments fills in the identities of the road segments that a list of
+//traffic flow observations refer to
+func (db *myDB) resolveTrafficFlowSegments(tfos []persistence.TrafficFlowObserved) error {
+	ids := []uint{}
+	for _, tfo := range tfos {
+		if tfo.RoadSegmentID != 0 {
+			ids = append(ids, tfo.RoadSegmentID)
+		}
+	}
 
-	knownTypes := []string{"grass", "gravel", "snow", "tarmac"}
+	if len(ids) == 0 {
+		return nil
+	}
 
-	for _, kt := range knownTypes {
-		if strings.Compare(surfaceType, kt) == 0 {
-			return nil
+	segments := []persistence.RoadSegment{}
+	result := db.impl.Where("id IN ?", ids).Find(&segments)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	segmentIDs := map[uint]string{}
+	for _, segment := range segments {
+		segmentIDs[segment.ID] = segment.SegmentID
+	}
+
+	for idx := range tfos {
+		tfos[idx].SegmentID = segmentIDs[tfos[idx].RoadSegmentID]
+	}
+
+	return nil
+}
+
+func (db *myDB) CountTrafficFlowsObserved(query ObservationQuery) (uint64, error) {
+	var count int64
+
+	gorm, err := insertObservationFilterSQL(db.trafficFlowsObservedSource(), trafficFlowObservedTable, query)
+	if err != nil {
+		return 0, err
+	}
+
+	result := gorm.Count(&count)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+
+	return uint64(count), nil
+}
+
+//TrafficFlowDuplicates counts the duplicate traffic flow observations that were suppressed
+//for a source device
+type TrafficFlowDuplicates struct {
+	SourceDevice string
+	// Observations is the number of stored observations that were received more than once
+	Observations int64
+	Duplicates   int64
+}
+
+//GetTrafficFlowDuplicates reports, per source device, how many duplicates were suppressed for
+//the observations made within a time range. Only raw observations are read, since the hourly
+//aggregates do not keep the number of duplicates.
+func (db *myDB) GetTrafficFlowDuplicates(from, to time.Time) ([]TrafficFlowDuplicates, error) {
+	duplicates := []TrafficFlowDuplicates{}
+
+	gorm := insertTemporalSQL(db.impl.Model(&persistence.TrafficFlowObserved{}), "date_observed", from, to)
+	result := gorm.
+		Select("source_device, COUNT(*) AS observations, SUM(duplicates) AS duplicates").
+		Where("duplicates > 0").
+		Group("source_device").
+		Order("source_device").
+		Scan(&duplicates)
+
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return duplicates, nil
+}
+
+func (db *myDB) GetEntityStatistics(typeName string) (*EntityStatistics, error) {
+	stats := &EntityStatistics{}
+
+	if typeName == "Road" || typeName == "RoadSegment" {
+		for _, road := range db.roads {
+			bbox := road.BoundingBox()
+			if stats.Bounds != nil {
+				bbox = NewBoundingBoxFromRectangles(*stats.Bounds, bbox)
+			}
+			stats.Bounds = &bbox
 		}
+
+		if typeName == "Road" {
+			stats.Count = uint64(db.GetRoadCount())
+		} else {
+			stats.Count = uint64(db.GetRoadSegmentCount())
+		}
+
+		return stats, nil
+	}
+
+	var model interface{}
+
+	if typeName == "RoadSurfaceObserved" {
+		model = &persistence.RoadSurfaceObserved{}
+	} else if typeName == "TrafficFlowObserved" {
+		model = &persistence.TrafficFlowObserved{}
+	} else if typeName == "Alert" {
+		model = &persistence.Alert{}
+	} else {
+		return nil, fmt.Errorf("no statistics available for unknown type %s", typeName)
+	}
+
+	var count int64
+	result := db.impl.Model(model).Count(&count)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	stats.Count = uint64(count)
+
+	bounds := struct {
+		MinLat *float64
+		MinLon *float64
+		MaxLat *float64
+		MaxLon *float64
+	}{}
+
+	// Observations without a location are stored as (0,0) and must not affect the bounds
+	result = db.impl.Model(model).
+		Select("min(latitude) as min_lat, min(longitude) as min_lon, max(latitude) as max_lat, max(longitude) as max_lon").
+		Where("latitude <> 0 OR longitude <> 0").
+		Scan(&bounds)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	if bounds.MinLat != nil && bounds.MinLon != nil && bounds.MaxLat != nil && bounds.MaxLon != nil {
+		rect := NewRectangle(NewPoint(*bounds.MinLat, *bounds.MinLon), NewPoint(*bounds.MaxLat, *bounds.MaxLon))
+		stats.Bounds = &rect
 	}
 
-	return fmt.Errorf("surfaceType does not match any known types")
+	return stats, nil
+}
+
+func (db *myDB) CreateSurfaceLabel(label SurfaceLabel) (*persistence.SurfaceLabel, error) {
+	surfaceType := surface.Normalize(label.SurfaceType)
+	if db.vocabulary.Kind(surfaceType) == "" {
+		return nil, fmt.Errorf("surfaceType %s does not match any known types", label.SurfaceType)
+	}
+
+	if label.Timestamp.IsZero() {
+		return nil, fmt.Errorf("a surface label must have a timestamp")
+	}
+
+	segment := &persistence.RoadSegment{SegmentID: label.SegmentID}
+	result := db.impl.Where(segment).First(segment)
+
+	if result.RowsAffected == 0 {
+		_, err := db.addNewRoadSegment(label.SegmentID)
+		if err != nil {
+			return nil, err
+		}
+		_ = db.impl.Where(segment).First(segment)
+	}
+
+	sl := &persistence.SurfaceLabel{
+		RoadSegmentID: segment.ID,
+		SurfaceType:   surfaceType,
+		Timestamp:     label.Timestamp.UTC(),
+		Source:        label.Source,
+		Client:        label.Client,
+	}
+
+	result = db.impl.Create(sl)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return sl, nil
+}
+
+//GetLabelledSurfacePredictions matches every label within a time range with the most recent
+//prediction of each dataset that was made for the same segment before the label, unless the
+//prediction had become stale by then
+func (db *myDB) GetLabelledSurfacePredictions(from, to time.Time) ([]LabelledSurfacePrediction, error) {
+	labels := []persistence.SurfaceLabel{}
+	result := db.impl.Where("timestamp >= ? AND timestamp <= ?", from, to).Order("timestamp").Find(&labels)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	segmentIDs := []uint{}
+	for _, l := range labels {
+		segmentIDs = append(segmentIDs, l.RoadSegmentID)
+	}
+
+	predictions := []persistence.SurfaceTypePrediction{}
+	if len(segmentIDs) > 0 {
+		result = db.impl.Where("road_segment_id IN ? AND timestamp <= ?", segmentIDs, to).Order("timestamp").Find(&predictions)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+	}
+
+	predictionsPerSegment := map[uint][]persistence.SurfaceTypePrediction{}
+	for _, p := range predictions {
+		predictionsPerSegment[p.RoadSegmentID] = append(predictionsPerSegment[p.RoadSegmentID], p)
+	}
+
+	labelled := []LabelledSurfacePrediction{}
+
+	for _, l := range labels {
+		// Predictions are ordered by time, so the last valid prediction of each dataset wins
+		mostRecent := map[string]persistence.SurfaceTypePrediction{}
+		datasetIDs := []string{}
+
+		for _, p := range predictionsPerSegment[l.RoadSegmentID] {
+			if p.Timestamp.After(l.Timestamp) {
+				break
+			}
+
+			datasetID := Provenance{Source: p.Source, Model: p.ModelName, ModelVersion: p.ModelVersion}.DatasetID()
+			if _, ok := mostRecent[datasetID]; !ok {
+				datasetIDs = append(datasetIDs, datasetID)
+			}
+			mostRecent[datasetID] = p
+		}
+
+		for _, datasetID := range datasetIDs {
+			p := mostRecent[datasetID]
+			if !db.freshness.IsStale(db.vocabulary.Kind(p.SurfaceType), p.Timestamp, l.Timestamp) {
+				labelled = append(labelled, LabelledSurfacePrediction{Label: l, Prediction: p})
+			}
+		}
+	}
+
+	return labelled, nil
+}
+
+const (
+	//AlertStatusActive is the status of an alert that has not been closed
+	AlertStatusActive string = "active"
+	//AlertStatusClosed is the status of an alert that is no longer valid
+	AlertStatusClosed string = "closed"
+)
+
+func (db *myDB) CreateAlert(alert persistence.Alert) (*persistence.Alert, error) {
+	if alert.AlertID == "" || alert.SegmentID == "" {
+		return nil, fmt.Errorf("an alert must have an id and refer to a road segment")
+	}
+
+	alert.Status = AlertStatusActive
+	alert.ValidTo = nil
+
+	result := db.impl.Create(&alert)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return &alert, nil
+}
+
+//CloseAlert closes an active alert. It returns false if the alert had already been closed, e.g.
+//by another replica of this service, in which case the alert is left as it was.
+func (db *myDB) CloseAlert(alertID string, validTo time.Time) (*persistence.Alert, bool, error) {
+	alert := &persistence.Alert{}
+	result := db.impl.Where("alert_id = ?", alertID).First(alert)
+	if result.Error != nil {
+		return nil, false, fmt.Errorf("unable to close alert %s: %s", alertID, result.Error.Error())
+	}
+
+	validTo = validTo.UTC()
+
+	// The status is checked by the update itself, so that an alert is only closed once
+	result = db.impl.Model(&persistence.Alert{}).Where("alert_id = ? AND status = ?", alertID, AlertStatusActive).Updates(
+		map[string]interface{}{"status": AlertStatusClosed, "valid_to": validTo},
+	)
+	if result.Error != nil {
+		return nil, false, result.Error
+	} else if result.RowsAffected == 0 {
+		return alert, false, nil
+	}
+
+	alert.Status = AlertStatusClosed
+	alert.ValidTo = &validTo
+
+	return alert, true, nil
+}
+
+//GetActiveAlertForSegment returns the most recently issued active alert of a road segment,
+//or nil if the segment has no active alerts
+func (db *myDB) GetActiveAlertForSegment(segmentID string) (*persistence.Alert, error) {
+	alerts := []persistence.Alert{}
+	result := db.impl.Where("segment_id = ? AND status = ?", segmentID, AlertStatusActive).Order("date_issued desc").Limit(1).Find(&alerts)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	if len(alerts) == 0 {
+		return nil, nil
+	}
+
+	return &alerts[0], nil
+}
+
+var alertTable = observationTable{
+	columns: map[string]string{
+		"id":          "alert_id",
+		"dateIssued":  "date_issued",
+		"validFrom":   "valid_from",
+		"validTo":     "valid_to",
+		"status":      "status",
+		"severity":    "severity",
+		"subCategory": "sub_category",
+		"surfaceType": "surface_type",
+	},
+	timeColumn: "date_issued",
+}
+
+func (db *myDB) QueryAlerts(query ObservationQuery) ([]persistence.Alert, error) {
+	alerts := []persistence.Alert{}
+
+	gorm, err := insertOrderSQL(db.impl, alertTable.columns, query.OrderBy, query.ReferencePoint)
+	if err != nil {
+		return nil, err
+	}
+
+	gorm, err = insertObservationFilterSQL(gorm, alertTable, query)
+	if err != nil {
+		return nil, err
+	}
+
+	gorm = insertPaginationSQL(gorm, query)
+
+	result := gorm.Find(&alerts)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return alerts, nil
+}
+
+func (db *myDB) CountAlerts(query ObservationQuery) (uint64, error) {
+	var count int64
+
+	gorm, err := insertObservationFilterSQL(db.impl.Model(&persistence.Alert{}), alertTable, query)
+	if err != nil {
+		return 0, err
+	}
+
+	result := gorm.Count(&count)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+
+	return uint64(count), nil
+}
+
+func (db *myDB) SurfaceVocabulary() *surface.Vocabulary {
+	return db.vocabulary
+}
+
+func (db *myDB) SurfaceFreshness() *surface.Freshness {
+	return db.freshness
+}
+
+//ExpireRoadSegmentSurfaces returns the road segments with surface conditions that have
+//become stale since the last call
+func (db *myDB) ExpireRoadSegmentSurfaces(now time.Time) []RoadSegment {
+	expired := []RoadSegment{}
+
+	for _, road := range db.roads {
+		for _, segmentID := range road.GetSegmentIdentities() {
+			segment, err := road.GetSegment(segmentID)
+			if err == nil && segment.expireCondition(db.freshness, now) {
+				expired = append(expired, segment)
+			}
+		}
+	}
+
+	return expired
 }
 
 func (db *myDB) addNewRoadSegment(segmentID string) (*persistence.Road, error) {
@@ -894,4 +1969,9 @@ type myDB struct {
 
 	roads    map[string]Road
 	seg2road map[string]string
+
+	vocabulary *surface.Vocabulary
+	freshness  *surface.Freshness
+	policy     DatasetPolicy
+	thresholds *congestion.Thresholds
 }
@@ -3,18 +3,24 @@ package database_test
 import (
 	"encoding/json"
 	"fmt"
+	"math"
 	"os"
 	"strings"
 	"testing"
 	"time"
 
 	db "github.com/diwise/api-transportation/internal/pkg/database"
+	"github.com/diwise/api-transportation/internal/pkg/persistence"
+	"github.com/diwise/ngsi-ld-golang/pkg/datamodels/diwise"
 	"github.com/diwise/ngsi-ld-golang/pkg/datamodels/fiware"
 	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/geojson"
 	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/types"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/matryer/is"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
 )
 
 func TestMain(m *testing.M) {
@@ -102,6 +108,244 @@ func TestUpdateRoadSegmentSurface(t *testing.T) {
 	}
 }
 
+func TestThatSurfaceMaterialAndConditionAreTrackedSeparately(t *testing.T) {
+	is := is.New(t)
+
+	segmentID := "21277:153930"
+	seedData := fmt.Sprintf("%s;%s;62.389109;17.310863;62.389084;17.310852\n", segmentID, segmentID)
+	datastore, _ := db.NewDatabaseConnection(db.NewSQLiteConnector(), strings.NewReader(seedData))
+
+	datastore.RoadSegmentSurfaceUpdated(segmentID, "asphalt", 0.9, time.Now().Add(-time.Hour))
+	datastore.RoadSegmentSurfaceUpdated(segmentID, "ice", 0.6, time.Now())
+
+	seg, _ := datastore.GetRoadSegmentByID(segmentID)
+
+	surfaceType, _ := seg.SurfaceType()
+	is.Equal(surfaceType, "ice") // the most recent surface type should be ice
+
+	material := seg.SurfaceMaterial()
+	is.Equal(material.SurfaceType, "asphalt") // the material should survive a change of condition
+	is.Equal(material.Probability, 0.9)
+
+	condition := seg.SurfaceCondition()
+	is.Equal(condition.SurfaceType, "ice")
+}
+
+func TestThatStaleSurfaceConditionsAreExpiredOnce(t *testing.T) {
+	is := is.New(t)
+
+	segmentID := "21277:153930"
+	seedData := fmt.Sprintf("%s;%s;62.389109;17.310863;62.389084;17.310852\n", segmentID, segmentID)
+	datastore, _ := db.NewDatabaseConnection(db.NewSQLiteConnector(), strings.NewReader(seedData))
+
+	now := time.Now().UTC()
+	datastore.RoadSegmentSurfaceUpdated(segmentID, "snow", 0.9, now.Add(-13*time.Hour))
+
+	expired := datastore.ExpireRoadSegmentSurfaces(now)
+	is.Equal(len(expired), 1) // expected the snow to have expired after the default max age
+	is.Equal(expired[0].ID(), segmentID)
+
+	is.Equal(len(datastore.ExpireRoadSegmentSurfaces(now)), 0) // an expiry should only be reported once
+
+	datastore.RoadSegmentSurfaceUpdated(segmentID, "wet", 0.9, now)
+	is.Equal(len(datastore.ExpireRoadSegmentSurfaces(now.Add(13*time.Hour))), 1) // a new condition should be able to expire again
+}
+
+func TestThatConditionsThatExpiredWhileTheServiceWasDownAreReported(t *testing.T) {
+	is := is.New(t)
+
+	segmentID := "21277:153930"
+	seedData := fmt.Sprintf("%s;%s;62.389109;17.310863;62.389084;17.310852\n", segmentID, segmentID)
+
+	dbfile := t.TempDir() + "/transportation.db"
+	connector := func() (*gorm.DB, error) {
+		return gorm.Open(sqlite.Open(dbfile), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	}
+
+	datastore, err := db.NewDatabaseConnection(connector, strings.NewReader(seedData))
+	is.NoErr(err)
+
+	now := time.Now().UTC()
+	is.NoErr(datastore.UpdateRoadSegmentSurface(segmentID, "snow", 0.9, now.Add(-13*time.Hour)))
+
+	restored, err := db.NewDatabaseConnection(connector, strings.NewReader(seedData))
+	is.NoErr(err)
+	is.Equal(len(restored.ExpireRoadSegmentSurfaces(now)), 1) // the stale snow should be left for the expiry watcher to report
+}
+
+func TestThatSurfacesCanBeUpdatedAndExpiredWhileTheyAreRead(t *testing.T) {
+	is := is.New(t)
+
+	segmentID := "21277:153930"
+	seedData := fmt.Sprintf("%s;%s;62.389109;17.310863;62.389084;17.310852\n", segmentID, segmentID)
+	datastore, _ := db.NewDatabaseConnection(db.NewSQLiteConnector(), strings.NewReader(seedData))
+
+	seg, err := datastore.GetRoadSegmentByID(segmentID)
+	is.NoErr(err)
+
+	now := time.Now().UTC()
+	done := make(chan bool)
+
+	// The messaging handlers and the expiry watcher run concurrently with the API
+	go func() {
+		for i := 0; i < 100; i++ {
+			datastore.RoadSegmentSurfaceUpdated(segmentID, "snow", 0.9, now.Add(-13*time.Hour))
+			datastore.ExpireRoadSegmentSurfaces(now)
+		}
+		done <- true
+	}()
+
+	for i := 0; i < 100; i++ {
+		seg.SurfaceType()
+		seg.SurfaceCondition()
+		seg.SurfaceDatasets()
+		seg.DateModified()
+	}
+
+	<-done
+}
+
+func TestThatSurfaceTypeDistributionsAreRestoredFromTheDatabase(t *testing.T) {
+	is := is.New(t)
+
+	segmentID := "21277:153930"
+	seedData := fmt.Sprintf("%s;%s;62.389109;17.310863;62.389084;17.310852\n", segmentID, segmentID)
+
+	// Use a database file so that the predictions outlive the first datastore
+	dbfile := t.TempDir() + "/transportation.db"
+	connector := func() (*gorm.DB, error) {
+		return gorm.Open(sqlite.Open(dbfile), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	}
+
+	datastore, err := db.NewDatabaseConnection(connector, strings.NewReader(seedData))
+	is.NoErr(err)
+
+	distribution := map[string]float64{"snow": 0.55, "ice": 0.35, "tarmac": 0.1}
+	prediction := db.NewSurfacePredictionFromDistribution(distribution, time.Now().UTC())
+	prediction.Provenance = db.Provenance{Source: db.SourceModel, Model: "roadcam", ModelVersion: "1.2", Client: "urn:ngsi-ld:Device:cam-17"}
+	err = datastore.UpdateRoadSegmentSurfacePrediction(segmentID, prediction)
+	is.NoErr(err)
+
+	restored, err := db.NewDatabaseConnection(connector, strings.NewReader(seedData))
+	is.NoErr(err)
+
+	seg, _ := restored.GetRoadSegmentByID(segmentID)
+	surfaceType, probability := seg.SurfaceType()
+	is.Equal(surfaceType, "snow") // the most probable surface type should be kept as the top-1 surface type
+	is.Equal(probability, 0.55)
+	is.Equal(seg.SurfacePrediction().Distribution, distribution)        // the full distribution should have been restored
+	is.Equal(seg.SurfacePrediction().Provenance, prediction.Provenance) // the provenance should have been restored
+	is.Equal(seg.SurfacePrediction().Provenance.DatasetID(), "urn:ngsi-ld:Dataset:model:roadcam:1.2")
+}
+
+func TestThatDatasetPoliciesPickTheDefaultSurfaceType(t *testing.T) {
+	is := is.New(t)
+
+	now := time.Now().UTC()
+	camera := db.NewSurfacePrediction("snow", 0.9, now.Add(-time.Minute))
+	camera.Provenance = db.Provenance{Source: db.SourceModel, Model: "roadcam"}
+	friction := db.NewSurfacePrediction("ice", 0.6, now)
+	friction.Provenance = db.Provenance{Source: db.SourceModel, Model: "friction"}
+	predictions := []*db.SurfacePrediction{&camera, &friction}
+
+	recent, _ := db.NewDatasetPolicy("recent", nil)
+	is.Equal(recent.Select(predictions).SurfaceType, "ice") // the friction prediction is the most recent
+
+	confidence, _ := db.NewDatasetPolicy("confidence", nil)
+	is.Equal(confidence.Select(predictions).SurfaceType, "snow") // the camera prediction is the most confident
+
+	priority, _ := db.NewDatasetPolicy("priority", []string{"urn:ngsi-ld:Dataset:model:roadcam"})
+	is.Equal(priority.Select(predictions).SurfaceType, "snow") // the camera dataset has the highest priority
+
+	_, err := db.NewDatasetPolicy("priority", nil)
+	is.True(err != nil) // a priority policy without priorities should not be allowed
+}
+
+func TestThatEachDatasetKeepsItsOwnSurfacePrediction(t *testing.T) {
+	is := is.New(t)
+
+	segmentID := "21277:153930"
+	seedData := fmt.Sprintf("%s;%s;62.389109;17.310863;62.389084;17.310852\n", segmentID, segmentID)
+
+	os.Setenv("TRANSPORTATION_DATASET_POLICY", "confidence")
+	defer os.Unsetenv("TRANSPORTATION_DATASET_POLICY")
+
+	datastore, err := db.NewDatabaseConnection(db.NewSQLiteConnector(), strings.NewReader(seedData))
+	is.NoErr(err)
+
+	now := time.Now().UTC()
+	camera := db.NewSurfacePrediction("snow", 0.9, now.Add(-time.Minute))
+	camera.Provenance = db.Provenance{Source: db.SourceModel, Model: "roadcam"}
+	friction := db.NewSurfacePrediction("ice", 0.6, now)
+	friction.Provenance = db.Provenance{Source: db.SourceModel, Model: "friction"}
+
+	datastore.RoadSegmentSurfacePredictionUpdated(segmentID, camera)
+	datastore.RoadSegmentSurfacePredictionUpdated(segmentID, friction)
+
+	seg, _ := datastore.GetRoadSegmentByID(segmentID)
+	surfaceType, _ := seg.SurfaceType()
+	is.Equal(surfaceType, "snow")           // the configured policy should favour the most confident dataset
+	is.Equal(len(seg.SurfaceDatasets()), 2) // expected a prediction per dataset
+	is.Equal(seg.SurfaceDataset("urn:ngsi-ld:Dataset:model:friction").SurfaceType, "ice")
+}
+
+func TestThatLateSurfacePredictionsDoNotReplaceMoreRecentOnes(t *testing.T) {
+	is := is.New(t)
+
+	segmentID := "21277:153930"
+	seedData := fmt.Sprintf("%s;%s;62.389109;17.310863;62.389084;17.310852\n", segmentID, segmentID)
+	datastore, _ := db.NewDatabaseConnection(db.NewSQLiteConnector(), strings.NewReader(seedData))
+
+	now := time.Now().UTC()
+	recent := db.NewSurfacePrediction("wet", 0.9, now)
+	late := db.NewSurfacePrediction("snow", 0.9, now.Add(-time.Hour))
+
+	datastore.RoadSegmentSurfacePredictionUpdated(segmentID, recent)
+	datastore.RoadSegmentSurfacePredictionUpdated(segmentID, late)
+
+	seg, _ := datastore.GetRoadSegmentByID(segmentID)
+	surfaceType, _ := seg.SurfaceType()
+	is.Equal(surfaceType, "wet")                        // the late prediction should not replace the recent one
+	is.Equal(seg.SurfaceCondition().SurfaceType, "wet") // nor the recent surface condition
+
+	selected, err := datastore.SelectRoadSegmentSurfacePrediction(segmentID, late)
+	is.NoErr(err)
+	is.Equal(selected.SurfaceType, "wet")
+}
+
+func TestThatLabelsAreMatchedWithTheLatestValidPredictionOfEachDataset(t *testing.T) {
+	is := is.New(t)
+
+	segmentID := "21277:153930"
+	seedData := fmt.Sprintf("%s;%s;62.389109;17.310863;62.389084;17.310852\n", segmentID, segmentID)
+	datastore, _ := db.NewDatabaseConnection(db.NewSQLiteConnector(), strings.NewReader(seedData))
+
+	labelTime := time.Date(2021, 1, 15, 12, 0, 0, 0, time.UTC)
+
+	predict := func(surfaceType string, timestamp time.Time, model string) {
+		prediction := db.NewSurfacePrediction(surfaceType, 0.8, timestamp)
+		prediction.Provenance = db.Provenance{Source: db.SourceModel, Model: model}
+		is.NoErr(datastore.UpdateRoadSegmentSurfacePrediction(segmentID, prediction))
+	}
+
+	predict("wet", labelTime.Add(-2*time.Hour), "roadcam")
+	predict("snow", labelTime.Add(-time.Hour), "roadcam")
+	predict("ice", labelTime.Add(time.Hour), "roadcam")      // made after the label and should be ignored
+	predict("ice", labelTime.Add(-24*time.Hour), "friction") // stale at the time of the label
+
+	_, err := datastore.CreateSurfaceLabel(db.SurfaceLabel{SegmentID: segmentID, SurfaceType: "Snow", Timestamp: labelTime, Source: "inspection"})
+	is.NoErr(err)
+
+	_, err = datastore.CreateSurfaceLabel(db.SurfaceLabel{SegmentID: segmentID, SurfaceType: "mud", Timestamp: labelTime})
+	is.True(err != nil) // labels with unknown surface types should be rejected
+
+	labelled, err := datastore.GetLabelledSurfacePredictions(labelTime.Add(-time.Hour), labelTime.Add(time.Hour))
+	is.NoErr(err)
+	is.Equal(len(labelled), 1) // expected only the latest valid roadcam prediction to be matched
+	is.Equal(labelled[0].Label.SurfaceType, "snow")
+	is.Equal(labelled[0].Prediction.SurfaceType, "snow")
+}
+
 var theDawnOfTime time.Time
 var theEndOfTime time.Time
 
@@ -150,6 +394,121 @@ func TestThatGetTrafficFlowObservedReturnsCorrectAmountOfEntriesInTheCorrectOrde
 	}
 }
 
+func TestThatTrafficFlowsObservedCanBeAggregatedByTimeAndLane(t *testing.T) {
+	is := is.New(t)
+
+	datastore, _ := db.NewDatabaseConnection(db.NewSQLiteConnector(), nil)
+
+	observations := []struct {
+		observedAt string
+		lane       int
+		intensity  int
+		speed      float64
+	}{
+		{"2016-12-07T11:10:00Z", 1, 10, 50},
+		{"2016-12-07T11:20:00Z", 1, 20, 80},
+		{"2016-12-07T11:30:00Z", 1, 30, 0},
+		{"2016-12-07T11:40:00Z", 1, 40, 60},
+		{"2016-12-07T11:40:00Z", 2, 5, 0},
+		{"2016-12-07T12:10:00Z", 1, 100, 70},
+	}
+
+	for idx, o := range observations {
+		tfo := fiware.NewTrafficFlowObserved(fmt.Sprintf("tfo%d", idx), o.observedAt, o.lane, o.intensity)
+		if o.speed > 0 {
+			tfo.AverageVehicleSpeed = types.NewNumberProperty(o.speed)
+		}
+		_, err := datastore.CreateTrafficFlowObserved(tfo)
+		is.NoErr(err)
+	}
+
+	aggregates, err := datastore.AggregateTrafficFlowsObserved(db.ObservationQuery{}, db.TrafficFlowAggregation{
+		Bucket:      db.BucketHour,
+		GroupByLane: true,
+		Percentiles: []float64{50, 90},
+	})
+	is.NoErr(err)
+	is.Equal(len(aggregates), 3) // expected one aggregate per hour and lane
+
+	first := aggregates[0]
+	is.Equal(first.BucketStart.Format(time.RFC3339), "2016-12-07T11:00:00Z")
+	is.Equal(*first.LaneID, 1)
+	is.Equal(first.Observations, int64(4))
+	is.Equal(first.IntensitySum, int64(100))
+	is.Equal(first.IntensityMean, 25.0)
+	is.True(math.Abs(*first.AverageSpeed-4500.0/70.0) < 1e-6) // speed should be weighted by intensity, ignoring missing speeds
+	is.Equal(first.Percentiles, []int64{20, 40})
+
+	is.Equal(*aggregates[1].LaneID, 2)
+	is.True(aggregates[1].AverageSpeed == nil) // no speeds were observed in lane 2
+	is.Equal(aggregates[2].BucketStart.Format(time.RFC3339), "2016-12-07T12:00:00Z")
+
+	weeks, err := datastore.AggregateTrafficFlowsObserved(db.ObservationQuery{}, db.TrafficFlowAggregation{Bucket: db.BucketWeek})
+	is.NoErr(err)
+	is.Equal(len(weeks), 1)
+	is.Equal(weeks[0].BucketStart.Format(time.RFC3339), "2016-12-05T00:00:00Z") // weeks should start on mondays
+	is.Equal(weeks[0].IntensitySum, int64(205))
+	is.True(weeks[0].LaneID == nil) // lanes should not be reported unless grouped by
+}
+
+func TestThatRetriedTrafficFlowsObservedUpdateTheStoredObservation(t *testing.T) {
+	is := is.New(t)
+
+	datastore, _ := db.NewDatabaseConnection(db.NewSQLiteConnector(), nil)
+
+	original := fiware.NewTrafficFlowObserved("original", "2016-12-07T11:10:00Z", 1, 35)
+	_, duplicate, err := datastore.UpsertTrafficFlowObserved(original, db.TrafficFlowObservedDetails{SourceDevice: "urn:ngsi-ld:Device:counter-1"})
+	is.NoErr(err)
+	is.True(!duplicate) // the first observation is not a duplicate
+
+	retry := fiware.NewTrafficFlowObserved("retry", "2016-12-07T11:10:00Z", 1, 36)
+	tfo, duplicate, err := datastore.UpsertTrafficFlowObserved(retry, db.TrafficFlowObservedDetails{SourceDevice: "urn:ngsi-ld:Device:counter-1"})
+	is.NoErr(err)
+	is.True(duplicate)                                                // the retry has the same natural key
+	is.True(strings.HasSuffix(tfo.TrafficFlowObservedID, "original")) // the retry should keep the id of the stored observation
+	is.Equal(tfo.Intensity, 36)                                       // the retry should update the stored observation
+
+	otherDevice := fiware.NewTrafficFlowObserved("other", "2016-12-07T11:10:00Z", 1, 12)
+	_, duplicate, _ = datastore.UpsertTrafficFlowObserved(otherDevice, db.TrafficFlowObservedDetails{SourceDevice: "urn:ngsi-ld:Device:counter-2"})
+	is.True(!duplicate) // observations from other devices are not duplicates
+
+	unknownDevice := fiware.NewTrafficFlowObserved("unknown", "2016-12-07T11:10:00Z", 1, 12)
+	_, _ = datastore.CreateTrafficFlowObserved(unknownDevice)
+	_, _ = datastore.CreateTrafficFlowObserved(unknownDevice)
+
+	tfos, _ := datastore.GetTrafficFlowsObserved(theDawnOfTime, theEndOfTime, 10)
+	is.Equal(len(tfos), 4) // observations without a device can not be recognized as duplicates
+
+	duplicates, err := datastore.GetTrafficFlowDuplicates(theDawnOfTime, theEndOfTime)
+	is.NoErr(err)
+	is.Equal(len(duplicates), 1) // only one device has sent duplicates
+	is.Equal(duplicates[0].SourceDevice, "urn:ngsi-ld:Device:counter-1")
+	is.Equal(duplicates[0].Duplicates, int64(1))
+}
+
+func TestThatReplayedTrafficFlowsObservedOfAnAggregatedHourAreDuplicates(t *testing.T) {
+	is := is.New(t)
+
+	datastore, _ := db.NewDatabaseConnection(db.NewSQLiteConnector(), nil)
+	details := db.TrafficFlowObservedDetails{SourceDevice: "urn:ngsi-ld:Device:counter-1"}
+
+	original := fiware.NewTrafficFlowObserved("original", "2016-12-07T11:10:00Z", 1, 35)
+	_, _, err := datastore.UpsertTrafficFlowObserved(original, details)
+	is.NoErr(err)
+
+	_, err = datastore.DownsampleTrafficFlowsObserved(time.Date(2016, 12, 7, 12, 0, 0, 0, time.UTC))
+	is.NoErr(err)
+
+	replay := fiware.NewTrafficFlowObserved("replay", "2016-12-07T11:10:00Z", 1, 35)
+	_, duplicate, err := datastore.UpsertTrafficFlowObserved(replay, details)
+	is.NoErr(err)
+	is.True(duplicate) // the hour of the replayed observation has already been aggregated
+
+	tfos, _ := datastore.QueryTrafficFlowsObserved(db.ObservationQuery{})
+	is.Equal(len(tfos), 1)          // the replayed observation should not be stored
+	is.Equal(tfos[0].Intensity, 35) // the replayed observation should not be counted twice
+}
+
 func TestThatGetTrafficFlowObservedHandlesSelectFromTime(t *testing.T) {
 	is := is.New(t)
 
@@ -297,3 +656,247 @@ func TestConnectToSQLite(t *testing.T) {
 		t.Errorf("Failed to update road segment surface type a second time in database. %s", err.Error())
 	}
 }
+
+func TestThatTrafficFlowsObservedCanBeOrderedAndPaged(t *testing.T) {
+	is := is.New(t)
+
+	datastore, _ := db.NewDatabaseConnection(db.NewSQLiteConnector(), nil)
+
+	for i, suffix := range []string{"ignored1", "second", "first", "ignored0"} {
+		src := fiware.NewTrafficFlowObserved(suffix, "2016-12-07T11:10:00.000Z", 1, 35)
+		src.Location = geojson.CreateGeoJSONPropertyFromWGS84(17.310863+0.001*float64(i), 62.389109)
+		_, err := datastore.CreateTrafficFlowObserved(src)
+		is.NoErr(err)
+	}
+
+	pt := db.NewPoint(62.389109, 17.310863)
+	tfos, err := datastore.QueryTrafficFlowsObserved(db.ObservationQuery{
+		Limit:          2,
+		Offset:         1,
+		OrderBy:        []db.OrderBy{{Property: "distance", Descending: true}},
+		ReferencePoint: &pt,
+	})
+	is.NoErr(err)
+	is.Equal(len(tfos), 2) // unexpected number of observations returned
+
+	is.True(strings.HasSuffix(tfos[0].TrafficFlowObservedID, "first"))  // results returned in the wrong order
+	is.True(strings.HasSuffix(tfos[1].TrafficFlowObservedID, "second")) // results returned in the wrong order
+}
+
+func TestThatEntityStatisticsReportCountAndBounds(t *testing.T) {
+	is := is.New(t)
+
+	datastore, _ := db.NewDatabaseConnection(db.NewSQLiteConnector(), nil)
+
+	src1 := fiware.NewTrafficFlowObserved("first", "2016-12-07T11:10:00.000Z", 1, 35)
+	src1.Location = geojson.CreateGeoJSONPropertyFromWGS84(17.3, 62.3)
+	src2 := fiware.NewTrafficFlowObserved("second", "2016-12-07T11:10:00.000Z", 1, 35)
+	src2.Location = geojson.CreateGeoJSONPropertyFromWGS84(17.4, 62.4)
+	src3 := fiware.NewTrafficFlowObserved("third", "2016-12-07T11:10:00.000Z", 1, 35)
+
+	for _, src := range []*fiware.TrafficFlowObserved{src1, src2, src3} {
+		_, err := datastore.CreateTrafficFlowObserved(src)
+		is.NoErr(err)
+	}
+
+	stats, err := datastore.GetEntityStatistics("TrafficFlowObserved")
+	is.NoErr(err)
+	is.Equal(stats.Count, uint64(3)) // unexpected number of observations
+
+	is.True(stats.Bounds != nil)                         // expected bounds of the observations with a location
+	is.Equal(stats.Bounds.NorthWest().Latitude(), 62.4)  // unexpected north bound
+	is.Equal(stats.Bounds.NorthWest().Longitude(), 17.3) // unexpected west bound
+	is.Equal(stats.Bounds.SouthEast().Latitude(), 62.3)  // unexpected south bound
+	is.Equal(stats.Bounds.SouthEast().Longitude(), 17.4) // unexpected east bound
+}
+
+func TestThatRoadSurfacesObservedCanBeFilteredByLocationAndProperties(t *testing.T) {
+	is := is.New(t)
+
+	datastore, _ := db.NewDatabaseConnection(db.NewSQLiteConnector(), nil)
+
+	observations := []*diwise.RoadSurfaceObserved{
+		diwise.NewRoadSurfaceObserved("near", "snow", 0.9, 62.389109, 17.310863),
+		diwise.NewRoadSurfaceObserved("nearbutdry", "tarmac", 0.9, 62.389209, 17.310963),
+		diwise.NewRoadSurfaceObserved("uncertain", "snow", 0.3, 62.389309, 17.311063),
+		diwise.NewRoadSurfaceObserved("far", "snow", 0.9, 62.1, 16.0),
+	}
+
+	for _, src := range observations {
+		_, err := datastore.CreateRoadSurfaceObserved(src)
+		is.NoErr(err)
+	}
+
+	pt := db.NewPoint(62.389109, 17.310863)
+	query := db.ObservationQuery{
+		NearPoint:   &pt,
+		MaxDistance: 100,
+		Filters: []db.PropertyFilter{
+			{Property: "surfaceType", Operator: "==", Value: "snow"},
+			{Property: "probability", Operator: ">=", Value: 0.5},
+		},
+	}
+
+	rsos, err := datastore.QueryRoadSurfacesObserved(query)
+	is.NoErr(err)
+	is.Equal(len(rsos), 1) // unexpected number of observations returned
+	is.True(strings.HasSuffix(rsos[0].RoadSurfaceObservedID, "near"))
+
+	rect := db.NewRectangle(db.NewPoint(62.0, 15.9), db.NewPoint(62.2, 16.1))
+	count, err := datastore.CountRoadSurfacesObserved(db.ObservationQuery{WithinRect: &rect})
+	is.NoErr(err)
+	is.Equal(count, uint64(1)) // unexpected number of observations within the rectangle
+}
+
+func TestThatDownsampledTrafficFlowsObservedAreQueriedAsHourlyAggregates(t *testing.T) {
+	is := is.New(t)
+
+	seedData := "21277:153930;21277:153930;62.389109;17.310863;62.389084;17.310852\n"
+	datastore, _ := db.NewDatabaseConnection(db.NewSQLiteConnector(), strings.NewReader(seedData))
+
+	newTrafficFlow := func(id, observedAt string, intensity int, speed float64) *fiware.TrafficFlowObserved {
+		src := fiware.NewTrafficFlowObserved(id, observedAt, 1, intensity)
+		src.RefRoadSegment = types.NewSingleObjectRelationship(fiware.RoadSegmentIDPrefix + "21277:153930")
+		if speed > 0 {
+			src.AverageVehicleSpeed = types.NewNumberProperty(speed)
+		}
+		return src
+	}
+
+	for _, src := range []*fiware.TrafficFlowObserved{
+		newTrafficFlow("first", "2016-12-07T11:10:00Z", 10, 30),
+		newTrafficFlow("second", "2016-12-07T11:20:00Z", 20, 60),
+		newTrafficFlow("third", "2016-12-07T11:40:00Z", 30, 0),
+		newTrafficFlow("recent", "2016-12-07T13:10:00Z", 5, 0),
+	} {
+		_, err := datastore.CreateTrafficFlowObserved(src)
+		is.NoErr(err)
+	}
+
+	cutoff := time.Date(2016, 12, 7, 12, 0, 0, 0, time.UTC)
+
+	purged, err := datastore.DownsampleTrafficFlowsObserved(cutoff)
+	is.NoErr(err)
+	is.Equal(purged, int64(3)) // only the observations before the cutoff should be purged
+
+	query := db.ObservationQuery{OrderBy: []db.OrderBy{{Property: "dateObserved"}}}
+	tfos, err := datastore.QueryTrafficFlowsObserved(query)
+	is.NoErr(err)
+	is.Equal(len(tfos), 2) // expected the hourly aggregate and the recent observation
+	is.True(strings.Contains(tfos[0].TrafficFlowObservedID, "hourly"))
+	is.Equal(tfos[0].Intensity, 60)             // the intensity of the hour should be the sum of its observations
+	is.Equal(tfos[0].AverageVehicleSpeed, 50.0) // the speed should be weighted by intensity
+	is.Equal(tfos[0].SegmentID, "21277:153930") // the aggregate should keep the road segment
+	is.True(tfos[0].DateObservedFrom.Equal(cutoff.Add(-time.Hour)))
+	is.True(strings.HasSuffix(tfos[1].TrafficFlowObservedID, "recent"))
+
+	late := newTrafficFlow("late", "2016-12-07T11:50:00Z", 40, 50)
+	_, err = datastore.CreateTrafficFlowObserved(late)
+	is.NoErr(err)
+
+	_, err = datastore.DownsampleTrafficFlowsObserved(cutoff)
+	is.NoErr(err)
+
+	tfos, _ = datastore.QueryTrafficFlowsObserved(query)
+	is.Equal(len(tfos), 2)                      // a late observation should be added to the existing aggregate
+	is.Equal(tfos[0].Intensity, 100)            // unexpected intensity after adding the late observation
+	is.Equal(tfos[0].AverageVehicleSpeed, 50.0) // unexpected speed after adding the late observation
+
+	days, err := datastore.AggregateTrafficFlowsObserved(db.ObservationQuery{}, db.TrafficFlowAggregation{Bucket: db.BucketDay})
+	is.NoErr(err)
+	is.Equal(len(days), 1)
+	is.Equal(days[0].IntensitySum, int64(105)) // the aggregated intensity should include the downsampled hour
+	is.Equal(days[0].Observations, int64(2))   // the hourly aggregate should count as one observation
+
+	baselines, err := datastore.GetTrafficFlowBaselines(theDawnOfTime, theEndOfTime)
+	is.NoErr(err)
+	is.Equal(len(baselines), 1)      // the baselines should only be learned from raw observations
+	is.Equal(baselines[0].Hour, 13)  // unexpected hour of the baseline
+	is.Equal(baselines[0].Mean, 5.0) // the hourly aggregate should not affect the baseline
+
+	purged, err = datastore.PurgeObservationAggregates(cutoff)
+	is.NoErr(err)
+	is.Equal(purged, int64(1))
+
+	count, _ := datastore.CountTrafficFlowsObserved(db.ObservationQuery{})
+	is.Equal(count, uint64(1)) // only the recent observation should remain
+}
+
+func TestThatDownsampledRoadSurfacesObservedAreQueriedAsHourlyAggregates(t *testing.T) {
+	is := is.New(t)
+
+	datastore, _ := db.NewDatabaseConnection(db.NewSQLiteConnector(), nil)
+
+	newRoadSurface := func(id, surfaceType string, probability float64, observedAt string) *diwise.RoadSurfaceObserved {
+		src := diwise.NewRoadSurfaceObserved(id, surfaceType, probability, 62.389109, 17.310863)
+		src.DateObserved = types.CreateDateTimeProperty(observedAt)
+		return src
+	}
+
+	for _, src := range []*diwise.RoadSurfaceObserved{
+		newRoadSurface("first", "snow", 0.8, "2016-12-07T11:05:00Z"),
+		newRoadSurface("second", "snow", 0.6, "2016-12-07T11:25:00Z"),
+		newRoadSurface("third", "tarmac", 0.9, "2016-12-07T11:45:00Z"),
+	} {
+		_, err := datastore.CreateRoadSurfaceObserved(src)
+		is.NoErr(err)
+	}
+
+	purged, err := datastore.DownsampleRoadSurfacesObserved(time.Date(2016, 12, 7, 12, 0, 0, 0, time.UTC))
+	is.NoErr(err)
+	is.Equal(purged, int64(3))
+
+	rsos, err := datastore.QueryRoadSurfacesObserved(db.ObservationQuery{
+		From:    time.Date(2016, 12, 7, 0, 0, 0, 0, time.UTC),
+		To:      time.Date(2016, 12, 8, 0, 0, 0, 0, time.UTC),
+		Filters: []db.PropertyFilter{{Property: "surfaceType", Operator: "==", Value: "snow"}},
+	})
+	is.NoErr(err)
+	is.Equal(len(rsos), 1)                                   // the snow observations should be rolled up into one aggregate
+	is.True(math.Abs(rsos[0].Probability-0.7) < 0.000001)    // the probability should be the mean of the observations
+	is.True(math.Abs(rsos[0].Latitude-62.389109) < 0.000001) // the location should be the mean of the observations
+	is.True(rsos[0].Timestamp.Equal(time.Date(2016, 12, 7, 11, 0, 0, 0, time.UTC)))
+
+	all, err := datastore.GetRoadSurfacesObserved()
+	is.NoErr(err)
+	is.Equal(len(all), 2) // expected the hourly aggregates of both surface types
+}
+
+func TestThatRoadSegmentTrafficIsOnlyLoadedForTheRequestedSegments(t *testing.T) {
+	is := is.New(t)
+
+	seedData := "21277:153930;21277:153930;62.389109;17.310863;62.389084;17.310852\n" +
+		"21277:153931;21277:153931;62.389084;17.310852;62.389041;17.310839\n"
+	datastore, _ := db.NewDatabaseConnection(db.NewSQLiteConnector(), strings.NewReader(seedData))
+
+	is.NoErr(datastore.SetRoadSegmentSpeedLimit("21277:153930", 50))
+	is.NoErr(datastore.SetRoadSegmentSpeedLimit("21277:153931", 70))
+
+	traffic, err := datastore.GetRoadSegmentTraffic([]string{"21277:153930", "unknown"})
+	is.NoErr(err)
+	is.Equal(len(traffic), 1) // only the requested segment with a speed limit should be loaded
+	is.Equal(*traffic["21277:153930"].SpeedLimit, 50.0)
+
+	traffic, err = datastore.GetRoadSegmentTraffic(nil)
+	is.NoErr(err)
+	is.Equal(len(traffic), 0) // nothing should be loaded when no segments are requested
+}
+
+func TestThatAlertsAreOnlyClosedOnce(t *testing.T) {
+	is := is.New(t)
+
+	datastore, _ := db.NewDatabaseConnection(db.NewSQLiteConnector(), nil)
+
+	_, err := datastore.CreateAlert(persistence.Alert{AlertID: "alert", SegmentID: "21277:153930", DateIssued: time.Now().UTC()})
+	is.NoErr(err)
+
+	closedAt := time.Date(2016, 12, 7, 12, 0, 0, 0, time.UTC)
+	_, closed, err := datastore.CloseAlert("alert", closedAt)
+	is.NoErr(err)
+	is.True(closed)
+
+	alert, closed, err := datastore.CloseAlert("alert", closedAt.Add(time.Hour))
+	is.NoErr(err)
+	is.True(!closed)                       // the alert has already been closed
+	is.True(alert.ValidTo.Equal(closedAt)) // an alert that is already closed should be left as it was
+}
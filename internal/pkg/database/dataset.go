@@ -0,0 +1,107 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/diwise/api-transportation/internal/pkg/env"
+)
+
+//DatasetPolicy picks the prediction that should be the default surface type of a road
+//segment, when several datasets have made predictions for the same segment
+type DatasetPolicy interface {
+	Select(predictions []*SurfacePrediction) *SurfacePrediction
+}
+
+//LoadDatasetPolicy creates the policy named by the environment variable
+//TRANSPORTATION_DATASET_POLICY, falling back to the most recent prediction. The priority
+//policy reads its comma separated list of dataset ids from TRANSPORTATION_DATASET_PRIORITY.
+func LoadDatasetPolicy() (DatasetPolicy, error) {
+	priority := []string{}
+	for _, datasetID := range strings.Split(env.GetVariableOrDefault("TRANSPORTATION_DATASET_PRIORITY", ""), ",") {
+		if datasetID = strings.TrimSpace(datasetID); datasetID != "" {
+			priority = append(priority, datasetID)
+		}
+	}
+
+	name := env.GetVariableOrDefault("TRANSPORTATION_DATASET_POLICY", "recent")
+
+	return NewDatasetPolicy(name, priority)
+}
+
+//NewDatasetPolicy returns the policy with the given name. Priority is only used by the
+//priority policy.
+func NewDatasetPolicy(name string, priority []string) (DatasetPolicy, error) {
+	if name == "recent" {
+		return &mostRecentPolicy{}, nil
+	} else if name == "confidence" {
+		return &highestConfidencePolicy{}, nil
+	} else if name == "priority" {
+		if len(priority) == 0 {
+			return nil, fmt.Errorf("the priority dataset policy requires a list of dataset ids")
+		}
+		return &priorityListPolicy{priority: priority}, nil
+	}
+
+	return nil, fmt.Errorf("unknown dataset policy %s", name)
+}
+
+//isBefore orders predictions by time and then by dataset id, so that the policies do not
+//depend on the order of the predictions when timestamps are equal
+func isBefore(p1, p2 *SurfacePrediction) bool {
+	if p1.Timestamp.Equal(p2.Timestamp) {
+		return p1.Provenance.DatasetID() > p2.Provenance.DatasetID()
+	}
+
+	return p1.Timestamp.Before(p2.Timestamp)
+}
+
+//mostRecentPolicy picks the most recent prediction, regardless of its dataset
+type mostRecentPolicy struct{}
+
+func (p *mostRecentPolicy) Select(predictions []*SurfacePrediction) *SurfacePrediction {
+	var selected *SurfacePrediction
+
+	for _, prediction := range predictions {
+		if selected == nil || isBefore(selected, prediction) {
+			selected = prediction
+		}
+	}
+
+	return selected
+}
+
+//highestConfidencePolicy picks the prediction with the highest probability, preferring the
+//most recent prediction when several are equally probable
+type highestConfidencePolicy struct{}
+
+func (p *highestConfidencePolicy) Select(predictions []*SurfacePrediction) *SurfacePrediction {
+	var selected *SurfacePrediction
+
+	for _, prediction := range predictions {
+		if selected == nil || prediction.Probability > selected.Probability ||
+			(prediction.Probability == selected.Probability && isBefore(selected, prediction)) {
+			selected = prediction
+		}
+	}
+
+	return selected
+}
+
+//priorityListPolicy picks the prediction of the dataset that comes first in a list of
+//dataset ids. The most recent prediction is picked if none of the datasets are listed.
+type priorityListPolicy struct {
+	priority []string
+}
+
+func (p *priorityListPolicy) Select(predictions []*SurfacePrediction) *SurfacePrediction {
+	for _, datasetID := range p.priority {
+		for _, prediction := range predictions {
+			if prediction.Provenance.DatasetID() == datasetID {
+				return prediction
+			}
+		}
+	}
+
+	return (&mostRecentPolicy{}).Select(predictions)
+}
@@ -0,0 +1,122 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/diwise/api-transportation/internal/pkg/persistence"
+	"github.com/diwise/ngsi-ld-golang/pkg/datamodels/fiware"
+	"gorm.io/gorm"
+)
+
+//ImportedTrafficFlowObserved is a traffic flow observation that is imported in bulk, together with
+//the details that the fiware model lacks
+type ImportedTrafficFlowObserved struct {
+	Observation *fiware.TrafficFlowObserved
+	Details     TrafficFlowObservedDetails
+}
+
+//TrafficFlowImportResult is the outcome of importing a batch of traffic flow observations
+type TrafficFlowImportResult struct {
+	Imported   int
+	Duplicates int
+	// Errors holds the reasons that observations were rejected, keyed by their index in the batch
+	Errors map[int]error
+}
+
+//ImportTrafficFlowsObserved validates a batch of traffic flow observations in the same way as
+//UpsertTrafficFlowObserved and inserts the valid ones in a single transaction. Observations that
+//have already been stored, or that occur more than once in the batch, are skipped rather than
+//updated, so that an interrupted import can be started over from the beginning of its file.
+//Observations of an hour that has already been rolled up into an aggregate for the same device
+//and lane are skipped as well, since they would otherwise be counted twice.
+func (db *myDB) ImportTrafficFlowsObserved(batch []ImportedTrafficFlowObserved) (*TrafficFlowImportResult, error) {
+	importResult := &TrafficFlowImportResult{Errors: map[int]error{}}
+
+	tfos := []*persistence.TrafficFlowObserved{}
+	segments := map[string]uint{}
+
+	for idx, imported := range batch {
+		tfo, segmentID, err := newTrafficFlowObserved(imported.Observation, imported.Details)
+		if err != nil {
+			importResult.Errors[idx] = err
+			continue
+		}
+
+		if segmentID != "" {
+			key, ok := segments[segmentID]
+			if !ok {
+				key = db.roadSegmentKey(segmentID)
+				segments[segmentID] = key
+			}
+
+			tfo.RoadSegmentID = key
+			if key != 0 {
+				tfo.SegmentID = segmentID
+			}
+		}
+
+		tfos = append(tfos, tfo)
+	}
+
+	err := db.impl.Transaction(func(tx *gorm.DB) error {
+		unique := []*persistence.TrafficFlowObserved{}
+		keys := map[string]bool{}
+
+		for _, tfo := range tfos {
+			if tfo.SourceDevice != nil {
+				key := fmt.Sprintf("%s|%d|%s|%s", *tfo.SourceDevice, tfo.LaneID,
+					tfo.DateObservedFrom.Format(time.RFC3339), tfo.DateObservedTo.Format(time.RFC3339))
+
+				existing, err := findTrafficFlowObservedByNaturalKey(tx, tfo)
+				if err != nil {
+					return err
+				}
+
+				aggregated, err := isTrafficFlowObservedAggregated(tx, tfo)
+				if err != nil {
+					return err
+				}
+
+				if existing != nil || aggregated || keys[key] {
+					importResult.Duplicates++
+					continue
+				}
+
+				keys[key] = true
+			}
+
+			unique = append(unique, tfo)
+		}
+
+		if len(unique) == 0 {
+			return nil
+		}
+
+		result := tx.CreateInBatches(unique, len(unique))
+		if result.Error != nil {
+			return result.Error
+		}
+
+		importResult.Imported = len(unique)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return importResult, nil
+}
+
+//isTrafficFlowObservedAggregated returns true if the hour of an observation has been rolled up
+//into an hourly aggregate for the same device and lane, after its raw observations were purged
+func isTrafficFlowObservedAggregated(tx *gorm.DB, tfo *persistence.TrafficFlowObserved) (bool, error) {
+	var count int64
+
+	result := tx.Model(&persistence.HourlyTrafficFlowObserved{}).Where(
+		"source_device = ? AND lane_id = ? AND date_observed_from <= ? AND date_observed_to > ?",
+		*tfo.SourceDevice, tfo.LaneID, tfo.DateObserved, tfo.DateObserved,
+	).Count(&count)
+
+	return count > 0, result.Error
+}
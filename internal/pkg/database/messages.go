@@ -0,0 +1,46 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/diwise/api-transportation/internal/pkg/persistence"
+)
+
+//ClaimMessage claims a message that every replica of the service has received, so that only one
+//of them handles it. It returns true if the message was claimed by the caller, and false if
+//another replica had already claimed it.
+func (db *myDB) ClaimMessage(messageKey string) (bool, error) {
+	if messageKey == "" {
+		return false, fmt.Errorf("a message can not be claimed without a key")
+	}
+
+	claim := &persistence.MessageClaim{MessageKey: messageKey}
+
+	result := db.impl.Create(claim)
+	if result.Error != nil {
+		// The unique key makes the insert fail if another replica claimed the message first
+		claims := []persistence.MessageClaim{}
+		found := db.impl.Where("message_key = ?", messageKey).Limit(1).Find(&claims)
+		if found.Error != nil || len(claims) == 0 {
+			return false, result.Error
+		}
+		return false, nil
+	}
+
+	return true, nil
+}
+
+//ReleaseMessage deletes the claim on a message that the claiming replica failed to handle, so
+//that the message can be handled again if it is redelivered
+func (db *myDB) ReleaseMessage(messageKey string) error {
+	result := db.impl.Unscoped().Where("message_key = ?", messageKey).Delete(&persistence.MessageClaim{})
+	return result.Error
+}
+
+//PurgeMessageClaims deletes the claims that were made before a point in time, when the messages
+//they refer to can no longer be redelivered. It returns the number of claims that were deleted.
+func (db *myDB) PurgeMessageClaims(before time.Time) (int64, error) {
+	result := db.impl.Unscoped().Where("created_at < ?", before).Delete(&persistence.MessageClaim{})
+	return result.RowsAffected, result.Error
+}
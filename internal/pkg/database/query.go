@@ -0,0 +1,176 @@
+package database
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+//OrderBy describes a property that query results should be ordered by
+type OrderBy struct {
+	Property   string
+	Descending bool
+}
+
+//ObservationQuery contains the filters, ordering and pagination that should be applied
+//when observations are retrieved from the datastore
+type ObservationQuery struct {
+	From time.Time
+	To   time.Time
+	// TimeProperty is the property that From and To applies to. The time of the observation
+	// is used if no property is given.
+	TimeProperty string
+
+	Limit  int
+	Offset int
+
+	// IDs limits the result to observations with any of the given identities
+	IDs []string
+	// RoadSegmentIDs limits the result to observations of any of the given road segments
+	RoadSegmentIDs []string
+
+	// NearPoint and MaxDistance limits the result to observations within MaxDistance
+	// meters from a point
+	NearPoint   *Point
+	MaxDistance uint64
+	// WithinRect limits the result to observations located within a rectangle
+	WithinRect *Rectangle
+
+	// Filters limits the result to observations with properties that match all filters
+	Filters []PropertyFilter
+
+	OrderBy []OrderBy
+	// ReferencePoint is the point that distances are measured from when ordering by distance
+	ReferencePoint *Point
+}
+
+//PropertyFilter compares the value of a property with a constant, e.g. probability >= 0.5
+type PropertyFilter struct {
+	Property string
+	Operator string
+	Value    interface{}
+}
+
+//validFilterOperators maps the supported filter operators to their SQL counterparts
+var validFilterOperators = map[string]string{
+	"==": "=",
+	"!=": "<>",
+	">":  ">",
+	">=": ">=",
+	"<":  "<",
+	"<=": "<=",
+}
+
+//metersPerDegree is the length of a degree of latitude on a sphere with the mean radius of the earth
+const metersPerDegree float64 = 6371000 * math.Pi / 180
+
+//distanceSQL returns an expression that computes the (approximate) squared distance in
+//degrees between the location of a row and a point. The longitude delta is scaled to compensate for the convergence of the meridians.
+func distanceSQL(pt Point) string {
+	scale := math.Pow(math.Cos(pt.lat*math.Pi/180), 2)
+	return fmt.Sprintf(
+		"((latitude - %f) * (latitude - %f) + (longitude - %f) * (longitude - %f) * %f)",
+		pt.lat, pt.lat, pt.lon, pt.lon, scale,
+	)
+}
+
+//insertOrderSQL adds an ORDER BY clause for all the properties that can be mapped to a column.
+//The primary key is always added last, to guarantee a deterministic order between pages.
+func insertOrderSQL(gorm *gorm.DB, columns map[string]string, orderBy []OrderBy, ref *Point) (*gorm.DB, error) {
+	for _, ob := range orderBy {
+		var column string
+
+		if ob.Property == "distance" {
+			if ref == nil {
+				return nil, fmt.Errorf("ordering by distance requires a reference point")
+			}
+			column = distanceSQL(*ref)
+		} else {
+			var ok bool
+			column, ok = columns[ob.Property]
+			if !ok {
+				// Properties that do not exist in this table do not affect the order
+				continue
+			}
+		}
+
+		if ob.Descending {
+			column = column + " desc"
+		}
+
+		gorm = gorm.Order(column)
+	}
+
+	return gorm.Order("id"), nil
+}
+
+//observationTable describes how the properties of an observation map to table columns
+type observationTable struct {
+	columns    map[string]string
+	timeColumn string
+}
+
+//insertObservationFilterSQL adds WHERE clauses for the filters in an ObservationQuery
+func insertObservationFilterSQL(gorm *gorm.DB, table observationTable, query ObservationQuery) (*gorm.DB, error) {
+	if len(query.IDs) > 0 {
+		gorm = gorm.Where(fmt.Sprintf("%s IN ?", table.columns["id"]), query.IDs)
+	}
+
+	if len(query.RoadSegmentIDs) > 0 {
+		gorm = gorm.Where("road_segment_id IN (SELECT id FROM road_segments WHERE segment_id IN ?)", query.RoadSegmentIDs)
+	}
+
+	if !query.From.IsZero() || !query.To.IsZero() {
+		timeColumn := table.timeColumn
+		if query.TimeProperty != "" {
+			var ok bool
+			timeColumn, ok = table.columns[query.TimeProperty]
+			if !ok {
+				return nil, fmt.Errorf("unable to filter on unknown time property %s", query.TimeProperty)
+			}
+		}
+
+		gorm = insertTemporalSQL(gorm, timeColumn, query.From, query.To)
+	}
+
+	if query.NearPoint != nil {
+		maxDistance := float64(query.MaxDistance) / metersPerDegree
+		gorm = gorm.Where(fmt.Sprintf("%s <= ?", distanceSQL(*query.NearPoint)), maxDistance*maxDistance)
+	}
+
+	if query.WithinRect != nil {
+		nw, se := query.WithinRect.NorthWest(), query.WithinRect.SouthEast()
+		gorm = gorm.Where("latitude BETWEEN ? AND ?", se.lat, nw.lat)
+		gorm = gorm.Where("longitude BETWEEN ? AND ?", nw.lon, se.lon)
+	}
+
+	for _, filter := range query.Filters {
+		column, ok := table.columns[filter.Property]
+		if !ok {
+			return nil, fmt.Errorf("unable to filter on unknown property %s", filter.Property)
+		}
+
+		operator, ok := validFilterOperators[filter.Operator]
+		if !ok {
+			return nil, fmt.Errorf("unsupported filter operator %s", filter.Operator)
+		}
+
+		gorm = gorm.Where(fmt.Sprintf("%s %s ?", column, operator), filter.Value)
+	}
+
+	return gorm, nil
+}
+
+func insertPaginationSQL(gorm *gorm.DB, query ObservationQuery) *gorm.DB {
+	if query.Offset > 0 {
+		gorm = gorm.Offset(query.Offset)
+	}
+
+	if query.Limit > 0 {
+		gorm = gorm.Limit(query.Limit)
+	}
+
+	return gorm
+}
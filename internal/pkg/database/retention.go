@@ -0,0 +1,286 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/diwise/api-transportation/internal/pkg/persistence"
+	"github.com/diwise/ngsi-ld-golang/pkg/datamodels/diwise"
+	"github.com/diwise/ngsi-ld-golang/pkg/datamodels/fiware"
+	"gorm.io/gorm"
+)
+
+//hourlyIDTimeFormat is the time format used in the identities of hourly aggregates
+const hourlyIDTimeFormat string = "2006-01-02T15"
+
+//trafficFlowsObservedSource returns the raw traffic flow observations together with the hourly
+//aggregates that replaced the observations that have been purged, so that queries for old time
+//ranges transparently fall back to the aggregates. The ids are doubled (and incremented for the
+//aggregates) to keep them unique, since the primary key is used to order pages.
+func (db *myDB) trafficFlowsObservedSource() *gorm.DB {
+	raw := db.impl.Model(&persistence.TrafficFlowObserved{}).Select(
+		"id * 2 AS id, created_at, updated_at, deleted_at, traffic_flow_observed_id, date_observed, " +
+			"date_observed_to, date_observed_from, latitude, longitude, lane_id, average_vehicle_speed, intensity, " +
+			"road_segment_id, source_device, duplicates, occupancy, congested, average_headway_time, " +
+			"average_gap_distance, average_vehicle_length, vehicle_type, vehicle_sub_type, lane_direction, reversed_lane",
+	)
+
+	hourly := db.impl.Model(&persistence.HourlyTrafficFlowObserved{}).Select(
+		"id * 2 + 1, date_observed_to, date_observed_to, deleted_at, traffic_flow_observed_id, date_observed_from, " +
+			"date_observed_to, date_observed_from, latitude, longitude, lane_id, average_vehicle_speed, intensity, " +
+			"road_segment_id, source_device, 0, NULL, NULL, NULL, NULL, NULL, '', '', '', NULL",
+	)
+
+	return db.impl.Unscoped().Table("(? UNION ALL ?) AS traffic_flow_observeds", raw, hourly)
+}
+
+//roadSurfacesObservedSource returns the raw road surface observations together with the hourly
+//aggregates that replaced the observations that have been purged. See trafficFlowsObservedSource.
+func (db *myDB) roadSurfacesObservedSource() *gorm.DB {
+	raw := db.impl.Model(&persistence.RoadSurfaceObserved{}).Select(
+		"id * 2 AS id, created_at, updated_at, deleted_at, road_segment_id, road_surface_observed_id, " +
+			"surface_type, probability, latitude, longitude, timestamp",
+	)
+
+	hourly := db.impl.Model(&persistence.HourlyRoadSurfaceObserved{}).Select(
+		"id * 2 + 1, timestamp, timestamp, deleted_at, road_segment_id, road_surface_observed_id, " +
+			"surface_type, probability, latitude, longitude, timestamp",
+	)
+
+	return db.impl.Unscoped().Table("(? UNION ALL ?) AS road_surface_observeds", raw, hourly)
+}
+
+//maxIDBefore returns the largest primary key among the rows of a table with a time before a
+//point in time. Rows that are inserted while they are downsampled are left for the next run.
+func maxIDBefore(tx *gorm.DB, model interface{}, timeColumn string, before time.Time) (uint, error) {
+	var maxID uint
+
+	err := tx.Unscoped().Model(model).
+		Select("COALESCE(MAX(id), 0)").
+		Where(fmt.Sprintf("%s < ?", timeColumn), before).
+		Row().Scan(&maxID)
+
+	return maxID, err
+}
+
+//DownsampleTrafficFlowsObserved rolls the traffic flows observed before a point in time up into
+//hourly aggregates per lane, location and device, and purges the raw observations. Observations that
+//arrive late for an hour that has already been rolled up are added to its aggregate. It returns
+//the number of raw observations that were purged.
+func (db *myDB) DownsampleTrafficFlowsObserved(before time.Time) (int64, error) {
+	var purged int64
+
+	err := db.impl.Transaction(func(tx *gorm.DB) error {
+		maxID, err := maxIDBefore(tx, &persistence.TrafficFlowObserved{}, "date_observed", before)
+		if err != nil || maxID == 0 {
+			return err
+		}
+
+		hourSQL := fmt.Sprintf("(%s / 3600) * 3600", db.epochSQL("date_observed"))
+
+		groups := []struct {
+			Hour           int64
+			RoadSegmentID  uint
+			SegmentID      *string
+			LaneID         int
+			Latitude       float64
+			Longitude      float64
+			SourceDevice   *string
+			Observations   int
+			Intensity      int
+			SpeedSum       *float64
+			SpeedIntensity *int
+		}{}
+
+		result := tx.Model(&persistence.TrafficFlowObserved{}).
+			Select(hourSQL+" AS hour, road_segment_id, road_segments.segment_id AS segment_id, lane_id, latitude, longitude, source_device, "+
+				"COUNT(*) AS observations, SUM(intensity) AS intensity, "+
+				"SUM(CASE WHEN average_vehicle_speed > 0 THEN average_vehicle_speed * intensity END) AS speed_sum, "+
+				"SUM(CASE WHEN average_vehicle_speed > 0 THEN intensity END) AS speed_intensity").
+			Joins("LEFT JOIN road_segments ON road_segments.id = traffic_flow_observeds.road_segment_id").
+			Where("date_observed < ? AND traffic_flow_observeds.id <= ?", before, maxID).
+			Group(hourSQL + ", road_segment_id, road_segments.segment_id, lane_id, latitude, longitude, source_device").
+			Scan(&groups)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		for _, g := range groups {
+			from := time.Unix(g.Hour, 0).UTC()
+
+			// Observations of the same lane of a road segment share an aggregate even if their
+			// locations differ slightly
+			location := fmt.Sprintf("%f,%f", g.Latitude, g.Longitude)
+			if g.SegmentID != nil {
+				location = *g.SegmentID
+			}
+
+			// The observations of each device are kept apart, so that imports can tell which
+			// hours of a device have already been rolled up
+			if g.SourceDevice != nil {
+				location += ":" + *g.SourceDevice
+			}
+
+			hourly := persistence.HourlyTrafficFlowObserved{
+				TrafficFlowObservedID: fmt.Sprintf("%shourly:%s:%d:%s", fiware.TrafficFlowObservedIDPrefix, from.Format(hourlyIDTimeFormat), g.LaneID, location),
+				DateObservedFrom:      from,
+				DateObservedTo:        from.Add(time.Hour),
+				Latitude:              g.Latitude,
+				Longitude:             g.Longitude,
+				LaneID:                g.LaneID,
+				RoadSegmentID:         g.RoadSegmentID,
+				SourceDevice:          g.SourceDevice,
+			}
+
+			existing := []persistence.HourlyTrafficFlowObserved{}
+			result = tx.Where("traffic_flow_observed_id = ?", hourly.TrafficFlowObservedID).Limit(1).Find(&existing)
+			if result.Error != nil {
+				return result.Error
+			}
+
+			if len(existing) > 0 {
+				hourly = existing[0]
+			}
+
+			speedSum := hourly.AverageVehicleSpeed * float64(hourly.SpeedIntensity)
+			if g.SpeedSum != nil && g.SpeedIntensity != nil {
+				speedSum += *g.SpeedSum
+				hourly.SpeedIntensity += *g.SpeedIntensity
+			}
+
+			hourly.Observations += g.Observations
+			hourly.Intensity += g.Intensity
+			if hourly.SpeedIntensity > 0 {
+				hourly.AverageVehicleSpeed = speedSum / float64(hourly.SpeedIntensity)
+			}
+
+			result = tx.Save(&hourly)
+			if result.Error != nil {
+				return result.Error
+			}
+		}
+
+		result = tx.Unscoped().
+			Where("date_observed < ? AND id <= ?", before, maxID).
+			Delete(&persistence.TrafficFlowObserved{})
+		if result.Error != nil {
+			return result.Error
+		}
+
+		purged = result.RowsAffected
+		return nil
+	})
+
+	return purged, err
+}
+
+//DownsampleRoadSurfacesObserved rolls the road surfaces observed before a point in time up into
+//hourly aggregates per surface type within roughly 100 by 50 meters, and purges the raw
+//observations. It returns the number of raw observations that were purged.
+func (db *myDB) DownsampleRoadSurfacesObserved(before time.Time) (int64, error) {
+	var purged int64
+
+	err := db.impl.Transaction(func(tx *gorm.DB) error {
+		maxID, err := maxIDBefore(tx, &persistence.RoadSurfaceObserved{}, "timestamp", before)
+		if err != nil || maxID == 0 {
+			return err
+		}
+
+		hourSQL := fmt.Sprintf("(%s / 3600) * 3600", db.epochSQL("timestamp"))
+		cellSQL := "CAST(latitude * 1000 AS INTEGER), CAST(longitude * 1000 AS INTEGER)"
+
+		groups := []struct {
+			Hour           int64
+			RoadSegmentID  uint
+			SurfaceType    string
+			CellLatitude   int64
+			CellLongitude  int64
+			Observations   int
+			LatitudeSum    float64
+			LongitudeSum   float64
+			ProbabilitySum float64
+		}{}
+
+		result := tx.Model(&persistence.RoadSurfaceObserved{}).
+			Select(hourSQL+" AS hour, MIN(road_segment_id) AS road_segment_id, surface_type, "+
+				"CAST(latitude * 1000 AS INTEGER) AS cell_latitude, CAST(longitude * 1000 AS INTEGER) AS cell_longitude, "+
+				"COUNT(*) AS observations, SUM(latitude) AS latitude_sum, SUM(longitude) AS longitude_sum, "+
+				"SUM(probability) AS probability_sum").
+			Where("timestamp < ? AND id <= ?", before, maxID).
+			Group(hourSQL + ", surface_type, " + cellSQL).
+			Scan(&groups)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		for _, g := range groups {
+			timestamp := time.Unix(g.Hour, 0).UTC()
+
+			hourly := persistence.HourlyRoadSurfaceObserved{
+				RoadSurfaceObservedID: fmt.Sprintf("%shourly:%s:%s:%d,%d", diwise.RoadSurfaceObservedIDPrefix, timestamp.Format(hourlyIDTimeFormat), g.SurfaceType, g.CellLatitude, g.CellLongitude),
+				RoadSegmentID:         g.RoadSegmentID,
+				SurfaceType:           g.SurfaceType,
+				Timestamp:             timestamp,
+			}
+
+			existing := []persistence.HourlyRoadSurfaceObserved{}
+			result = tx.Where("road_surface_observed_id = ?", hourly.RoadSurfaceObservedID).Limit(1).Find(&existing)
+			if result.Error != nil {
+				return result.Error
+			}
+
+			if len(existing) > 0 {
+				hourly = existing[0]
+			}
+
+			n := float64(hourly.Observations)
+			total := n + float64(g.Observations)
+
+			hourly.Latitude = (hourly.Latitude*n + g.LatitudeSum) / total
+			hourly.Longitude = (hourly.Longitude*n + g.LongitudeSum) / total
+			hourly.Probability = (hourly.Probability*n + g.ProbabilitySum) / total
+			hourly.Observations += g.Observations
+
+			result = tx.Save(&hourly)
+			if result.Error != nil {
+				return result.Error
+			}
+		}
+
+		result = tx.Unscoped().
+			Where("timestamp < ? AND id <= ?", before, maxID).
+			Delete(&persistence.RoadSurfaceObserved{})
+		if result.Error != nil {
+			return result.Error
+		}
+
+		purged = result.RowsAffected
+		return nil
+	})
+
+	return purged, err
+}
+
+//PurgeObservationAggregates deletes the hourly aggregates of hours that started before a point
+//in time. It returns the number of aggregates that were deleted.
+func (db *myDB) PurgeObservationAggregates(before time.Time) (int64, error) {
+	var purged int64
+
+	err := db.impl.Transaction(func(tx *gorm.DB) error {
+		result := tx.Unscoped().Where("date_observed_from < ?", before).Delete(&persistence.HourlyTrafficFlowObserved{})
+		if result.Error != nil {
+			return result.Error
+		}
+		purged = result.RowsAffected
+
+		result = tx.Unscoped().Where("timestamp < ?", before).Delete(&persistence.HourlyRoadSurfaceObserved{})
+		if result.Error != nil {
+			return result.Error
+		}
+		purged += result.RowsAffected
+
+		return nil
+	})
+
+	return purged, err
+}
@@ -0,0 +1,12 @@
+package env
+
+import "os"
+
+//GetVariableOrDefault returns the value of an environment variable, or the fallback value if
+//the variable is not set
+func GetVariableOrDefault(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,147 @@
+package context
+
+import (
+	"time"
+
+	"github.com/diwise/api-transportation/internal/pkg/alerts"
+	"github.com/diwise/api-transportation/internal/pkg/database"
+	"github.com/diwise/api-transportation/internal/pkg/persistence"
+	"github.com/diwise/ngsi-ld-golang/pkg/datamodels/fiware"
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/geojson"
+	ngsitypes "github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/types"
+)
+
+//AlertIDPrefix is the prefix of the identities of Alert entities
+const AlertIDPrefix string = "urn:ngsi-ld:Alert:"
+
+//alert is a Smart Data Models Alert about a hazardous road surface. The location of the
+//alert is the geometry of the affected road segment.
+type alert struct {
+	ngsitypes.BaseEntity
+	Name        *ngsitypes.TextProperty     `json:"name"`
+	Category    *ngsitypes.TextProperty     `json:"category"`
+	SubCategory *ngsitypes.TextProperty     `json:"subCategory"`
+	Severity    *ngsitypes.TextProperty     `json:"severity"`
+	Description *ngsitypes.TextProperty     `json:"description,omitempty"`
+	AlertSource *ngsitypes.TextProperty     `json:"alertSource"`
+	Location    interface{}                 `json:"location,omitempty"`
+	DateIssued  *ngsitypes.DateTimeProperty `json:"dateIssued"`
+	ValidFrom   *ngsitypes.DateTimeProperty `json:"validFrom"`
+	ValidTo     *ngsitypes.DateTimeProperty `json:"validTo,omitempty"`
+	Status      *ngsitypes.TextProperty     `json:"status"`
+}
+
+func newAlert(a persistence.Alert, segment database.RoadSegment) *alert {
+	entity := &alert{
+		BaseEntity: ngsitypes.BaseEntity{
+			ID:   AlertIDPrefix + a.AlertID,
+			Type: "Alert",
+			Context: []string{
+				"https://smartdatamodels.org/context.jsonld",
+				"https://uri.etsi.org/ngsi-ld/v1/ngsi-ld-core-context.jsonld",
+			},
+		},
+		Name:        ngsitypes.NewTextProperty(alerts.Name),
+		Category:    ngsitypes.NewTextProperty(alerts.Category),
+		SubCategory: ngsitypes.NewTextProperty(a.SubCategory),
+		Severity:    ngsitypes.NewTextProperty(a.Severity),
+		AlertSource: ngsitypes.NewTextProperty(fiware.RoadSegmentIDPrefix + a.SegmentID),
+		DateIssued:  ngsitypes.CreateDateTimeProperty(a.DateIssued.UTC().Format(time.RFC3339)),
+		ValidFrom:   ngsitypes.CreateDateTimeProperty(a.ValidFrom.UTC().Format(time.RFC3339)),
+		Status:      ngsitypes.NewTextProperty(a.Status),
+	}
+
+	if a.Description != "" {
+		entity.Description = ngsitypes.NewTextProperty(a.Description)
+	}
+
+	if a.ValidTo != nil {
+		entity.ValidTo = ngsitypes.CreateDateTimeProperty(a.ValidTo.UTC().Format(time.RFC3339))
+	}
+
+	// Fall back to the middle of the segment if the segment is no longer known
+	if segment != nil {
+		location := ngsitypes.NewRoadSegmentLocation(segment.Coordinates())
+		entity.Location = &location
+	} else {
+		entity.Location = geojson.CreateGeoJSONPropertyFromWGS84(a.Longitude, a.Latitude)
+	}
+
+	return entity
+}
+
+var alertProperties = observationProperties{
+	idPrefix: AlertIDPrefix,
+	filterable: map[string]string{
+		"status":      "status",
+		"severity":    "severity",
+		"subCategory": "subCategory",
+	},
+	temporal: map[string]string{
+		"observedAt": "dateIssued",
+		"dateIssued": "dateIssued",
+		"validFrom":  "validFrom",
+		"validTo":    "validTo",
+	},
+}
+
+func (cs *contextSource) getAlerts(req *entityRequest, callback keyedEntitiesCallback) (uint64, error) {
+	order := req.order
+
+	// Unless the client asks for a specific order, the most recent alerts are returned first
+	if order.isEmpty() {
+		order = ordering{{Property: "dateIssued", Descending: true}}
+	}
+
+	alertQuery, err := newObservationQuery(req, alertProperties, order)
+	if err != nil || alertQuery == nil {
+		return 0, err
+	}
+
+	ref := alertQuery.ReferencePoint
+
+	// An idPattern can not be matched in SQL, so the page is picked after filtering
+	paged := !req.ids.hasPattern()
+
+	total := uint64(0)
+	if paged {
+		total, err = cs.db.CountAlerts(*alertQuery)
+		if err != nil {
+			return 0, err
+		}
+
+		alertQuery.Offset = int(req.offset)
+		alertQuery.Limit = int(req.limit)
+	}
+
+	storedAlerts, err := cs.db.QueryAlerts(*alertQuery)
+	if err != nil {
+		return 0, err
+	}
+
+	matchingAlerts := []persistence.Alert{}
+	for _, a := range storedAlerts {
+		if paged || req.ids.matches(AlertIDPrefix+a.AlertID) {
+			matchingAlerts = append(matchingAlerts, a)
+		}
+	}
+
+	firstIndex, stopIndex := uint64(0), uint64(len(matchingAlerts))
+	if !paged {
+		total = uint64(len(matchingAlerts))
+		firstIndex, stopIndex = pageBounds(total, req.offset, req.limit)
+	}
+
+	for i := firstIndex; i < stopIndex; i++ {
+		a := matchingAlerts[i]
+
+		segment, _ := cs.db.GetRoadSegmentByID(a.SegmentID)
+
+		err = callback(newAlert(a, segment), alertSortKeys(a, ref))
+		if err != nil {
+			return total, err
+		}
+	}
+
+	return total, nil
+}
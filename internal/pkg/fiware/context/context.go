@@ -2,18 +2,21 @@ package context
 
 import (
 	"errors"
-	"math"
+	"fmt"
 	"sort"
 	"strings"
 	"time"
 
 	"github.com/diwise/api-transportation/internal/pkg/database"
+	"github.com/diwise/api-transportation/internal/pkg/fusion"
 	"github.com/diwise/api-transportation/internal/pkg/messaging"
 	"github.com/diwise/api-transportation/internal/pkg/messaging/commands"
+	"github.com/diwise/api-transportation/internal/pkg/messaging/events"
+	"github.com/diwise/api-transportation/internal/pkg/persistence"
+	"github.com/diwise/api-transportation/internal/pkg/surface"
 	diwise "github.com/diwise/ngsi-ld-golang/pkg/datamodels/diwise"
 	"github.com/diwise/ngsi-ld-golang/pkg/datamodels/fiware"
 	ngsi "github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld"
-	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/geojson"
 	ngsitypes "github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/types"
 	"github.com/google/uuid"
 
@@ -21,27 +24,49 @@ import (
 )
 
 type contextSource struct {
-	db  database.Datastore
-	msg messaging.MessagingContext
+	db    database.Datastore
+	msg   messaging.MessagingContext
+	fuser fusion.Fuser
 }
 
-//CreateSource instantiates and returns a Fiware ContextSource that wraps the provided db interface
-func CreateSource(db database.Datastore, msg messaging.MessagingContext) ngsi.ContextSource {
-	return &contextSource{db: db, msg: msg}
+//CreateSource instantiates and returns a Fiware ContextSource that wraps the provided db interface.
+//New road surface observations are fused into the surface of the closest road segment, unless
+//the provided fuser is nil.
+func CreateSource(db database.Datastore, msg messaging.MessagingContext, fuser fusion.Fuser) ContextSource {
+	return &contextSource{db: db, msg: msg, fuser: fuser}
 }
 
 func (cs *contextSource) CreateEntity(typeName, entityID string, req ngsi.Request) error {
 	var err error
 
 	if typeName == "RoadSurfaceObserved" {
-		rso := &diwise.RoadSurfaceObserved{}
-		err = req.DecodeBodyInto(rso)
+		var rso *diwise.RoadSurfaceObserved
+		rso, err = decodeRoadSurfaceObserved(req)
 		if err != nil {
 			log.Errorf("could not create new RoadSurfaceObserved: %s", err.Error())
 			return err
 		}
 		rso.ID = uuid.New().String()
-		_, err = cs.db.CreateRoadSurfaceObserved(rso)
+
+		segmentID, matched := "", false
+		if cs.fuser != nil {
+			segmentID, matched = cs.fuser.MapMatch(rso)
+		}
+
+		var stored *persistence.RoadSurfaceObserved
+		stored, err = cs.db.CreateRoadSurfaceObserved(rso)
+		if err == nil {
+			cs.publishRoadSurfaceObservedCreated(rso, stored)
+		}
+
+		// The observation is stored once it has been created, so failing to fuse it must not
+		// make the client retry and store it again
+		if err == nil && matched {
+			fuseErr := cs.fuser.FuseSegment(segmentID, time.Now().UTC())
+			if fuseErr != nil {
+				log.Errorf("failed to fuse road surface observations of segment %s: %s", segmentID, fuseErr.Error())
+			}
+		}
 	} else if typeName == "TrafficFlowObserved" {
 		tfo := &fiware.TrafficFlowObserved{}
 		err = req.DecodeBodyInto(tfo)
@@ -49,19 +74,158 @@ func (cs *contextSource) CreateEntity(typeName, entityID string, req ngsi.Reques
 			log.Errorf("could not create new TrafficFlowObserved: %s", err.Error())
 			return err
 		}
+		// The fiware model decodes itself, so the rest of the attributes are decoded separately
+		details := &trafficFlowObservedDetails{}
+		err = req.DecodeBodyInto(details)
+		if err != nil {
+			return err
+		}
+
 		tfo.ID = uuid.New().String()
-		_, err = cs.db.CreateTrafficFlowObserved(tfo)
+		var stored *persistence.TrafficFlowObserved
+		var duplicate bool
+		stored, duplicate, err = cs.db.UpsertTrafficFlowObserved(tfo, details.toDatastore())
 		if err != nil {
 			log.Errorf("could not create new tfo in database: %s", err.Error())
+			return err
+		}
+
+		if !duplicate {
+			cs.publishTrafficFlowObservedCreated(stored)
+		}
+
+		if tfo.RefRoadSegment != nil {
+			cs.updateCongestion(strings.TrimPrefix(tfo.RefRoadSegment.Object, fiware.RoadSegmentIDPrefix), stored.DateObserved)
 		}
 	}
 
 	return err
 }
 
-func (cs *contextSource) getRoads(query ngsi.Query, callback ngsi.QueryEntitiesCallback) error {
+//publishTrafficFlowObservedCreated notifies other services about a newly stored traffic flow
+//observation by publishing a TrafficFlowObservedCreated event
+func (cs *contextSource) publishTrafficFlowObservedCreated(tfo *persistence.TrafficFlowObserved) {
+	if cs.msg == nil {
+		return
+	}
+
+	event := &events.TrafficFlowObservedCreated{
+		ID:                  tfo.TrafficFlowObservedID,
+		LaneID:              tfo.LaneID,
+		Intensity:           tfo.Intensity,
+		AverageVehicleSpeed: tfo.AverageVehicleSpeed,
+		Latitude:            tfo.Latitude,
+		Longitude:           tfo.Longitude,
+		DateObserved:        tfo.DateObserved.UTC().Format(time.RFC3339),
+		DateObservedFrom:    tfo.DateObservedFrom.UTC().Format(time.RFC3339),
+		DateObservedTo:      tfo.DateObservedTo.UTC().Format(time.RFC3339),
+		Timestamp:           time.Now().UTC().Format(time.RFC3339),
+	}
+
+	if tfo.SegmentID != "" {
+		event.RoadSegment = fiware.RoadSegmentIDPrefix + tfo.SegmentID
+	}
+
+	if tfo.SourceDevice != nil {
+		event.RefDevice = *tfo.SourceDevice
+	}
+
+	err := cs.msg.PublishOnTopic(event)
+	if err != nil {
+		log.Errorf("failed to publish the creation of %s: %s", tfo.TrafficFlowObservedID, err.Error())
+	}
+}
+
+//publishRoadSurfaceObservedCreated notifies other services about a newly stored road surface
+//observation by publishing a RoadSurfaceObservedCreated event
+func (cs *contextSource) publishRoadSurfaceObservedCreated(src *diwise.RoadSurfaceObserved, rso *persistence.RoadSurfaceObserved) {
+	if cs.msg == nil {
+		return
+	}
+
+	event := &events.RoadSurfaceObservedCreated{
+		ID:           rso.RoadSurfaceObservedID,
+		SurfaceType:  rso.SurfaceType,
+		Probability:  rso.Probability,
+		Latitude:     rso.Latitude,
+		Longitude:    rso.Longitude,
+		DateObserved: rso.Timestamp.UTC().Format(time.RFC3339),
+		Timestamp:    time.Now().UTC().Format(time.RFC3339),
+	}
+
+	// The observation refers to the segment that it was matched to, if it was matched at all
+	if src.RefRoadSegment != nil && len(src.RefRoadSegment.Object) > 0 {
+		event.RoadSegment = fiware.RoadSegmentIDPrefix + strings.TrimPrefix(src.RefRoadSegment.Object[0], fiware.RoadSegmentIDPrefix)
+	}
+
+	err := cs.msg.PublishOnTopic(event)
+	if err != nil {
+		log.Errorf("failed to publish the creation of %s: %s", rso.RoadSurfaceObservedID, err.Error())
+	}
+}
+
+//updateCongestion decides the congestion level of a road segment after a traffic flow has been
+//observed on it, and publishes a RoadSegmentCongestionUpdated event if the level changed
+func (cs *contextSource) updateCongestion(segmentID string, observedAt time.Time) {
+	current, previousLevel, err := cs.db.UpdateRoadSegmentCongestion(segmentID, observedAt)
+	if err != nil {
+		log.Errorf("failed to update the congestion level of road segment %s: %s", segmentID, err.Error())
+		return
+	}
+
+	if current == nil || current.Level == previousLevel || cs.msg == nil {
+		return
+	}
+
+	err = cs.msg.PublishOnTopic(&events.RoadSegmentCongestionUpdated{
+		ID:                  segmentID,
+		Level:               current.Level,
+		PreviousLevel:       previousLevel,
+		AverageVehicleSpeed: current.AverageVehicleSpeed,
+		SpeedRatio:          current.SpeedRatio,
+		Intensity:           current.Intensity,
+		ObservedAt:          current.ObservedAt.Format(time.RFC3339),
+		Timestamp:           time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		log.Errorf("failed to publish the congestion level of road segment %s: %s", segmentID, err.Error())
+	}
+}
+
+//entityRequest contains the parts of a query that have been parsed by GetEntities, and
+//the page of entities that a getter should return
+type entityRequest struct {
+	query   ngsi.Query
+	order   ordering
+	ids     *idFilter
+	filters []database.PropertyFilter
+	// dataset is the datasetId of the surface predictions that should be returned, allDatasets
+	// for all of them, or empty for the default prediction
+	dataset string
+	offset  uint64
+	limit   uint64
+}
+
+//allDatasets is the datasetId query parameter value that asks for the predictions of every dataset
+const allDatasets string = "@all"
+
+func requestedDataset(query ngsi.Query) string {
+	req := query.Request()
+	if req == nil {
+		return ""
+	}
+
+	return strings.TrimSpace(req.URL.Query().Get("datasetId"))
+}
+
+//keyedEntitiesCallback is used by the getters to pass entities, together with the keys
+//that they can be ordered by, back to GetEntities
+type keyedEntitiesCallback func(entity ngsi.Entity, keys sortKeys) error
+
+func (cs *contextSource) getRoads(req *entityRequest, callback keyedEntitiesCallback) (uint64, error) {
 	var err error
 
+	query := req.query
 	roads := []database.Road{}
 
 	if query.IsGeoQuery() {
@@ -73,20 +237,42 @@ func (cs *contextSource) getRoads(query ngsi.Query, callback ngsi.QueryEntitiesC
 		} else if geoQ.GeoRel == ngsi.GeoSpatialRelationWithinRect {
 			lon0, lat0, lon1, lat1, err := geoQ.Rectangle()
 			if err != nil {
-				return err
+				return 0, err
 			}
 			roads, _ = cs.db.GetRoadsWithinRect(lat0, lon0, lat1, lon1)
 		}
+	} else if req.ids.hasIdentities() {
+		for _, id := range req.ids.identities(fiware.RoadIDPrefix) {
+			if road, err := cs.db.GetRoadByID(id); err == nil {
+				roads = append(roads, road)
+			}
+		}
 	}
 
-	numberOfRoads := uint64(len(roads))
-
-	firstIndex := query.PaginationOffset()
-	stopIndex := firstIndex + query.PaginationLimit()
+	ref := referencePoint(query)
+	keys := map[string]sortKeys{}
+	matchingRoads := []database.Road{}
 
-	if stopIndex > numberOfRoads {
-		stopIndex = numberOfRoads
+	for _, r := range roads {
+		if _, ok := keys[r.ID()]; ok || !req.ids.matches(fiware.RoadIDPrefix+r.ID()) {
+			continue
+		}
+		if !matchesFilters(req.filters, roadFilterValues(r)) {
+			continue
+		}
+		keys[r.ID()] = roadSortKeys(r, ref)
+		matchingRoads = append(matchingRoads, r)
 	}
+	roads = matchingRoads
+
+	// Sort the roads in the order requested by the client, falling back to the road id
+	// to get a deterministic order that can be paged through
+	sort.Slice(roads, func(i, j int) bool {
+		return req.order.less(keys[roads[i].ID()], keys[roads[j].ID()])
+	})
+
+	numberOfRoads := uint64(len(roads))
+	firstIndex, stopIndex := pageBounds(numberOfRoads, req.offset, req.limit)
 
 	if firstIndex > 0 || stopIndex != numberOfRoads {
 		log.Infof("Returning road %d to %d of %d", firstIndex, stopIndex-1, numberOfRoads)
@@ -96,18 +282,28 @@ func (cs *contextSource) getRoads(query ngsi.Query, callback ngsi.QueryEntitiesC
 		r := roads[i]
 		fwRoad := fiware.NewRoad(r.ID(), r.ID(), "class", r.GetSegmentIdentities())
 
-		err = callback(fwRoad)
+		err = callback(fwRoad, keys[r.ID()])
 		if err != nil {
 			break
 		}
 	}
 
-	return err
+	return numberOfRoads, err
 }
 
-func (cs *contextSource) getRoadSegments(query ngsi.Query, callback ngsi.QueryEntitiesCallback) error {
+//roadFilterValues returns the values of the properties of a road that can be filtered on with q.
+//Filters on any other property, e.g. one that only road segments have, never match a road.
+func roadFilterValues(r database.Road) map[string]interface{} {
+	return map[string]interface{}{
+		"name":      r.ID(),
+		"roadClass": "class",
+	}
+}
+
+func (cs *contextSource) getRoadSegments(req *entityRequest, callback keyedEntitiesCallback) (uint64, error) {
 	var err error
 
+	query := req.query
 	segments := []database.RoadSegment{}
 
 	if query.IsGeoQuery() {
@@ -119,112 +315,593 @@ func (cs *contextSource) getRoadSegments(query ngsi.Query, callback ngsi.QueryEn
 		} else if geoQ.GeoRel == ngsi.GeoSpatialRelationWithinRect {
 			lon0, lat0, lon1, lat1, err := geoQ.Rectangle()
 			if err != nil {
-				return err
+				return 0, err
 			}
 			segments, _ = cs.db.GetSegmentsWithinRect(lat0, lon0, lat1, lon1)
 		}
+	} else if req.ids.hasIdentities() {
+		for _, id := range req.ids.identities(fiware.RoadSegmentIDPrefix) {
+			if segment, err := cs.db.GetRoadSegmentByID(id); err == nil {
+				segments = append(segments, segment)
+			}
+		}
 	}
 
-	numberOfSegments := uint64(len(segments))
+	// Only the traffic of the segments that may match is loaded, as it is needed to filter them
+	segmentIDs := make([]string, 0, len(segments))
+	for _, s := range segments {
+		segmentIDs = append(segmentIDs, s.ID())
+	}
 
-	firstIndex := query.PaginationOffset()
-	stopIndex := firstIndex + query.PaginationLimit()
+	traffic, err := cs.db.GetRoadSegmentTraffic(segmentIDs)
+	if err != nil {
+		return 0, err
+	}
+
+	ref := referencePoint(query)
+	keys := map[string]sortKeys{}
+	matchingSegments := []database.RoadSegment{}
 
-	if stopIndex > numberOfSegments {
-		stopIndex = numberOfSegments
+	for _, s := range segments {
+		if _, ok := keys[s.ID()]; ok || !req.ids.matches(fiware.RoadSegmentIDPrefix+s.ID()) {
+			continue
+		}
+		if !roadSegmentMatchesFilters(s, req.dataset, traffic[s.ID()], req.filters) {
+			continue
+		}
+		keys[s.ID()] = roadSegmentSortKeys(s, ref)
+		matchingSegments = append(matchingSegments, s)
 	}
+	segments = matchingSegments
+
+	// Sort the segments in the order requested by the client, falling back to the segment
+	// id to get a deterministic order that does not change when segments are updated
+	// between two page requests
+	sort.Slice(segments, func(i, j int) bool {
+		return req.order.less(keys[segments[i].ID()], keys[segments[j].ID()])
+	})
+
+	numberOfSegments := uint64(len(segments))
+	firstIndex, stopIndex := pageBounds(numberOfSegments, req.offset, req.limit)
 
 	if firstIndex > 0 || stopIndex != numberOfSegments {
 		log.Infof("Returning segment %d to %d of %d", firstIndex, stopIndex-1, numberOfSegments)
 	}
 
-	sort.Slice(segments, func(i, j int) bool {
-		iTime := segments[i].DateModified()
-		jTime := segments[j].DateModified()
-
-		// Sort by time first with most recently updated at the top
-		// TODO: Remove this when we have working pagination as it breaks pageability of the data
-		if iTime != nil {
-			if jTime != nil {
-				// We want the most reent to come first, so it is less if it is after ...
-				return iTime.After(*jTime)
-			} else {
-				return true
-			}
-		} else if jTime != nil {
-			return false
-		}
-
-		// Neither segment have been updated. Sort by segment id
-		return strings.Compare(segments[i].ID(), segments[j].ID()) < 0
-	})
+	freshness := cs.db.SurfaceFreshness()
+	now := time.Now().UTC()
 
 	for i := firstIndex; i < stopIndex; i++ {
 		s := segments[i]
-		rs := fiware.NewRoadSegment(s.ID(), s.ID(), s.RoadID(), s.Coordinates(), s.DateModified())
-
-		surfaceType, probability := s.SurfaceType()
-		rs = rs.WithSurfaceType(surfaceType, probability)
 
-		err = callback(rs)
+		err = callback(newRoadSegment(s, req.dataset, traffic[s.ID()], freshness, now), keys[s.ID()])
 		if err != nil {
 			break
 		}
 	}
 
-	return err
+	return numberOfSegments, err
+}
+
+//roadSegment extends the fiware RoadSegment with the most recent surface material and
+//surface condition of the segment, and how fresh they are. SurfaceType holds either a single
+//prediction or, when all datasets are requested, a list of predictions.
+type roadSegment struct {
+	*fiware.RoadSegment
+	SurfaceType             interface{}               `json:"surfaceType,omitempty"`
+	SurfaceTypeDistribution *surfaceTypeDistribution  `json:"surfaceTypeDistribution,omitempty"`
+	SurfaceMaterial         *roadSurfaceType          `json:"surfaceMaterial,omitempty"`
+	SurfaceCondition        *roadSurfaceType          `json:"surfaceCondition,omitempty"`
+	MaximumAllowedSpeed     *ngsitypes.NumberProperty `json:"maximumAllowedSpeed,omitempty"`
+	CongestionLevel         *congestionLevel          `json:"congestionLevel,omitempty"`
+}
+
+//congestionLevel is the congestion level of a road segment together with the traffic that it
+//was decided from
+type congestionLevel struct {
+	ngsitypes.TextProperty
+	ObservedAt          string  `json:"observedAt"`
+	AverageVehicleSpeed float64 `json:"averageVehicleSpeed"`
+	SpeedRatio          float64 `json:"speedRatio"`
+	Intensity           int     `json:"intensity"`
+}
+
+func newCongestionLevel(c *persistence.RoadSegmentCongestion) *congestionLevel {
+	if c == nil {
+		return nil
+	}
+
+	return &congestionLevel{
+		TextProperty:        *ngsitypes.NewTextProperty(c.Level),
+		ObservedAt:          c.ObservedAt.UTC().Format(time.RFC3339),
+		AverageVehicleSpeed: c.AverageVehicleSpeed,
+		SpeedRatio:          c.SpeedRatio,
+		Intensity:           c.Intensity,
+	}
+}
+
+//roadSurfaceType extends the fiware RoadSurfaceType with the time of the prediction, the
+//probability after it has decayed with time, whether the prediction is fresh or stale and
+//where the prediction came from
+type roadSurfaceType struct {
+	fiware.RoadSurfaceType
+	ObservedAt           string                              `json:"observedAt,omitempty"`
+	EffectiveProbability float64                             `json:"effectiveProbability"`
+	State                string                              `json:"state"`
+	DatasetID            string                              `json:"datasetId,omitempty"`
+	ObservedBy           *ngsitypes.SingleObjectRelationship `json:"observedBy,omitempty"`
+}
+
+const (
+	surfaceStateFresh string = "fresh"
+	surfaceStateStale string = "stale"
+)
+
+func newRoadSegment(s database.RoadSegment, dataset string, traffic database.RoadSegmentTraffic, freshness *surface.Freshness, now time.Time) *roadSegment {
+	segment := &roadSegment{
+		RoadSegment:      fiware.NewRoadSegment(s.ID(), s.ID(), s.RoadID(), s.Coordinates(), s.DateModified()),
+		SurfaceMaterial:  newRoadSurfaceType(s.SurfaceMaterial(), freshness, now),
+		SurfaceCondition: newRoadSurfaceType(s.SurfaceCondition(), freshness, now),
+		CongestionLevel:  newCongestionLevel(traffic.Congestion),
+	}
+
+	if traffic.SpeedLimit != nil {
+		segment.MaximumAllowedSpeed = ngsitypes.NewNumberProperty(*traffic.SpeedLimit)
+	}
+
+	prediction := s.SurfacePrediction()
+	if dataset != "" && dataset != allDatasets {
+		prediction = s.SurfaceDataset(dataset)
+	}
+
+	if surfaceType := newRoadSurfaceType(prediction, freshness, now); surfaceType != nil {
+		segment.SurfaceType = surfaceType
+
+		// The distribution of a stale prediction is as unreliable as its most probable surface type
+		if surfaceType.State == surfaceStateFresh {
+			segment.SurfaceTypeDistribution = newSurfaceTypeDistribution(prediction.Distribution)
+		}
+	}
+
+	if dataset == allDatasets {
+		instances := []*roadSurfaceType{}
+		for _, p := range s.SurfaceDatasets() {
+			instances = append(instances, newRoadSurfaceType(p, freshness, now))
+		}
+
+		if len(instances) > 0 {
+			segment.SurfaceType = instances
+		}
+	}
+
+	return segment
+}
+
+//newRoadSurfaceType converts a prediction into a property, replacing stale predictions
+//with an unknown surface type
+func newRoadSurfaceType(prediction *database.SurfacePrediction, freshness *surface.Freshness, now time.Time) *roadSurfaceType {
+	if prediction == nil || prediction.SurfaceType == "" {
+		return nil
+	}
+
+	rst := &roadSurfaceType{
+		RoadSurfaceType: fiware.RoadSurfaceType{
+			TextProperty: ngsitypes.TextProperty{
+				Property: ngsitypes.Property{Type: "Property"},
+				Value:    prediction.SurfaceType,
+			},
+			Probability: prediction.Probability,
+		},
+		EffectiveProbability: freshness.EffectiveProbability(prediction.Kind, prediction.Probability, prediction.Timestamp, now),
+		State:                surfaceStateFresh,
+		DatasetID:            prediction.Provenance.DatasetID(),
+	}
+
+	if prediction.Provenance.Client != "" {
+		rst.ObservedBy = ngsitypes.NewSingleObjectRelationship(prediction.Provenance.Client)
+	}
+
+	if !prediction.Timestamp.IsZero() {
+		rst.ObservedAt = prediction.Timestamp.UTC().Format(time.RFC3339)
+	}
+
+	if freshness.IsStale(prediction.Kind, prediction.Timestamp, now) {
+		rst.Value = surface.Unknown
+		rst.Probability = 0
+		rst.State = surfaceStateStale
+	}
+
+	return rst
+}
+
+//roadSegmentMatchesFilters returns true if the surface prediction of the requested dataset,
+//together with the congestion level of the segment, matches all filters, or if any dataset
+//does when all datasets are requested
+func roadSegmentMatchesFilters(s database.RoadSegment, dataset string, traffic database.RoadSegmentTraffic, filters []database.PropertyFilter) bool {
+	if len(filters) == 0 {
+		return true
+	}
+
+	predictions := []*database.SurfacePrediction{s.SurfacePrediction()}
+	if dataset == allDatasets {
+		predictions = s.SurfaceDatasets()
+	} else if dataset != "" {
+		predictions = []*database.SurfacePrediction{s.SurfaceDataset(dataset)}
+	}
+
+	for _, prediction := range predictions {
+		values := surfacePredictionFilterValues(prediction)
+
+		if traffic.SpeedLimit != nil {
+			values["maximumAllowedSpeed"] = *traffic.SpeedLimit
+		}
+
+		if traffic.Congestion != nil {
+			values["congestionLevel"] = traffic.Congestion.Level
+		}
+
+		if matchesFilters(filters, values) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//surfacePredictionFilterValues returns the values of the properties of a road segment's
+//surface prediction that can be filtered on with q, i.e. the provenance of the prediction
+func surfacePredictionFilterValues(prediction *database.SurfacePrediction) map[string]interface{} {
+	values := map[string]interface{}{}
+
+	if prediction == nil {
+		return values
+	}
+
+	provenance := map[string]string{
+		"surfaceType.datasetId":    prediction.Provenance.DatasetID(),
+		"surfaceType.observedBy":   prediction.Provenance.Client,
+		"surfaceType.source":       prediction.Provenance.Source,
+		"surfaceType.model":        prediction.Provenance.Model,
+		"surfaceType.modelVersion": prediction.Provenance.ModelVersion,
+	}
+
+	for property, value := range provenance {
+		if value != "" {
+			values[property] = value
+		}
+	}
+
+	return values
+}
+
+//observationProperties describes how the properties of an observation type, that can be
+//used in queries, map to the properties used by the datastore
+type observationProperties struct {
+	idPrefix string
+	// filterable maps the properties that can be filtered on with q
+	filterable map[string]string
+	// temporal maps the time properties that a temporal query can target
+	temporal map[string]string
+	// segmentRelationship is the relationship, if any, that refers to the road segment of an
+	// observation, e.g. refRoadSegment
+	segmentRelationship string
+}
+
+var roadSurfaceObservedProperties = observationProperties{
+	idPrefix: diwise.RoadSurfaceObservedIDPrefix,
+	filterable: map[string]string{
+		"surfaceType":             "surfaceType",
+		"probability":             "probability",
+		"surfaceType.probability": "probability",
+	},
+	temporal: map[string]string{
+		"observedAt":   "dateObserved",
+		"dateObserved": "dateObserved",
+		"createdAt":    "dateCreated",
+		"dateCreated":  "dateCreated",
+	},
+}
+
+var trafficFlowObservedProperties = observationProperties{
+	idPrefix: fiware.TrafficFlowObservedIDPrefix,
+	filterable: map[string]string{
+		"laneID":               "laneID",
+		"intensity":            "intensity",
+		"averageVehicleSpeed":  "averageVehicleSpeed",
+		"occupancy":            "occupancy",
+		"congested":            "congested",
+		"averageHeadwayTime":   "averageHeadwayTime",
+		"averageGapDistance":   "averageGapDistance",
+		"averageVehicleLength": "averageVehicleLength",
+		"vehicleType":          "vehicleType",
+		"vehicleSubType":       "vehicleSubType",
+		"laneDirection":        "laneDirection",
+		"reversedLane":         "reversedLane",
+	},
+	temporal: map[string]string{
+		"observedAt":       "dateObserved",
+		"dateObserved":     "dateObserved",
+		"dateObservedFrom": "dateObservedFrom",
+		"dateObservedTo":   "dateObservedTo",
+		"createdAt":        "dateCreated",
+		"dateCreated":      "dateCreated",
+		"modifiedAt":       "dateModified",
+		"dateModified":     "dateModified",
+	},
+	segmentRelationship: "refRoadSegment",
+}
+
+//ValidateTimeProperty returns an error if a temporal query targets a time property (timeproperty=)
+//that none of the entity types provided by this context source have
+func ValidateTimeProperty(timeProperty string) error {
+	for _, properties := range []observationProperties{roadSurfaceObservedProperties, trafficFlowObservedProperties, alertProperties} {
+		if _, ok := properties.temporal[timeProperty]; ok {
+			return nil
+		}
+	}
+
+	return errors.New("unable to apply a temporal query to unknown time property " + timeProperty)
+}
+
+//newObservationQuery translates the geo and temporal queries, id list, q filters and ordering
+//of a request into an ObservationQuery. A nil query is returned if the request filters on
+//properties that the observations lack, or only asks for identities of other types of entities,
+//as such a request can never match any observations.
+func newObservationQuery(req *entityRequest, properties observationProperties, order ordering) (*database.ObservationQuery, error) {
+	query := req.query
+
+	segmentIDs, propertyFilters, err := segmentFilters(req.filters, properties.segmentRelationship)
+	if err != nil || segmentIDs == nil {
+		return nil, err
+	}
+
+	filters, ok := filtersForProperties(propertyFilters, properties.filterable)
+	if !ok {
+		return nil, nil
+	}
+
+	ids := req.ids.identities(properties.idPrefix)
+	if req.ids.hasIdentities() && len(ids) == 0 {
+		// None of the requested identities belong to this type of observation
+		return nil, nil
+	}
+
+	observationQuery := &database.ObservationQuery{
+		IDs:            ids,
+		RoadSegmentIDs: segmentIDs,
+		Filters:        filters,
+		OrderBy:        order,
+		ReferencePoint: referencePoint(query),
+	}
+
+	if query.IsTemporalQuery() {
+		temporalQ := query.Temporal()
+
+		timeProperty, ok := properties.temporal[temporalQ.Property()]
+		if !ok {
+			return nil, nil
+		}
+
+		observationQuery.From, observationQuery.To = temporalQ.TimeSpan()
+		observationQuery.TimeProperty = timeProperty
+	}
+
+	if query.IsGeoQuery() {
+		geoQ := query.Geo()
+		if geoQ.GeoRel == ngsi.GeoSpatialRelationNearPoint {
+			lon, lat, err := geoQ.Point()
+			if err != nil {
+				return nil, err
+			}
+			distance, _ := geoQ.Distance()
+
+			pt := database.NewPoint(lat, lon)
+			observationQuery.NearPoint = &pt
+			observationQuery.MaxDistance = uint64(distance)
+		} else if geoQ.GeoRel == ngsi.GeoSpatialRelationWithinRect {
+			lon0, lat0, lon1, lat1, err := geoQ.Rectangle()
+			if err != nil {
+				return nil, err
+			}
+
+			rect := database.NewRectangle(database.NewPoint(lat0, lon0), database.NewPoint(lat1, lon1))
+			observationQuery.WithinRect = &rect
+		}
+	}
+
+	return observationQuery, nil
 }
 
-func (cs *contextSource) getRoadSurfaceObserved(query ngsi.Query, callback ngsi.QueryEntitiesCallback) error {
-	roadSurfaces, err := cs.db.GetRoadSurfacesObserved()
+func (cs *contextSource) getRoadSurfaceObserved(req *entityRequest, callback keyedEntitiesCallback) (uint64, error) {
+	observationQuery, err := newObservationQuery(req, roadSurfaceObservedProperties, req.order)
+	if err != nil || observationQuery == nil {
+		return 0, err
+	}
+
+	ref := observationQuery.ReferencePoint
+
+	// An idPattern can not be matched in SQL, so the page is picked after filtering
+	paged := !req.ids.hasPattern()
+
+	total := uint64(0)
+	if paged {
+		total, err = cs.db.CountRoadSurfacesObserved(*observationQuery)
+		if err != nil {
+			return 0, err
+		}
+
+		observationQuery.Offset = int(req.offset)
+		observationQuery.Limit = int(req.limit)
+	}
+
+	roadSurfaces, err := cs.db.QueryRoadSurfacesObserved(*observationQuery)
 	if err != nil {
-		return err
+		return 0, err
 	}
+
+	matchingSurfaces := []persistence.RoadSurfaceObserved{}
+	entities := []*roadSurfaceObserved{}
+
 	for _, rso := range roadSurfaces {
-		diwiseRoadSurface := diwise.NewRoadSurfaceObserved(rso.RoadSurfaceObservedID, rso.SurfaceType, rso.Probability, rso.Latitude, rso.Longitude)
-		diwiseRoadSurface.DateObserved = ngsitypes.CreateDateTimeProperty(rso.Timestamp.Format(time.RFC3339))
-		err = callback(diwiseRoadSurface)
+		diwiseRoadSurface := newRoadSurfaceObserved(rso)
+		if paged || req.ids.matches(diwiseRoadSurface.ID) {
+			matchingSurfaces = append(matchingSurfaces, rso)
+			entities = append(entities, diwiseRoadSurface)
+		}
+	}
+
+	firstIndex, stopIndex := uint64(0), uint64(len(entities))
+	if !paged {
+		total = uint64(len(entities))
+		firstIndex, stopIndex = pageBounds(total, req.offset, req.limit)
+	}
+
+	for i := firstIndex; i < stopIndex; i++ {
+		err = callback(entities[i], roadSurfaceObservedSortKeys(matchingSurfaces[i], ref))
 		if err != nil {
 			break
 		}
 	}
 
-	return nil
+	return total, err
 }
 
-func (cs *contextSource) getTrafficFlowsObserved(query ngsi.Query, callback ngsi.QueryEntitiesCallback) error {
-	var from, to time.Time
+func (cs *contextSource) getTrafficFlowsObserved(req *entityRequest, callback keyedEntitiesCallback) (uint64, error) {
+	order := req.order
 
-	if query.IsTemporalQuery() {
-		from, to = query.Temporal().TimeSpan()
+	// Unless the client asks for a specific order, we return the most recent observations
+	// in chronological order
+	chronological := order.isEmpty()
+	if chronological {
+		order = ordering{
+			{Property: "dateObserved", Descending: true},
+			{Property: "laneID", Descending: true},
+		}
 	}
 
-	observations, err := cs.db.GetTrafficFlowsObserved(from, to, int(query.PaginationLimit()))
-	if err != nil {
-		return err
+	observationQuery, err := newObservationQuery(req, trafficFlowObservedProperties, order)
+	if err != nil || observationQuery == nil {
+		return 0, err
 	}
 
-	for i := len(observations) - 1; i >= 0; i-- {
-		obs := observations[i]
+	ref := observationQuery.ReferencePoint
 
-		timeStr := obs.DateObserved.Format(time.RFC3339)
-		trafficFlowObserved := fiware.NewTrafficFlowObserved(obs.TrafficFlowObservedID, timeStr, int(obs.LaneID), int(obs.Intensity))
+	// An idPattern can not be matched in SQL, so the page is picked after filtering
+	paged := !req.ids.hasPattern()
 
-		if obs.AverageVehicleSpeed > 0.1 {
-			trafficFlowObserved.AverageVehicleSpeed = ngsitypes.NewNumberProperty(obs.AverageVehicleSpeed)
+	total := uint64(0)
+	if paged {
+		total, err = cs.db.CountTrafficFlowsObserved(*observationQuery)
+		if err != nil {
+			return 0, err
 		}
 
-		if math.Abs(obs.Latitude) > 0.1 || math.Abs(obs.Longitude) > 0.1 {
-			trafficFlowObserved.Location = geojson.CreateGeoJSONPropertyFromWGS84(obs.Longitude, obs.Latitude)
+		observationQuery.Offset = int(req.offset)
+		observationQuery.Limit = int(req.limit)
+	}
+
+	observations, err := cs.db.QueryTrafficFlowsObserved(*observationQuery)
+	if err != nil {
+		return 0, err
+	}
+
+	matchingObservations := []persistence.TrafficFlowObserved{}
+	entities := []*trafficFlowObserved{}
+
+	for _, obs := range observations {
+		trafficFlowObserved := newTrafficFlowObserved(obs)
+		if paged || req.ids.matches(trafficFlowObserved.ID) {
+			matchingObservations = append(matchingObservations, obs)
+			entities = append(entities, trafficFlowObserved)
+		}
+	}
+
+	firstIndex, stopIndex := uint64(0), uint64(len(entities))
+	if !paged {
+		total = uint64(len(entities))
+		firstIndex, stopIndex = pageBounds(total, req.offset, req.limit)
+	}
+
+	for i := firstIndex; i < stopIndex; i++ {
+		idx := i
+		if chronological {
+			idx = firstIndex + stopIndex - 1 - i
 		}
 
-		err = callback(trafficFlowObserved)
+		err = callback(entities[idx], trafficFlowObservedSortKeys(matchingObservations[idx], ref))
 		if err != nil {
 			break
 		}
 	}
 
-	return nil
+	return total, err
+}
+
+//roadSurfaceObserved extends the diwise RoadSurfaceObserved with the time that the
+//observation was stored in the datastore
+type roadSurfaceObserved struct {
+	diwise.RoadSurfaceObserved
+	DateCreated *ngsitypes.DateTimeProperty `json:"dateCreated,omitempty"`
+}
+
+func newRoadSurfaceObserved(rso persistence.RoadSurfaceObserved) *roadSurfaceObserved {
+	diwiseRoadSurface := diwise.NewRoadSurfaceObserved(rso.RoadSurfaceObservedID, rso.SurfaceType, rso.Probability, rso.Latitude, rso.Longitude)
+	diwiseRoadSurface.DateObserved = ngsitypes.CreateDateTimeProperty(rso.Timestamp.Format(time.RFC3339))
+
+	roadSurface := &roadSurfaceObserved{RoadSurfaceObserved: *diwiseRoadSurface}
+	if !rso.CreatedAt.IsZero() {
+		roadSurface.DateCreated = ngsitypes.CreateDateTimeProperty(rso.CreatedAt.UTC().Format(time.RFC3339))
+	}
+
+	return roadSurface
+}
+
+//getEntitiesOfType passes a page of entities of the given type to the callback and
+//returns the total number of entities of that type that matched the request
+func (cs *contextSource) getEntitiesOfType(typeName string, req *entityRequest, callback keyedEntitiesCallback) (uint64, error) {
+	if typeName == "Road" {
+		return cs.getRoads(req, callback)
+	} else if typeName == "RoadSegment" {
+		return cs.getRoadSegments(req, callback)
+	} else if typeName == "RoadSurfaceObserved" {
+		return cs.getRoadSurfaceObserved(req, callback)
+	} else if typeName == "TrafficFlowObserved" {
+		return cs.getTrafficFlowsObserved(req, callback)
+	} else if typeName == "Alert" {
+		return cs.getAlerts(req, callback)
+	}
+
+	return 0, nil
+}
+
+//requestedTypes returns the provided types that a query asks for. A query without any
+//types asks for all types that provide at least one of the requested attributes.
+func requestedTypes(query ngsi.Query) []string {
+	typeNames := []string{}
+
+	for _, typeName := range query.EntityTypes() {
+		if findProvidedType(typeName) != nil && !containsString(typeNames, typeName) {
+			typeNames = append(typeNames, typeName)
+		}
+	}
+
+	if len(typeNames) == 0 && len(strings.Join(query.EntityTypes(), "")) == 0 {
+		for _, info := range providedTypes {
+			for _, attr := range info.attributes {
+				if containsString(query.EntityAttributes(), attr.name) {
+					typeNames = append(typeNames, info.name)
+					break
+				}
+			}
+		}
+	}
+
+	return typeNames
+}
+
+type keyedEntity struct {
+	entity ngsi.Entity
+	keys   sortKeys
 }
 
 func (cs *contextSource) GetEntities(query ngsi.Query, callback ngsi.QueryEntitiesCallback) error {
@@ -235,15 +912,78 @@ func (cs *contextSource) GetEntities(query ngsi.Query, callback ngsi.QueryEntiti
 		return errors.New("GetEntities: query may not be nil")
 	}
 
-	for _, typeName := range query.EntityTypes() {
-		if typeName == "Road" {
-			return cs.getRoads(query, callback)
-		} else if typeName == "RoadSegment" {
-			return cs.getRoadSegments(query, callback)
-		} else if typeName == "RoadSurfaceObserved" {
-			return cs.getRoadSurfaceObserved(query, callback)
-		} else if typeName == "TrafficFlowObserved" {
-			return cs.getTrafficFlowsObserved(query, callback)
+	req := &entityRequest{
+		query:  query,
+		offset: query.PaginationOffset(),
+		limit:  query.PaginationLimit(),
+	}
+
+	req.order, err = newOrdering(query)
+	if err != nil {
+		return err
+	}
+
+	req.ids, err = newIDFilter(query)
+	if err != nil {
+		return err
+	}
+
+	req.filters, err = newPropertyFilters(query)
+	if err != nil {
+		return err
+	}
+
+	req.dataset = requestedDataset(query)
+
+	callback = newEntityProjection(query).wrap(callback)
+	typeNames := requestedTypes(query)
+
+	if len(typeNames) == 1 {
+		total, err := cs.getEntitiesOfType(typeNames[0], req, func(entity ngsi.Entity, _ sortKeys) error {
+			return callback(entity)
+		})
+		addToResultCount(query, total)
+		return err
+	}
+
+	// When several types are requested, each type is asked for the first offset+limit
+	// entities in the requested order. These are then merged and the requested page
+	// is picked from the merged result.
+	if req.order.isEmpty() {
+		req.order = ordering{{Property: "id"}}
+	}
+
+	offset := req.offset
+	req.limit = req.offset + req.limit
+	req.offset = 0
+
+	entities := []keyedEntity{}
+	total := uint64(0)
+
+	for _, typeName := range typeNames {
+		count, err := cs.getEntitiesOfType(typeName, req, func(entity ngsi.Entity, keys sortKeys) error {
+			entities = append(entities, keyedEntity{entity: entity, keys: keys})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		total += count
+	}
+
+	addToResultCount(query, total)
+
+	sort.SliceStable(entities, func(i, j int) bool {
+		return req.order.less(entities[i].keys, entities[j].keys)
+	})
+
+	firstIndex, stopIndex := pageBounds(uint64(len(entities)), offset, query.PaginationLimit())
+
+	for i := firstIndex; i < stopIndex; i++ {
+		err = callback(entities[i].entity)
+		if err != nil {
+			break
 		}
 	}
 
@@ -251,13 +991,22 @@ func (cs *contextSource) GetEntities(query ngsi.Query, callback ngsi.QueryEntiti
 }
 
 func (cs contextSource) ProvidesAttribute(attributeName string) bool {
-	return true
+	for _, info := range providedTypes {
+		for _, attr := range info.attributes {
+			if attr.name == attributeName {
+				return true
+			}
+		}
+	}
+
+	return false
 }
 
 func (cs contextSource) ProvidesEntitiesWithMatchingID(entityID string) bool {
 	return strings.HasPrefix(entityID, fiware.RoadIDPrefix) ||
 		strings.HasPrefix(entityID, fiware.RoadSegmentIDPrefix) ||
-		strings.HasPrefix(entityID, diwise.RoadSurfaceObservedIDPrefix)
+		strings.HasPrefix(entityID, diwise.RoadSurfaceObservedIDPrefix) ||
+		strings.HasPrefix(entityID, AlertIDPrefix)
 }
 
 func (cs contextSource) GetProvidedTypeFromID(entityID string) (string, error) {
@@ -265,41 +1014,103 @@ func (cs contextSource) GetProvidedTypeFromID(entityID string) (string, error) {
 }
 
 func (cs contextSource) ProvidesType(typeName string) bool {
-	return typeName == "Road" || typeName == "RoadSegment" || typeName == "RoadSurfaceObserved" || typeName == "TrafficFlowObserved"
+	return findProvidedType(typeName) != nil
 }
 
 func (cs contextSource) RetrieveEntity(entityID string, request ngsi.Request) (ngsi.Entity, error) {
 	return nil, nil
 }
 
+//surfaceTypeDistribution is a property that holds the probabilities of several surface types
+type surfaceTypeDistribution struct {
+	ngsitypes.Property
+	Value      map[string]float64                  `json:"value"`
+	ObservedBy *ngsitypes.SingleObjectRelationship `json:"observedBy,omitempty"`
+}
+
+func newSurfaceTypeDistribution(distribution map[string]float64) *surfaceTypeDistribution {
+	if len(distribution) == 0 {
+		return nil
+	}
+
+	return &surfaceTypeDistribution{
+		Property: ngsitypes.Property{Type: "Property"},
+		Value:    distribution,
+	}
+}
+
+//roadSurfaceTypeUpdate is a surfaceType property that may tell who observed the surface type
+type roadSurfaceTypeUpdate struct {
+	fiware.RoadSurfaceType
+	ObservedBy *ngsitypes.SingleObjectRelationship `json:"observedBy"`
+}
+
+//roadSegmentSurfaceUpdate holds the attributes of a RoadSegment that can be updated
+type roadSegmentSurfaceUpdate struct {
+	SurfaceType             *roadSurfaceTypeUpdate    `json:"surfaceType"`
+	SurfaceTypeDistribution *surfaceTypeDistribution  `json:"surfaceTypeDistribution"`
+	MaximumAllowedSpeed     *ngsitypes.NumberProperty `json:"maximumAllowedSpeed"`
+}
+
+//client returns the client that submitted the update, as given by the observedBy relationship
+//of either of the updated properties
+func (u *roadSegmentSurfaceUpdate) client() string {
+	if u.SurfaceType != nil && u.SurfaceType.ObservedBy != nil {
+		return u.SurfaceType.ObservedBy.Object
+	}
+
+	if u.SurfaceTypeDistribution != nil && u.SurfaceTypeDistribution.ObservedBy != nil {
+		return u.SurfaceTypeDistribution.ObservedBy.Object
+	}
+
+	return ""
+}
+
 func (cs contextSource) UpdateEntityAttributes(entityID string, req ngsi.Request) error {
 	if !strings.Contains(entityID, ":RoadSegment:") {
 		return errors.New("UpdateEntityAttributes is only supported for RoadSegments")
 	}
 
-	updateSource := &fiware.RoadSegment{}
+	updateSource := &roadSegmentSurfaceUpdate{}
 	err := req.DecodeBodyInto(updateSource)
 	if err != nil {
 		log.Errorln("Failed to decode PATCH body in UpdateEntityAttributes: " + err.Error())
 		return err
 	}
 
-	if updateSource.SurfaceType == nil {
-		return errors.New("UpdateEntityAttributes only supports the surfaceType property which MUST be non null")
+	if updateSource.SurfaceType == nil && updateSource.SurfaceTypeDistribution == nil && updateSource.MaximumAllowedSpeed == nil {
+		return errors.New("UpdateEntityAttributes only supports the surfaceType, surfaceTypeDistribution and maximumAllowedSpeed properties and at least one of them MUST be non null")
 	}
 
-	segment, err := cs.db.GetRoadSegmentByID(entityID[24:])
-	if err != nil {
-		return err
+	segmentID := entityID[24:]
+
+	// Every attribute is validated before any of them is applied, so that an invalid attribute
+	// does not leave the segment partially updated
+	if updateSource.MaximumAllowedSpeed != nil && updateSource.MaximumAllowedSpeed.Value <= 0 {
+		return fmt.Errorf("the speed limit %g of road segment %s must be positive", updateSource.MaximumAllowedSpeed.Value, segmentID)
 	}
 
-	//Enqueue a command to a replica of this service, to persist the road surface update
-	command := &commands.UpdateRoadSegmentSurface{
-		ID:          segment.ID(),
-		SurfaceType: strings.ToLower(updateSource.SurfaceType.Value),
-		Probability: updateSource.SurfaceType.Probability,
-		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+	var command *commands.UpdateRoadSegmentSurface
+	if updateSource.SurfaceType != nil || updateSource.SurfaceTypeDistribution != nil {
+		command, err = cs.newUpdateRoadSegmentSurfaceCommand(segmentID, updateSource)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The speed limit is not held in memory, so it is stored right away instead of by a replica
+	if updateSource.MaximumAllowedSpeed != nil {
+		err = cs.db.SetRoadSegmentSpeedLimit(segmentID, updateSource.MaximumAllowedSpeed.Value)
+		if err != nil {
+			return err
+		}
 	}
+
+	if command == nil {
+		return nil
+	}
+
+	//Enqueue a command to a replica of this service, to persist the road surface update
 	err = cs.msg.NoteToSelf(command)
 	if err != nil {
 		log.Error(err.Error())
@@ -308,3 +1119,51 @@ func (cs contextSource) UpdateEntityAttributes(entityID string, req ngsi.Request
 
 	return nil
 }
+
+//newUpdateRoadSegmentSurfaceCommand validates the surface type and distribution of an update and
+//creates the command that persists them
+func (cs contextSource) newUpdateRoadSegmentSurfaceCommand(segmentID string, updateSource *roadSegmentSurfaceUpdate) (*commands.UpdateRoadSegmentSurface, error) {
+	distribution := map[string]float64{}
+	if updateSource.SurfaceTypeDistribution != nil {
+		for surfaceType, probability := range updateSource.SurfaceTypeDistribution.Value {
+			distribution[surface.Normalize(surfaceType)] = probability
+		}
+
+		err := cs.db.SurfaceVocabulary().ValidateDistribution(distribution)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The top-1 surfaceType is picked from the distribution, unless it is explicitly provided
+	surfaceType, probability := surface.MostProbable(distribution)
+	if updateSource.SurfaceType != nil {
+		surfaceType = surface.Normalize(updateSource.SurfaceType.Value)
+		probability = updateSource.SurfaceType.Probability
+	}
+
+	err := cs.db.SurfaceVocabulary().Validate(surfaceType, probability)
+	if err != nil {
+		return nil, err
+	}
+
+	segment, err := cs.db.GetRoadSegmentByID(segmentID)
+	if err != nil {
+		return nil, err
+	}
+
+	command := &commands.UpdateRoadSegmentSurface{
+		ID:          segment.ID(),
+		SurfaceType: surfaceType,
+		Probability: probability,
+		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+		Source:      database.SourceManual,
+		Client:      updateSource.client(),
+	}
+
+	if len(distribution) > 0 {
+		command.Distribution = distribution
+	}
+
+	return command, nil
+}
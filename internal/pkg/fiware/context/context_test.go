@@ -0,0 +1,574 @@
+package context_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diwise/api-transportation/internal/pkg/database"
+	fiwarecontext "github.com/diwise/api-transportation/internal/pkg/fiware/context"
+	"github.com/diwise/api-transportation/internal/pkg/fusion"
+	"github.com/diwise/api-transportation/internal/pkg/messaging/events"
+	"github.com/diwise/api-transportation/internal/pkg/persistence"
+	"github.com/diwise/messaging-golang/pkg/messaging"
+	"github.com/diwise/ngsi-ld-golang/pkg/datamodels/diwise"
+	"github.com/diwise/ngsi-ld-golang/pkg/datamodels/fiware"
+	ngsi "github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld"
+	ngsitypes "github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/types"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/matryer/is"
+)
+
+func TestMain(m *testing.M) {
+	log.SetFormatter(&log.JSONFormatter{})
+	os.Exit(m.Run())
+}
+
+const seedData string = "21277:153930;21277:153930;62.389109;17.310863;62.389084;17.310852\n"
+
+const threeSegments string = "21277:3;21277:3;62.389109;17.310863;62.389084;17.310852\n" +
+	"21277:1;21277:1;62.389084;17.310852;62.389073;17.310854\n" +
+	"21277:2;21277:2;62.389073;17.310854;62.389059;17.310878\n"
+
+func TestThatAttrsProjectsRoadSegments(t *testing.T) {
+	is := is.New(t)
+
+	entities := getEntities(t, "/ngsi-ld/v1/entities?type=RoadSegment&attrs=location,surfaceType&georel=near&maxDistance==100&geometry=Point&coordinates=[17.310863,62.389109]")
+	is.Equal(len(entities), 1) // expected a single road segment
+
+	_, hasName := entities[0]["name"]
+	is.True(!hasName) // name should have been projected away
+
+	_, hasLocation := entities[0]["location"]
+	is.True(hasLocation) // location should have been kept
+	is.Equal(entities[0]["id"], "urn:ngsi-ld:RoadSegment:21277:153930")
+}
+
+func TestThatKeyValuesSimplifiesRoadSegments(t *testing.T) {
+	is := is.New(t)
+
+	entities := getEntities(t, "/ngsi-ld/v1/entities?type=RoadSegment&options=keyValues&georel=near&maxDistance==100&geometry=Point&coordinates=[17.310863,62.389109]")
+	is.Equal(len(entities), 1) // expected a single road segment
+
+	is.Equal(entities[0]["name"], "21277:153930")
+	is.Equal(entities[0]["refRoad"], "urn:ngsi-ld:Road:21277:153930")
+}
+
+func TestThatRoadSegmentsArePagedInAStableOrder(t *testing.T) {
+	is := is.New(t)
+
+	ctxSrc := newContextSourceWithSeed(t, threeSegments)
+
+	path := "/ngsi-ld/v1/entities?type=RoadSegment&limit=1&offset=%d&georel=near&maxDistance==100&geometry=Point&coordinates=[17.310863,62.389109]"
+	expectations := []string{"21277:1", "21277:2", "21277:3"}
+
+	for offset, expectedID := range expectations {
+		req, _ := http.NewRequest("GET", fmt.Sprintf(path, offset), nil)
+		req, resultCount := fiwarecontext.NewRequestWithResultCount(req)
+
+		entities := getEntitiesFromSource(t, ctxSrc, req)
+		is.Equal(len(entities), 1)                                         // expected one segment per page
+		is.Equal(entities[0]["id"], "urn:ngsi-ld:RoadSegment:"+expectedID) // segments returned in the wrong order
+
+		total, known := resultCount.Total()
+		is.True(known)             // total number of segments was never reported
+		is.Equal(total, uint64(3)) // unexpected total number of segments
+	}
+}
+
+func TestThatRoadSegmentsCanBeOrderedByDateModified(t *testing.T) {
+	is := is.New(t)
+
+	db := newDatastore(t, threeSegments)
+	db.RoadSegmentSurfaceUpdated("21277:1", "snow", 0.5, time.Now().Add(-time.Hour))
+	db.RoadSegmentSurfaceUpdated("21277:3", "snow", 0.5, time.Now())
+
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities?type=RoadSegment&orderBy=-dateModified&georel=near&maxDistance==100&geometry=Point&coordinates=[17.310863,62.389109]", nil)
+	entities := getEntitiesFromSource(t, fiwarecontext.CreateSource(db, nil, nil), req)
+	is.Equal(len(entities), 3) // expected three segments
+
+	for i, expectedID := range []string{"21277:3", "21277:1", "21277:2"} {
+		is.Equal(entities[i]["id"], "urn:ngsi-ld:RoadSegment:"+expectedID) // segments returned in the wrong order
+	}
+}
+
+func TestThatRoadsAreFilteredByTheirProperties(t *testing.T) {
+	is := is.New(t)
+
+	near := "georel=near&maxDistance==100&geometry=Point&coordinates=[17.310863,62.389109]"
+
+	entities := getEntities(t, "/ngsi-ld/v1/entities?type=Road&q=name==%2221277:153930%22&"+near)
+	is.Equal(len(entities), 1) // expected the road with the requested name
+
+	entities = getEntities(t, "/ngsi-ld/v1/entities?type=Road,RoadSegment&q=congestionLevel==%22congested%22&"+near)
+	is.Equal(len(entities), 0) // roads have no congestion level and should not match the filter
+}
+
+func TestThatRoadSurfacesObservedCanBeQueriedByLocationTimeAndProperties(t *testing.T) {
+	is := is.New(t)
+
+	db := newDatastore(t, seedData)
+	db.CreateRoadSurfaceObserved(diwise.NewRoadSurfaceObserved("snowy", "snow", 0.9, 62.389109, 17.310863))
+	db.CreateRoadSurfaceObserved(diwise.NewRoadSurfaceObserved("uncertain", "snow", 0.3, 62.389109, 17.310863))
+	db.CreateRoadSurfaceObserved(diwise.NewRoadSurfaceObserved("faraway", "snow", 0.9, 62.1, 16.0))
+	ctxSrc := fiwarecontext.CreateSource(db, nil, nil)
+
+	near := "georel=near&maxDistance==100&geometry=Point&coordinates=[17.310863,62.389109]"
+
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities?type=RoadSurfaceObserved&q=surfaceType==\"snow\"%3BsurfaceType.probability>=0.5&"+near, nil)
+	entities := getEntitiesFromSource(t, ctxSrc, req)
+	is.Equal(len(entities), 1) // expected a single matching observation
+	is.Equal(entities[0]["id"], diwise.RoadSurfaceObservedIDPrefix+"snowy")
+
+	req, _ = http.NewRequest("GET", "/ngsi-ld/v1/entities?type=RoadSurfaceObserved&timerel=before&timeAt=2021-01-01T00:00:00Z&"+near, nil)
+	entities = getEntitiesFromSource(t, ctxSrc, req)
+	is.Equal(len(entities), 0) // expected no observations before the given time
+}
+
+func TestThatTemporalQueriesCanTargetDateObservedOrDateCreated(t *testing.T) {
+	is := is.New(t)
+
+	buffered := diwise.NewRoadSurfaceObserved("buffered", "snow", 0.9, 62.389109, 17.310863)
+	buffered.DateObserved = ngsitypes.CreateDateTimeProperty("2020-12-24T15:00:00Z")
+
+	db := newDatastore(t, seedData)
+	_, err := db.CreateRoadSurfaceObserved(buffered)
+	is.NoErr(err)
+	ctxSrc := fiwarecontext.CreateSource(db, nil, nil)
+
+	path := "/ngsi-ld/v1/entities?type=RoadSurfaceObserved&timerel=before&timeAt=2021-01-01T00:00:00Z"
+
+	req, _ := http.NewRequest("GET", path, nil)
+	entities := getEntitiesFromSource(t, ctxSrc, req)
+	is.Equal(len(entities), 1) // expected the observation to have been observed before the given time
+
+	dateObserved := entities[0]["dateObserved"].(map[string]interface{})["value"].(map[string]interface{})
+	is.Equal(dateObserved["@value"], "2020-12-24T15:00:00Z") // dateObserved should be taken from the observation
+	_, hasDateCreated := entities[0]["dateCreated"]
+	is.True(hasDateCreated) // expected the time of ingestion to be exposed as dateCreated
+
+	req, _ = http.NewRequest("GET", path+"&timeproperty=dateCreated", nil)
+	entities = getEntitiesFromSource(t, ctxSrc, req)
+	is.Equal(len(entities), 0) // expected no observations to have been created before the given time
+}
+
+func TestThatStaleSurfaceConditionsAreReportedAsUnknown(t *testing.T) {
+	is := is.New(t)
+
+	db := newDatastore(t, seedData)
+	db.RoadSegmentSurfaceUpdated("21277:153930", "asphalt", 0.9, time.Now().Add(-48*time.Hour))
+	db.RoadSegmentSurfaceUpdated("21277:153930", "snow", 0.9, time.Now().Add(-24*time.Hour))
+
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities?type=RoadSegment&georel=near&maxDistance==100&geometry=Point&coordinates=[17.310863,62.389109]", nil)
+	entities := getEntitiesFromSource(t, fiwarecontext.CreateSource(db, nil, nil), req)
+	is.Equal(len(entities), 1) // expected a single road segment
+
+	surfaceType := entities[0]["surfaceType"].(map[string]interface{})
+	is.Equal(surfaceType["value"], "unknown") // a day old snow observation should be stale
+	is.Equal(surfaceType["state"], "stale")
+	is.Equal(surfaceType["effectiveProbability"], 0.0)
+
+	material := entities[0]["surfaceMaterial"].(map[string]interface{})
+	is.Equal(material["value"], "asphalt") // materials should never become stale
+	is.Equal(material["effectiveProbability"], 0.9)
+}
+
+func TestThatRoadSegmentsExposeTheirSurfaceTypeDistribution(t *testing.T) {
+	is := is.New(t)
+
+	db := newDatastore(t, seedData)
+	distribution := map[string]float64{"snow": 0.55, "ice": 0.35, "tarmac": 0.1}
+	db.RoadSegmentSurfacePredictionUpdated("21277:153930", database.NewSurfacePredictionFromDistribution(distribution, time.Now().UTC()))
+
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities?type=RoadSegment&georel=near&maxDistance==100&geometry=Point&coordinates=[17.310863,62.389109]", nil)
+	entities := getEntitiesFromSource(t, fiwarecontext.CreateSource(db, nil, nil), req)
+	is.Equal(len(entities), 1) // expected a single road segment
+
+	surfaceType := entities[0]["surfaceType"].(map[string]interface{})
+	is.Equal(surfaceType["value"], "snow") // the most probable surface type should be reported as the surfaceType
+
+	surfaceTypeDistribution := entities[0]["surfaceTypeDistribution"].(map[string]interface{})
+	is.Equal(surfaceTypeDistribution["type"], "Property")
+	is.Equal(surfaceTypeDistribution["value"], map[string]interface{}{"snow": 0.55, "ice": 0.35, "tarmac": 0.1})
+}
+
+func TestThatRoadSegmentsExposeAndCanBeFilteredOnProvenance(t *testing.T) {
+	is := is.New(t)
+
+	db := newDatastore(t, threeSegments)
+
+	fromModel := database.NewSurfacePrediction("snow", 0.8, time.Now().UTC())
+	fromModel.Provenance = database.Provenance{Source: database.SourceModel, Model: "roadcam", ModelVersion: "1.2", Client: "urn:ngsi-ld:Device:cam-17"}
+	db.RoadSegmentSurfacePredictionUpdated("21277:1", fromModel)
+
+	fromPlow := database.NewSurfacePrediction("ice", 0.9, time.Now().UTC())
+	fromPlow.Provenance = database.Provenance{Source: database.SourceManual, Client: "urn:ngsi-ld:Device:plow-4"}
+	db.RoadSegmentSurfacePredictionUpdated("21277:2", fromPlow)
+
+	ctxSrc := fiwarecontext.CreateSource(db, nil, nil)
+	nearby := "/ngsi-ld/v1/entities?type=RoadSegment&georel=near&maxDistance==100&geometry=Point&coordinates=[17.310863,62.389109]"
+
+	req, _ := http.NewRequest("GET", nearby+"&q=surfaceType.source==%22model%22", nil)
+	entities := getEntitiesFromSource(t, ctxSrc, req)
+	is.Equal(len(entities), 1) // expected only the segment with a predicted surface type
+	is.Equal(entities[0]["id"], "urn:ngsi-ld:RoadSegment:21277:1")
+
+	surfaceType := entities[0]["surfaceType"].(map[string]interface{})
+	is.Equal(surfaceType["datasetId"], "urn:ngsi-ld:Dataset:model:roadcam:1.2")
+	is.Equal(surfaceType["observedBy"].(map[string]interface{})["object"], "urn:ngsi-ld:Device:cam-17")
+
+	req, _ = http.NewRequest("GET", nearby+"&q=surfaceType.observedBy==%22urn:ngsi-ld:Device:plow-4%22", nil)
+	entities = getEntitiesFromSource(t, ctxSrc, req)
+	is.Equal(len(entities), 1) // expected only the segment that was updated by the plow
+	is.Equal(entities[0]["id"], "urn:ngsi-ld:RoadSegment:21277:2")
+}
+
+func TestThatClientsCanRequestASpecificDatasetOrAllOfThem(t *testing.T) {
+	is := is.New(t)
+
+	db := newDatastore(t, seedData)
+
+	camera := database.NewSurfacePrediction("snow", 0.9, time.Now().UTC().Add(-time.Minute))
+	camera.Provenance = database.Provenance{Source: database.SourceModel, Model: "roadcam"}
+	db.RoadSegmentSurfacePredictionUpdated("21277:153930", camera)
+
+	friction := database.NewSurfacePrediction("ice", 0.6, time.Now().UTC())
+	friction.Provenance = database.Provenance{Source: database.SourceModel, Model: "friction"}
+	db.RoadSegmentSurfacePredictionUpdated("21277:153930", friction)
+
+	ctxSrc := fiwarecontext.CreateSource(db, nil, nil)
+	nearby := "/ngsi-ld/v1/entities?type=RoadSegment&georel=near&maxDistance==100&geometry=Point&coordinates=[17.310863,62.389109]"
+
+	req, _ := http.NewRequest("GET", nearby, nil)
+	entities := getEntitiesFromSource(t, ctxSrc, req)
+	surfaceType := entities[0]["surfaceType"].(map[string]interface{})
+	is.Equal(surfaceType["value"], "ice") // the most recent prediction should be the default
+
+	req, _ = http.NewRequest("GET", nearby+"&datasetId=urn:ngsi-ld:Dataset:model:roadcam", nil)
+	entities = getEntitiesFromSource(t, ctxSrc, req)
+	surfaceType = entities[0]["surfaceType"].(map[string]interface{})
+	is.Equal(surfaceType["value"], "snow") // expected the prediction of the requested dataset
+	is.Equal(surfaceType["datasetId"], "urn:ngsi-ld:Dataset:model:roadcam")
+
+	req, _ = http.NewRequest("GET", nearby+"&datasetId=@all", nil)
+	entities = getEntitiesFromSource(t, ctxSrc, req)
+	instances := entities[0]["surfaceType"].([]interface{})
+	is.Equal(len(instances), 2) // expected an instance of surfaceType per dataset
+
+	req, _ = http.NewRequest("GET", nearby+"&datasetId=@all&options=keyValues", nil)
+	entities = getEntitiesFromSource(t, ctxSrc, req)
+	is.Equal(entities[0]["surfaceType"], []interface{}{"ice", "snow"}) // instances are ordered by dataset id
+}
+
+func TestThatAlertsAreServedAsSmartDataModelsAlerts(t *testing.T) {
+	is := is.New(t)
+
+	db := newDatastore(t, seedData)
+	for _, id := range []string{"closed", "active"} {
+		_, err := db.CreateAlert(persistence.Alert{
+			AlertID:     id,
+			SegmentID:   "21277:153930",
+			SubCategory: "hazardOnRoad",
+			Severity:    "high",
+			DateIssued:  time.Now().UTC(),
+			ValidFrom:   time.Now().UTC(),
+		})
+		is.NoErr(err)
+	}
+	_, _, err := db.CloseAlert("closed", time.Now().UTC())
+	is.NoErr(err)
+
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities?type=Alert&q=status==%22active%22", nil)
+	entities := getEntitiesFromSource(t, fiwarecontext.CreateSource(db, nil, nil), req)
+	is.Equal(len(entities), 1) // expected only the active alert
+	is.Equal(entities[0]["id"], "urn:ngsi-ld:Alert:active")
+
+	severity := entities[0]["severity"].(map[string]interface{})
+	is.Equal(severity["value"], "high")
+
+	location := entities[0]["location"].(map[string]interface{})
+	is.Equal(location["value"].(map[string]interface{})["type"], "LineString") // the location should be the geometry of the segment
+}
+
+func TestThatTrafficFlowsObservedKeepTheFullSmartDataModelsAttributeSet(t *testing.T) {
+	is := is.New(t)
+
+	ctxSrc := fiwarecontext.CreateSource(newDatastore(t, ""), nil, nil)
+
+	tfo := `{"type":"TrafficFlowObserved","dateObserved":{"type":"Property","value":"2016-12-07T11:10:00Z"},` +
+		`"laneID":{"type":"Property","value":1},"intensity":{"type":"Property","value":120},` +
+		`"occupancy":{"type":"Property","value":0.45},"congested":{"type":"Property","value":true},` +
+		`"averageHeadwayTime":{"type":"Property","value":1.8},"averageGapDistance":{"type":"Property","value":12.5},` +
+		`"averageVehicleLength":{"type":"Property","value":5.2},"vehicleType":{"type":"Property","value":"car"},` +
+		`"vehicleSubType":{"type":"Property","value":"electric"},"laneDirection":{"type":"Property","value":"forward"},` +
+		`"reversedLane":{"type":"Property","value":false},"refDevice":{"type":"Relationship","object":"urn:ngsi-ld:Device:counter-1"}}`
+	is.Equal(createEntity(ctxSrc, tfo), http.StatusCreated)
+
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities?type=TrafficFlowObserved&q=congested==true%3BlaneDirection==%22forward%22", nil)
+	entities := getEntitiesFromSource(t, ctxSrc, req)
+	is.Equal(len(entities), 1) // expected the congested observation
+
+	expectations := map[string]interface{}{
+		"occupancy":            0.45,
+		"congested":            true,
+		"averageHeadwayTime":   1.8,
+		"averageGapDistance":   12.5,
+		"averageVehicleLength": 5.2,
+		"vehicleType":          "car",
+		"vehicleSubType":       "electric",
+		"laneDirection":        "forward",
+		"reversedLane":         false,
+	}
+	for attribute, expected := range expectations {
+		property, ok := entities[0][attribute].(map[string]interface{})
+		is.True(ok) // every attribute should be returned
+		is.Equal(property["value"], expected)
+	}
+	is.Equal(entities[0]["refDevice"].(map[string]interface{})["object"], "urn:ngsi-ld:Device:counter-1")
+
+	req, _ = http.NewRequest("GET", "/ngsi-ld/v1/entities?type=TrafficFlowObserved&q=reversedLane==true", nil)
+	is.Equal(len(getEntitiesFromSource(t, ctxSrc, req)), 0) // the lane is not reversed
+
+	invalid := strings.Replace(tfo, `"value":0.45`, `"value":1.45`, 1)
+	is.Equal(createEntity(ctxSrc, invalid), http.StatusBadRequest) // occupancy is a ratio
+}
+
+func TestThatTrafficFlowsObservedRoundTripTheirSegmentAndInterval(t *testing.T) {
+	is := is.New(t)
+
+	ctxSrc := fiwarecontext.CreateSource(newDatastore(t, seedData), nil, nil)
+
+	tfo := `{"type":"TrafficFlowObserved","dateObserved":{"type":"Property","value":"2016-12-07T11:10:00Z"},` +
+		`"dateObservedFrom":{"type":"Property","value":{"@type":"DateTime","@value":"2016-12-07T11:05:00Z"}},` +
+		`"dateObservedTo":{"type":"Property","value":{"@type":"DateTime","@value":"2016-12-07T11:10:00Z"}},` +
+		`"location":{"type":"GeoProperty","value":{"type":"Point","coordinates":[17.310863,62.389109]}},` +
+		`"laneID":{"type":"Property","value":1},"intensity":{"type":"Property","value":120},` +
+		`"refRoadSegment":{"type":"Relationship","object":"urn:ngsi-ld:RoadSegment:21277:153930"}}`
+	is.Equal(createEntity(ctxSrc, tfo), http.StatusCreated)
+
+	queries := []string{
+		"q=refRoadSegment==%22urn:ngsi-ld:RoadSegment:21277:153930%22",
+		"georel=near&maxDistance==100&geometry=Point&coordinates=[17.3108,62.3891]",
+		"georel=within&geometry=Polygon&coordinates=[[17.30,62.39],[17.32,62.38],[17.32,62.38]]",
+		"timerel=after&timeAt=2016-12-07T11:00:00Z&timeproperty=dateObservedFrom",
+	}
+
+	for _, q := range queries {
+		req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities?type=TrafficFlowObserved&"+q, nil)
+		entities := getEntitiesFromSource(t, ctxSrc, req)
+		is.Equal(len(entities), 1) // expected the observation to match the query
+
+		refRoadSegment := entities[0]["refRoadSegment"].(map[string]interface{})
+		is.Equal(refRoadSegment["object"], "urn:ngsi-ld:RoadSegment:21277:153930")
+
+		dateObservedFrom := entities[0]["dateObservedFrom"].(map[string]interface{})["value"].(map[string]interface{})
+		is.Equal(dateObservedFrom["@value"], "2016-12-07T11:05:00Z")
+
+		is.True(entities[0]["dateCreated"] != nil) // the time the observation was stored should be returned
+	}
+
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities?type=TrafficFlowObserved&q=refRoadSegment==%22urn:ngsi-ld:RoadSegment:other%22", nil)
+	is.Equal(len(getEntitiesFromSource(t, ctxSrc, req)), 0) // the observation belongs to another segment
+}
+
+func TestThatRoadSegmentsGetACongestionLevelFromTheirTrafficFlows(t *testing.T) {
+	is := is.New(t)
+
+	msg := &messagingMock{}
+	ctxSrc := fiwarecontext.CreateSource(newDatastore(t, seedData), msg, nil)
+
+	is.Equal(updateEntityAttributes(ctxSrc, "urn:ngsi-ld:RoadSegment:21277:153930", `{"maximumAllowedSpeed":{"type":"Property","value":50}}`), http.StatusNoContent)
+
+	trafficFlow := func(observedAt string, intensity int, speed float64) string {
+		return fmt.Sprintf(`{"type":"TrafficFlowObserved","dateObserved":{"type":"Property","value":"%s"},`+
+			`"laneID":{"type":"Property","value":1},"intensity":{"type":"Property","value":%d},`+
+			`"averageVehicleSpeed":{"type":"Property","value":%g},`+
+			`"refRoadSegment":{"type":"Relationship","object":"urn:ngsi-ld:RoadSegment:21277:153930"}}`, observedAt, intensity, speed)
+	}
+
+	is.Equal(createEntity(ctxSrc, trafficFlow("2016-12-07T11:10:00Z", 20, 45)), http.StatusCreated)
+	is.Equal(createEntity(ctxSrc, trafficFlow("2016-12-07T11:15:00Z", 20, 10)), http.StatusCreated)
+	is.Equal(createEntity(ctxSrc, trafficFlow("2016-12-07T11:20:00Z", 20, 5)), http.StatusCreated)
+
+	levels := []string{}
+	updates := msg.eventsOnTopic((&events.RoadSegmentCongestionUpdated{}).TopicName())
+	for _, m := range updates {
+		levels = append(levels, m.(*events.RoadSegmentCongestionUpdated).Level)
+	}
+	is.Equal(strings.Join(levels, ","), "freeFlow,dense,congested") // expected an event for every change of level
+	is.Equal(updates[2].(*events.RoadSegmentCongestionUpdated).PreviousLevel, "dense")
+
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities?type=RoadSegment&georel=near&maxDistance==100&geometry=Point&coordinates=[17.310863,62.389109]&q=congestionLevel==%22congested%22", nil)
+	entities := getEntitiesFromSource(t, ctxSrc, req)
+	is.Equal(len(entities), 1) // expected the congested segment
+
+	congestionLevel := entities[0]["congestionLevel"].(map[string]interface{})
+	is.Equal(congestionLevel["value"], "congested")
+	is.Equal(congestionLevel["speedRatio"], 0.4) // (45*20 + 10*20 + 5*20) / 60 = 20 km/h of 50 km/h
+	is.Equal(entities[0]["maximumAllowedSpeed"].(map[string]interface{})["value"], 50.0)
+}
+
+func TestThatInvalidAttributesLeaveTheRoadSegmentUnchanged(t *testing.T) {
+	is := is.New(t)
+
+	ctxSrc := fiwarecontext.CreateSource(newDatastore(t, seedData), &messagingMock{}, nil)
+
+	body := `{"maximumAllowedSpeed":{"type":"Property","value":50},"surfaceType":{"type":"Property","value":"lava","probability":0.9}}`
+	is.True(updateEntityAttributes(ctxSrc, "urn:ngsi-ld:RoadSegment:21277:153930", body) != http.StatusNoContent) // lava is not a surface type
+
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities?type=RoadSegment&id=urn:ngsi-ld:RoadSegment:21277:153930", nil)
+	entities := getEntitiesFromSource(t, ctxSrc, req)
+	is.Equal(len(entities), 1)
+	_, ok := entities[0]["maximumAllowedSpeed"]
+	is.True(!ok) // the speed limit should not be changed when another attribute is invalid
+}
+
+func TestThatCreatedObservationsArePublishedAsEvents(t *testing.T) {
+	is := is.New(t)
+
+	msg := &messagingMock{}
+	ctxSrc := fiwarecontext.CreateSource(newDatastore(t, seedData), msg, nil)
+
+	tfo := `{"type":"TrafficFlowObserved","dateObserved":{"type":"Property","value":"2016-12-07T11:10:00Z"},` +
+		`"laneID":{"type":"Property","value":2},"intensity":{"type":"Property","value":17},` +
+		`"refRoadSegment":{"type":"Relationship","object":"urn:ngsi-ld:RoadSegment:21277:153930"},` +
+		`"refDevice":{"type":"Relationship","object":"urn:ngsi-ld:Device:counter-1"}}`
+	is.Equal(createEntity(ctxSrc, tfo), http.StatusCreated)
+	is.Equal(createEntity(ctxSrc, tfo), http.StatusCreated)
+
+	created := msg.eventsOnTopic((&events.TrafficFlowObservedCreated{}).TopicName())
+	is.Equal(len(created), 1) // the retried observation should not be published again
+
+	tfoCreated := created[0].(*events.TrafficFlowObservedCreated)
+	is.Equal(tfoCreated.RoadSegment, "urn:ngsi-ld:RoadSegment:21277:153930")
+	is.Equal(tfoCreated.RefDevice, "urn:ngsi-ld:Device:counter-1")
+	is.Equal(tfoCreated.Intensity, 17)
+	is.Equal(tfoCreated.DateObserved, "2016-12-07T11:10:00Z")
+
+	rso, _ := json.Marshal(diwise.NewRoadSurfaceObserved("rso", "snow", 0.75, 62.389109, 17.310863))
+	is.Equal(createEntity(ctxSrc, string(rso)), http.StatusCreated)
+
+	created = msg.eventsOnTopic((&events.RoadSurfaceObservedCreated{}).TopicName())
+	is.Equal(len(created), 1)
+	is.Equal(created[0].(*events.RoadSurfaceObservedCreated).SurfaceType, "snow")
+	is.Equal(created[0].(*events.RoadSurfaceObservedCreated).Latitude, 62.389109)
+}
+
+func TestThatFailingToFuseAStoredObservationIsNotReportedToTheClient(t *testing.T) {
+	is := is.New(t)
+
+	db := newDatastore(t, seedData)
+	msg := &messagingMock{}
+	strategy, _ := fusion.NewStrategy("weighted")
+	fuser := fusion.NewFuser(db, msg, fusion.Config{Window: 30 * time.Minute, MaxDistance: 25, Strategy: strategy})
+	ctxSrc := fiwarecontext.CreateSource(db, msg, fuser)
+
+	rso := diwise.NewRoadSurfaceObserved("rso", "snow", 0.75, 62.389109, 17.310863)
+	segment := ngsitypes.NewMultiObjectRelationship([]string{fiware.RoadSegmentIDPrefix + "unknown"})
+	rso.RefRoadSegment = &segment
+	body, _ := json.Marshal(rso)
+	is.Equal(createEntity(ctxSrc, string(body)), http.StatusCreated) // the observation was stored although the segment is unknown
+
+	rsos, _ := db.GetRoadSurfacesObserved()
+	is.Equal(len(rsos), 1)
+}
+
+func newContextSource(t *testing.T) ngsi.ContextSource {
+	return newContextSourceWithSeed(t, seedData)
+}
+
+func newContextSourceWithSeed(t *testing.T, seed string) ngsi.ContextSource {
+	return fiwarecontext.CreateSource(newDatastore(t, seed), nil, nil)
+}
+
+func newDatastore(t *testing.T, seed string) database.Datastore {
+	db, err := database.NewDatabaseConnection(database.NewSQLiteConnector(), strings.NewReader(seed))
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+
+	return db
+}
+
+// getEntities runs a query through the ngsi-ld handler and returns the decoded response
+func getEntities(t *testing.T, path string) []map[string]interface{} {
+	req, _ := http.NewRequest("GET", path, nil)
+	return getEntitiesFromSource(t, newContextSource(t), req)
+}
+
+// createEntity posts an entity through the ngsi-ld handler and returns the response code
+func createEntity(ctxSrc ngsi.ContextSource, body string) int {
+	registry := ngsi.NewContextRegistry()
+	registry.Register(ctxSrc)
+
+	req, _ := http.NewRequest("POST", "/ngsi-ld/v1/entities", strings.NewReader(body))
+	w := httptest.NewRecorder()
+
+	ngsi.NewCreateEntityHandler(registry).ServeHTTP(w, req)
+
+	return w.Code
+}
+
+// updateEntityAttributes patches the attributes of an entity through the ngsi-ld handler and
+// returns the response code
+func updateEntityAttributes(ctxSrc ngsi.ContextSource, entityID, body string) int {
+	registry := ngsi.NewContextRegistry()
+	registry.Register(ctxSrc)
+
+	req, _ := http.NewRequest("PATCH", "/ngsi-ld/v1/entities/"+entityID+"/attrs/", strings.NewReader(body))
+	w := httptest.NewRecorder()
+
+	ngsi.NewUpdateEntityAttributesHandler(registry).ServeHTTP(w, req)
+
+	return w.Code
+}
+
+func getEntitiesFromSource(t *testing.T, ctxSrc ngsi.ContextSource, req *http.Request) []map[string]interface{} {
+	registry := ngsi.NewContextRegistry()
+	registry.Register(ctxSrc)
+
+	w := httptest.NewRecorder()
+
+	ngsi.NewQueryEntitiesHandler(registry).ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected response code %d: %s", w.Code, w.Body.String())
+	}
+
+	entities := []map[string]interface{}{}
+	err := json.Unmarshal(w.Body.Bytes(), &entities)
+	if err != nil {
+		t.Fatalf("failed to decode response: %s", err.Error())
+	}
+
+	return entities
+}
+
+type messagingMock struct {
+	events []messaging.TopicMessage
+}
+
+func (m *messagingMock) PublishOnTopic(message messaging.TopicMessage) error {
+	m.events = append(m.events, message)
+	return nil
+}
+
+func (m *messagingMock) eventsOnTopic(topic string) []messaging.TopicMessage {
+	published := []messaging.TopicMessage{}
+	for _, e := range m.events {
+		if e.TopicName() == topic {
+			published = append(published, e)
+		}
+	}
+	return published
+}
+
+func (m *messagingMock) NoteToSelf(message messaging.CommandMessage) error {
+	return nil
+}
@@ -0,0 +1,258 @@
+package context
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/diwise/api-transportation/internal/pkg/database"
+	"github.com/diwise/ngsi-ld-golang/pkg/datamodels/fiware"
+	ngsi "github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld"
+)
+
+//idFilter limits query results to entities with one of a list of identities (id=) and/or
+//identities that match a regular expression (idPattern=)
+type idFilter struct {
+	ids     map[string]bool
+	pattern *regexp.Regexp
+}
+
+func newIDFilter(query ngsi.Query) (*idFilter, error) {
+	f := &idFilter{ids: map[string]bool{}}
+
+	req := query.Request()
+	if req == nil {
+		return f, nil
+	}
+
+	for _, id := range strings.Split(req.URL.Query().Get("id"), ",") {
+		id = strings.TrimSpace(id)
+		if id != "" {
+			f.ids[id] = true
+		}
+	}
+
+	idPattern := req.URL.Query().Get("idPattern")
+	if idPattern != "" {
+		pattern, err := regexp.Compile(idPattern)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile idPattern %s: %s", idPattern, err.Error())
+		}
+		f.pattern = pattern
+	}
+
+	return f, nil
+}
+
+func (f *idFilter) hasIdentities() bool {
+	return len(f.ids) > 0
+}
+
+func (f *idFilter) hasPattern() bool {
+	return f.pattern != nil
+}
+
+//matches returns true if an entity with the given (prefixed) id passes the filter
+func (f *idFilter) matches(entityID string) bool {
+	if f.hasIdentities() && !f.ids[entityID] {
+		return false
+	}
+
+	if f.hasPattern() && !f.pattern.MatchString(entityID) {
+		return false
+	}
+
+	return true
+}
+
+//identities returns the identities in the filter that belong to entities with the given
+//prefix, both with and without the prefix, since observations may be stored either way
+func (f *idFilter) identities(prefix string) []string {
+	identities := []string{}
+
+	for id := range f.ids {
+		if strings.HasPrefix(id, prefix) {
+			identities = append(identities, id, strings.TrimPrefix(id, prefix))
+		}
+	}
+
+	return identities
+}
+
+//qOperators lists the supported comparison operators of the q parameter. Operators that
+//are prefixes of other operators must be listed after them.
+var qOperators = []string{"==", "!=", ">=", "<=", ">", "<"}
+
+//newPropertyFilters parses the q parameter of a query into a list of filters that must all
+//match, e.g. q=surfaceType=="snow";probability>=0.5
+func newPropertyFilters(query ngsi.Query) ([]database.PropertyFilter, error) {
+	filters := []database.PropertyFilter{}
+
+	req := query.Request()
+	if req == nil || query.HasDeviceReference() {
+		return filters, nil
+	}
+
+	q := strings.TrimSpace(req.URL.Query().Get("q"))
+	if q == "" {
+		return filters, nil
+	}
+
+	if strings.ContainsAny(q, "|()") {
+		return nil, fmt.Errorf("unsupported q expression %s: only conjunctions are supported", q)
+	}
+
+	for _, term := range strings.Split(q, ";") {
+		filter, err := newPropertyFilter(strings.TrimSpace(term))
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, *filter)
+	}
+
+	return filters, nil
+}
+
+func newPropertyFilter(term string) (*database.PropertyFilter, error) {
+	for _, op := range qOperators {
+		idx := strings.Index(term, op)
+		if idx <= 0 {
+			continue
+		}
+
+		filter := &database.PropertyFilter{
+			Property: strings.TrimSpace(term[:idx]),
+			Operator: op,
+		}
+
+		value := strings.TrimSpace(term[idx+len(op):])
+		if len(value) >= 2 && strings.HasPrefix(value, "\"") && strings.HasSuffix(value, "\"") {
+			filter.Value = value[1 : len(value)-1]
+		} else if number, err := strconv.ParseFloat(value, 64); err == nil {
+			filter.Value = number
+		} else if value == "true" || value == "false" {
+			filter.Value = (value == "true")
+		} else if value != "" {
+			filter.Value = value
+		} else {
+			return nil, fmt.Errorf("missing value in q term %s", term)
+		}
+
+		return filter, nil
+	}
+
+	return nil, fmt.Errorf("failed to parse q term %s", term)
+}
+
+//filtersForProperties translates the property names of a list of filters into the names
+//that are used by the datastore. False is returned if any filter targets a property that
+//is not in the map, since such a filter can not match any entities.
+func filtersForProperties(filters []database.PropertyFilter, properties map[string]string) ([]database.PropertyFilter, bool) {
+	result := []database.PropertyFilter{}
+
+	for _, filter := range filters {
+		property, ok := properties[filter.Property]
+		if !ok {
+			return nil, false
+		}
+
+		filter.Property = property
+		result = append(result, filter)
+	}
+
+	return result, true
+}
+
+//segmentFilters separates the filters on the relationship to the road segment of an observation,
+//e.g. q=refRoadSegment=="urn:ngsi-ld:RoadSegment:21277:153930", from the other filters and
+//returns the identities of the segments that they ask for. A nil list of identities is returned
+//if the filters contradict each other, since such a request can never match any observations.
+func segmentFilters(filters []database.PropertyFilter, relationship string) ([]string, []database.PropertyFilter, error) {
+	segmentIDs := []string{}
+	remaining := []database.PropertyFilter{}
+
+	for _, filter := range filters {
+		if relationship == "" || filter.Property != relationship {
+			remaining = append(remaining, filter)
+			continue
+		}
+
+		segmentID, ok := filter.Value.(string)
+		if !ok || filter.Operator != "==" {
+			return nil, nil, fmt.Errorf("%s can only be compared for equality with a road segment id", relationship)
+		}
+
+		segmentID = strings.TrimPrefix(segmentID, fiware.RoadSegmentIDPrefix)
+		if len(segmentIDs) > 0 && segmentIDs[0] != segmentID {
+			return nil, nil, nil
+		}
+
+		segmentIDs = []string{segmentID}
+	}
+
+	return segmentIDs, remaining, nil
+}
+
+//matchesFilters returns true if the values of the properties of an entity match all filters.
+//Filters on properties without a value never match.
+func matchesFilters(filters []database.PropertyFilter, values map[string]interface{}) bool {
+	for _, filter := range filters {
+		value, ok := values[filter.Property]
+		if !ok || !matchesFilter(filter, value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func matchesFilter(filter database.PropertyFilter, value interface{}) bool {
+	comparison := 0
+
+	switch v := value.(type) {
+	case string:
+		expected, ok := filter.Value.(string)
+		if !ok {
+			return false
+		}
+		comparison = strings.Compare(v, expected)
+	case float64:
+		expected, ok := filter.Value.(float64)
+		if !ok {
+			return false
+		}
+		if v < expected {
+			comparison = -1
+		} else if v > expected {
+			comparison = 1
+		}
+	case bool:
+		expected, ok := filter.Value.(bool)
+		if !ok || (filter.Operator != "==" && filter.Operator != "!=") {
+			return false
+		}
+		if v != expected {
+			comparison = 1
+		}
+	default:
+		return false
+	}
+
+	switch filter.Operator {
+	case "==":
+		return comparison == 0
+	case "!=":
+		return comparison != 0
+	case ">":
+		return comparison > 0
+	case ">=":
+		return comparison >= 0
+	case "<":
+		return comparison < 0
+	case "<=":
+		return comparison <= 0
+	}
+
+	return false
+}
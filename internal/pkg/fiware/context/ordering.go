@@ -0,0 +1,226 @@
+package context
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/diwise/api-transportation/internal/pkg/database"
+	"github.com/diwise/api-transportation/internal/pkg/persistence"
+	ngsi "github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld"
+)
+
+//orderableProperties lists the properties that clients may order query results by
+var orderableProperties = map[string]bool{
+	"id":           true,
+	"dateCreated":  true,
+	"dateIssued":   true,
+	"dateModified": true,
+	"dateObserved": true,
+	"distance":     true,
+	"probability":  true,
+}
+
+//ordering is a client selected order of query results, as requested with the orderBy
+//parameter, e.g. orderBy=-dateModified,id for the most recently modified entities first
+type ordering []database.OrderBy
+
+func newOrdering(query ngsi.Query) (ordering, error) {
+	o := ordering{}
+
+	req := query.Request()
+	if req == nil {
+		return o, nil
+	}
+
+	for _, property := range strings.Split(req.URL.Query().Get("orderBy"), ",") {
+		property = strings.TrimSpace(property)
+		if property == "" {
+			continue
+		}
+
+		ob := database.OrderBy{Property: property}
+		if strings.HasPrefix(property, "-") {
+			ob.Property = property[1:]
+			ob.Descending = true
+		}
+
+		if !orderableProperties[ob.Property] {
+			return nil, fmt.Errorf("unable to order results by unknown property %s", ob.Property)
+		}
+
+		if ob.Property == "distance" && referencePoint(query) == nil {
+			return nil, fmt.Errorf("ordering by distance requires a near query with a reference point")
+		}
+
+		o = append(o, ob)
+	}
+
+	return o, nil
+}
+
+func (o ordering) isEmpty() bool {
+	return len(o) == 0
+}
+
+//referencePoint returns the point of a near query, or nil if the query is not a near query
+func referencePoint(query ngsi.Query) *database.Point {
+	if !query.IsGeoQuery() {
+		return nil
+	}
+
+	geoQ := query.Geo()
+	if geoQ.GeoRel != ngsi.GeoSpatialRelationNearPoint {
+		return nil
+	}
+
+	lon, lat, err := geoQ.Point()
+	if err != nil {
+		return nil
+	}
+
+	pt := database.NewPoint(lat, lon)
+	return &pt
+}
+
+//sortKeys holds the values of the properties that an entity can be ordered by. Values
+//are strings, float64s or time.Times and properties that an entity lacks are left out.
+type sortKeys map[string]interface{}
+
+//less compares the sort keys of two entities and reports whether a should come before b.
+//Entities that lack a property are placed last, regardless of direction, and ties are
+//broken by the entity id so that the order is always deterministic.
+func (o ordering) less(a, b sortKeys) bool {
+	for _, ob := range o {
+		result := compareSortKeys(a[ob.Property], b[ob.Property], ob.Descending)
+		if result != 0 {
+			return result < 0
+		}
+	}
+
+	return compareSortKeys(a["id"], b["id"], false) < 0
+}
+
+func compareSortKeys(a, b interface{}, descending bool) int {
+	if a == nil || b == nil {
+		if a == nil && b == nil {
+			return 0
+		} else if a == nil {
+			return 1
+		}
+		return -1
+	}
+
+	result := 0
+
+	switch av := a.(type) {
+	case string:
+		result = strings.Compare(av, b.(string))
+	case float64:
+		bv := b.(float64)
+		if av < bv {
+			result = -1
+		} else if av > bv {
+			result = 1
+		}
+	case time.Time:
+		bv := b.(time.Time)
+		if av.Before(bv) {
+			result = -1
+		} else if av.After(bv) {
+			result = 1
+		}
+	}
+
+	if descending {
+		return -result
+	}
+
+	return result
+}
+
+func roadSortKeys(road database.Road, ref *database.Point) sortKeys {
+	keys := sortKeys{"id": road.ID()}
+
+	if road.DateModified() != nil {
+		keys["dateModified"] = *road.DateModified()
+	}
+
+	if ref != nil {
+		keys["distance"] = float64(road.DistanceFromPoint(*ref))
+	}
+
+	return keys
+}
+
+func roadSegmentSortKeys(segment database.RoadSegment, ref *database.Point) sortKeys {
+	keys := sortKeys{"id": segment.ID()}
+
+	if segment.DateModified() != nil {
+		keys["dateModified"] = *segment.DateModified()
+	}
+
+	if surfaceType, probability := segment.SurfaceType(); surfaceType != "" {
+		keys["probability"] = probability
+	}
+
+	if ref != nil {
+		keys["distance"] = float64(segment.DistanceFromPoint(*ref))
+	}
+
+	return keys
+}
+
+//observationDistance returns the distance between an observation and a reference point,
+//or nil if the observation lacks a location
+func observationDistance(lat, lon float64, ref *database.Point) interface{} {
+	if ref == nil || (lat == 0 && lon == 0) {
+		return nil
+	}
+
+	pt := database.NewPoint(lat, lon)
+	return float64(database.NewRectangle(pt, pt).DistanceFromPoint(*ref))
+}
+
+func roadSurfaceObservedSortKeys(rso persistence.RoadSurfaceObserved, ref *database.Point) sortKeys {
+	keys := sortKeys{
+		"id":           rso.RoadSurfaceObservedID,
+		"dateObserved": rso.Timestamp,
+		"dateCreated":  rso.CreatedAt,
+		"probability":  rso.Probability,
+	}
+
+	if distance := observationDistance(rso.Latitude, rso.Longitude, ref); distance != nil {
+		keys["distance"] = distance
+	}
+
+	return keys
+}
+
+func trafficFlowObservedSortKeys(tfo persistence.TrafficFlowObserved, ref *database.Point) sortKeys {
+	keys := sortKeys{
+		"id":           tfo.TrafficFlowObservedID,
+		"dateObserved": tfo.DateObserved,
+		"dateCreated":  tfo.CreatedAt,
+		"dateModified": tfo.UpdatedAt,
+	}
+
+	if distance := observationDistance(tfo.Latitude, tfo.Longitude, ref); distance != nil {
+		keys["distance"] = distance
+	}
+
+	return keys
+}
+
+func alertSortKeys(a persistence.Alert, ref *database.Point) sortKeys {
+	keys := sortKeys{
+		"id":         a.AlertID,
+		"dateIssued": a.DateIssued,
+	}
+
+	if distance := observationDistance(a.Latitude, a.Longitude, ref); distance != nil {
+		keys["distance"] = distance
+	}
+
+	return keys
+}
@@ -0,0 +1,74 @@
+package context
+
+import (
+	gocontext "context"
+	"net/http"
+	"sync"
+
+	ngsi "github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld"
+)
+
+type resultCountKey struct{}
+
+//ResultCount collects the total number of entities that matched a query, regardless
+//of how many of them that were returned on the requested page
+type ResultCount struct {
+	mu    sync.Mutex
+	total uint64
+	known bool
+}
+
+//NewRequestWithResultCount returns a shallow copy of the request with a ResultCount
+//attached, that context sources can report the number of matching entities to
+func NewRequestWithResultCount(r *http.Request) (*http.Request, *ResultCount) {
+	rc := &ResultCount{}
+	ctx := gocontext.WithValue(r.Context(), resultCountKey{}, rc)
+	return r.WithContext(ctx), rc
+}
+
+//Add increases the total number of matching entities
+func (rc *ResultCount) Add(count uint64) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	rc.total += count
+	rc.known = true
+}
+
+//Total returns the total number of matching entities and a flag indicating if the
+//total was ever reported
+func (rc *ResultCount) Total() (uint64, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	return rc.total, rc.known
+}
+
+//addToResultCount reports a number of matching entities to the ResultCount that
+//is attached to the query's request, if any
+func addToResultCount(query ngsi.Query, count uint64) {
+	req := query.Request()
+	if req == nil {
+		return
+	}
+
+	if rc, ok := req.Context().Value(resultCountKey{}).(*ResultCount); ok {
+		rc.Add(count)
+	}
+}
+
+//pageBounds returns the first index and the stop index of the requested page from a
+//result with count entities
+func pageBounds(count, offset, limit uint64) (uint64, uint64) {
+	firstIndex := offset
+	if firstIndex > count {
+		firstIndex = count
+	}
+
+	stopIndex := firstIndex + limit
+	if stopIndex > count {
+		stopIndex = count
+	}
+
+	return firstIndex, stopIndex
+}
@@ -0,0 +1,137 @@
+package context
+
+import (
+	"encoding/json"
+	"strings"
+
+	ngsi "github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld"
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/geojson"
+)
+
+//entityProjection converts entities into the representation requested by a client, by
+//dropping attributes that were not asked for (attrs=) and optionally simplifying the
+//remaining ones into plain key/value pairs (options=keyValues)
+type entityProjection struct {
+	attributes map[string]bool
+	keyValues  bool
+}
+
+func newEntityProjection(query ngsi.Query) *entityProjection {
+	p := &entityProjection{attributes: map[string]bool{}}
+
+	for _, attr := range query.EntityAttributes() {
+		attr = strings.TrimSpace(attr)
+		if attr != "" {
+			p.attributes[attr] = true
+		}
+	}
+
+	req := query.Request()
+	if req == nil {
+		return p
+	}
+
+	// GeoJSON responses are simplified by the ngsi-ld handler itself
+	for _, acceptableType := range req.Header["Accept"] {
+		if strings.HasPrefix(acceptableType, geojson.ContentType) {
+			p.attributes = map[string]bool{}
+			return p
+		}
+	}
+
+	for _, option := range strings.Split(req.URL.Query().Get("options"), ",") {
+		if option == "keyValues" {
+			p.keyValues = true
+		}
+	}
+
+	return p
+}
+
+//isIdentity returns true if the projection would leave entities unchanged
+func (p *entityProjection) isIdentity() bool {
+	return len(p.attributes) == 0 && !p.keyValues
+}
+
+func (p *entityProjection) project(entity ngsi.Entity) (ngsi.Entity, error) {
+	if p.isIdentity() {
+		return entity, nil
+	}
+
+	bytes, err := json.Marshal(entity)
+	if err != nil {
+		return nil, err
+	}
+
+	attributes := map[string]interface{}{}
+	err = json.Unmarshal(bytes, &attributes)
+	if err != nil {
+		return nil, err
+	}
+
+	projected := map[string]interface{}{}
+
+	for name, attribute := range attributes {
+		if name == "id" || name == "type" || name == "@context" {
+			projected[name] = attribute
+			continue
+		}
+
+		if len(p.attributes) > 0 && !p.attributes[name] {
+			continue
+		}
+
+		if p.keyValues {
+			attribute = simplifyAttribute(attribute)
+		}
+
+		projected[name] = attribute
+	}
+
+	return projected, nil
+}
+
+//wrap returns a callback that projects every entity before passing it on to the
+//provided callback
+func (p *entityProjection) wrap(callback ngsi.QueryEntitiesCallback) ngsi.QueryEntitiesCallback {
+	if p.isIdentity() {
+		return callback
+	}
+
+	return func(entity ngsi.Entity) error {
+		projected, err := p.project(entity)
+		if err != nil {
+			return err
+		}
+		return callback(projected)
+	}
+}
+
+//simplifyAttribute replaces a normalized property or relationship with its value or object,
+//and every instance of an attribute with several datasets with its value or object
+func simplifyAttribute(attribute interface{}) interface{} {
+	if instances, ok := attribute.([]interface{}); ok {
+		values := []interface{}{}
+		for _, instance := range instances {
+			values = append(values, simplifyAttribute(instance))
+		}
+		return values
+	}
+
+	attr, ok := attribute.(map[string]interface{})
+	if !ok {
+		return attribute
+	}
+
+	if attr["type"] == "Relationship" {
+		if object, ok := attr["object"]; ok {
+			return object
+		}
+	}
+
+	if value, ok := attr["value"]; ok {
+		return value
+	}
+
+	return attribute
+}
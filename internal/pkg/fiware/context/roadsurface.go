@@ -0,0 +1,34 @@
+package context
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/diwise/ngsi-ld-golang/pkg/datamodels/diwise"
+	ngsi "github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld"
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/geojson"
+)
+
+//decodeRoadSurfaceObserved decodes a RoadSurfaceObserved from the body of a request. The location
+//is decoded separately, since ngsi-ld-golang can not decode a geometry into its interface type.
+func decodeRoadSurfaceObserved(req ngsi.Request) (*diwise.RoadSurfaceObserved, error) {
+	dto := struct {
+		diwise.RoadSurfaceObserved
+		Location json.RawMessage `json:"location"`
+	}{}
+
+	err := req.DecodeBodyInto(&dto)
+	if err != nil {
+		return nil, err
+	}
+
+	location := geojson.CreateGeoJSONPropertyFromJSON(dto.Location)
+	if location == nil || location.Value == nil {
+		return nil, fmt.Errorf("a RoadSurfaceObserved must have a location")
+	}
+
+	rso := &dto.RoadSurfaceObserved
+	rso.Location = *location
+
+	return rso, nil
+}
@@ -0,0 +1,163 @@
+package context
+
+import (
+	"math"
+	"time"
+
+	"github.com/diwise/api-transportation/internal/pkg/database"
+	"github.com/diwise/api-transportation/internal/pkg/persistence"
+	"github.com/diwise/ngsi-ld-golang/pkg/datamodels/fiware"
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/geojson"
+	ngsitypes "github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/types"
+)
+
+//booleanProperty is a property with a boolean value, which ngsi-ld-golang lacks
+type booleanProperty struct {
+	ngsitypes.Property
+	Value bool `json:"value"`
+}
+
+func newBooleanProperty(value bool) *booleanProperty {
+	return &booleanProperty{Property: ngsitypes.Property{Type: "Property"}, Value: value}
+}
+
+//trafficFlowObservedDetails holds the Smart Data Models attributes of a TrafficFlowObserved
+//that the fiware model lacks, and the device that made the observation. Retried observations
+//can only be recognized when the device is known.
+type trafficFlowObservedDetails struct {
+	RefDevice            *ngsitypes.SingleObjectRelationship `json:"refDevice,omitempty"`
+	Occupancy            *ngsitypes.NumberProperty           `json:"occupancy,omitempty"`
+	Congested            *booleanProperty                    `json:"congested,omitempty"`
+	AverageHeadwayTime   *ngsitypes.NumberProperty           `json:"averageHeadwayTime,omitempty"`
+	AverageGapDistance   *ngsitypes.NumberProperty           `json:"averageGapDistance,omitempty"`
+	AverageVehicleLength *ngsitypes.NumberProperty           `json:"averageVehicleLength,omitempty"`
+	VehicleType          *ngsitypes.TextProperty             `json:"vehicleType,omitempty"`
+	VehicleSubType       *ngsitypes.TextProperty             `json:"vehicleSubType,omitempty"`
+	LaneDirection        *ngsitypes.TextProperty             `json:"laneDirection,omitempty"`
+	ReversedLane         *booleanProperty                    `json:"reversedLane,omitempty"`
+}
+
+func (d *trafficFlowObservedDetails) toDatastore() database.TrafficFlowObservedDetails {
+	details := database.TrafficFlowObservedDetails{
+		Occupancy:            numberValue(d.Occupancy),
+		Congested:            booleanValue(d.Congested),
+		AverageHeadwayTime:   numberValue(d.AverageHeadwayTime),
+		AverageGapDistance:   numberValue(d.AverageGapDistance),
+		AverageVehicleLength: numberValue(d.AverageVehicleLength),
+		VehicleType:          textValue(d.VehicleType),
+		VehicleSubType:       textValue(d.VehicleSubType),
+		LaneDirection:        textValue(d.LaneDirection),
+		ReversedLane:         booleanValue(d.ReversedLane),
+	}
+
+	if d.RefDevice != nil {
+		details.SourceDevice = d.RefDevice.Object
+	}
+
+	return details
+}
+
+func numberValue(p *ngsitypes.NumberProperty) *float64 {
+	if p == nil {
+		return nil
+	}
+	return &p.Value
+}
+
+func booleanValue(p *booleanProperty) *bool {
+	if p == nil {
+		return nil
+	}
+	return &p.Value
+}
+
+func textValue(p *ngsitypes.TextProperty) string {
+	if p == nil {
+		return ""
+	}
+	return p.Value
+}
+
+//trafficFlowObserved extends the fiware TrafficFlowObserved with the rest of the Smart Data
+//Models attributes
+type trafficFlowObserved struct {
+	fiware.TrafficFlowObserved
+	trafficFlowObservedDetails
+}
+
+func newTrafficFlowObserved(obs persistence.TrafficFlowObserved) *trafficFlowObserved {
+	timeStr := obs.DateObserved.Format(time.RFC3339)
+	tfo := &trafficFlowObserved{
+		TrafficFlowObserved: *fiware.NewTrafficFlowObserved(obs.TrafficFlowObservedID, timeStr, int(obs.LaneID), int(obs.Intensity)),
+	}
+
+	if obs.AverageVehicleSpeed > 0.1 {
+		tfo.AverageVehicleSpeed = ngsitypes.NewNumberProperty(obs.AverageVehicleSpeed)
+	}
+
+	if math.Abs(obs.Latitude) > 0.1 || math.Abs(obs.Longitude) > 0.1 {
+		tfo.Location = geojson.CreateGeoJSONPropertyFromWGS84(obs.Longitude, obs.Latitude)
+	}
+
+	if obs.SegmentID != "" {
+		tfo.RefRoadSegment = ngsitypes.NewSingleObjectRelationship(fiware.RoadSegmentIDPrefix + obs.SegmentID)
+	}
+
+	if !obs.DateObservedFrom.IsZero() {
+		tfo.DateObservedFrom = ngsitypes.CreateDateTimeProperty(obs.DateObservedFrom.UTC().Format(time.RFC3339))
+	}
+
+	if !obs.DateObservedTo.IsZero() {
+		tfo.DateObservedTo = ngsitypes.CreateDateTimeProperty(obs.DateObservedTo.UTC().Format(time.RFC3339))
+	}
+
+	if !obs.CreatedAt.IsZero() {
+		tfo.DateCreated = ngsitypes.CreateDateTimeProperty(obs.CreatedAt.UTC().Format(time.RFC3339))
+	}
+
+	if !obs.UpdatedAt.IsZero() {
+		tfo.DateModified = ngsitypes.CreateDateTimeProperty(obs.UpdatedAt.UTC().Format(time.RFC3339))
+	}
+
+	if obs.SourceDevice != nil {
+		tfo.RefDevice = ngsitypes.NewSingleObjectRelationship(*obs.SourceDevice)
+	}
+
+	if obs.Occupancy != nil {
+		tfo.Occupancy = ngsitypes.NewNumberProperty(*obs.Occupancy)
+	}
+
+	if obs.Congested != nil {
+		tfo.Congested = newBooleanProperty(*obs.Congested)
+	}
+
+	if obs.AverageHeadwayTime != nil {
+		tfo.AverageHeadwayTime = ngsitypes.NewNumberProperty(*obs.AverageHeadwayTime)
+	}
+
+	if obs.AverageGapDistance != nil {
+		tfo.AverageGapDistance = ngsitypes.NewNumberProperty(*obs.AverageGapDistance)
+	}
+
+	if obs.AverageVehicleLength != nil {
+		tfo.AverageVehicleLength = ngsitypes.NewNumberProperty(*obs.AverageVehicleLength)
+	}
+
+	if obs.VehicleType != "" {
+		tfo.VehicleType = ngsitypes.NewTextProperty(obs.VehicleType)
+	}
+
+	if obs.VehicleSubType != "" {
+		tfo.VehicleSubType = ngsitypes.NewTextProperty(obs.VehicleSubType)
+	}
+
+	if obs.LaneDirection != "" {
+		tfo.LaneDirection = ngsitypes.NewTextProperty(obs.LaneDirection)
+	}
+
+	if obs.ReversedLane != nil {
+		tfo.ReversedLane = newBooleanProperty(*obs.ReversedLane)
+	}
+
+	return tfo
+}
@@ -0,0 +1,217 @@
+package context
+
+import (
+	"sort"
+
+	ngsi "github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld"
+)
+
+//ContextSource is an ngsi.ContextSource that is also able to describe the entity types
+//and attributes that it provides
+type ContextSource interface {
+	ngsi.ContextSource
+
+	GetEntityTypes() ([]EntityType, error)
+	GetAttributes() ([]Attribute, error)
+}
+
+//EntityType describes a provided entity type, its attributes, the number of entities of
+//that type and the bounds of their locations as a GeoJSON bbox ([west, south, east, north])
+type EntityType struct {
+	ID             string    `json:"id"`
+	Type           string    `json:"type"`
+	TypeName       string    `json:"typeName"`
+	AttributeNames []string  `json:"attributeNames"`
+	EntityCount    uint64    `json:"entityCount"`
+	BBox           []float64 `json:"bbox,omitempty"`
+}
+
+//Attribute describes a provided attribute, its NGSI-LD attribute types and the names of
+//the entity types that have it
+type Attribute struct {
+	ID             string   `json:"id"`
+	Type           string   `json:"type"`
+	AttributeName  string   `json:"attributeName"`
+	AttributeTypes []string `json:"attributeTypes"`
+	TypeNames      []string `json:"typeNames"`
+}
+
+type attributeInfo struct {
+	name          string
+	attributeType string
+}
+
+type entityTypeInfo struct {
+	name       string
+	attributes []attributeInfo
+}
+
+//providedTypes lists the entity types that this context source provides, and the
+//attributes that entities of each type are returned with
+var providedTypes = []entityTypeInfo{
+	{
+		name: "Road",
+		attributes: []attributeInfo{
+			{"name", "Property"},
+			{"roadClass", "Property"},
+			{"refRoadSegment", "Relationship"},
+		},
+	},
+	{
+		name: "RoadSegment",
+		attributes: []attributeInfo{
+			{"name", "Property"},
+			{"dateModified", "Property"},
+			{"location", "GeoProperty"},
+			{"startPoint", "GeoProperty"},
+			{"endPoint", "GeoProperty"},
+			{"refRoad", "Relationship"},
+			{"totalLaneNumber", "Property"},
+			{"surfaceType", "Property"},
+			{"surfaceTypeDistribution", "Property"},
+			{"surfaceMaterial", "Property"},
+			{"surfaceCondition", "Property"},
+			{"maximumAllowedSpeed", "Property"},
+			{"congestionLevel", "Property"},
+		},
+	},
+	{
+		name: "RoadSurfaceObserved",
+		attributes: []attributeInfo{
+			{"location", "GeoProperty"},
+			{"surfaceType", "Property"},
+			{"dateObserved", "Property"},
+			{"dateCreated", "Property"},
+		},
+	},
+	{
+		name: "TrafficFlowObserved",
+		attributes: []attributeInfo{
+			{"dateObserved", "Property"},
+			{"dateObservedFrom", "Property"},
+			{"dateObservedTo", "Property"},
+			{"dateCreated", "Property"},
+			{"dateModified", "Property"},
+			{"refRoadSegment", "Relationship"},
+			{"location", "GeoProperty"},
+			{"laneID", "Property"},
+			{"averageVehicleSpeed", "Property"},
+			{"intensity", "Property"},
+			{"occupancy", "Property"},
+			{"congested", "Property"},
+			{"averageHeadwayTime", "Property"},
+			{"averageGapDistance", "Property"},
+			{"averageVehicleLength", "Property"},
+			{"vehicleType", "Property"},
+			{"vehicleSubType", "Property"},
+			{"laneDirection", "Property"},
+			{"reversedLane", "Property"},
+			{"refDevice", "Relationship"},
+		},
+	},
+	{
+		name: "Alert",
+		attributes: []attributeInfo{
+			{"name", "Property"},
+			{"category", "Property"},
+			{"subCategory", "Property"},
+			{"severity", "Property"},
+			{"description", "Property"},
+			{"alertSource", "Property"},
+			{"location", "GeoProperty"},
+			{"dateIssued", "Property"},
+			{"validFrom", "Property"},
+			{"validTo", "Property"},
+			{"status", "Property"},
+		},
+	},
+}
+
+func findProvidedType(typeName string) *entityTypeInfo {
+	for idx := range providedTypes {
+		if providedTypes[idx].name == typeName {
+			return &providedTypes[idx]
+		}
+	}
+
+	return nil
+}
+
+func (cs *contextSource) GetEntityTypes() ([]EntityType, error) {
+	entityTypes := []EntityType{}
+
+	for _, info := range providedTypes {
+		stats, err := cs.db.GetEntityStatistics(info.name)
+		if err != nil {
+			return nil, err
+		}
+
+		et := EntityType{
+			ID:             info.name,
+			Type:           "EntityType",
+			TypeName:       info.name,
+			AttributeNames: []string{},
+			EntityCount:    stats.Count,
+		}
+
+		for _, attr := range info.attributes {
+			et.AttributeNames = append(et.AttributeNames, attr.name)
+		}
+
+		if stats.Bounds != nil {
+			nw, se := stats.Bounds.NorthWest(), stats.Bounds.SouthEast()
+			et.BBox = []float64{nw.Longitude(), se.Latitude(), se.Longitude(), nw.Latitude()}
+		}
+
+		entityTypes = append(entityTypes, et)
+	}
+
+	return entityTypes, nil
+}
+
+func (cs *contextSource) GetAttributes() ([]Attribute, error) {
+	attributes := map[string]*Attribute{}
+
+	for _, info := range providedTypes {
+		for _, attr := range info.attributes {
+			a, ok := attributes[attr.name]
+			if !ok {
+				a = &Attribute{
+					ID:             attr.name,
+					Type:           "Attribute",
+					AttributeName:  attr.name,
+					AttributeTypes: []string{},
+					TypeNames:      []string{},
+				}
+				attributes[attr.name] = a
+			}
+
+			if !containsString(a.AttributeTypes, attr.attributeType) {
+				a.AttributeTypes = append(a.AttributeTypes, attr.attributeType)
+			}
+
+			a.TypeNames = append(a.TypeNames, info.name)
+		}
+	}
+
+	result := []Attribute{}
+	for _, a := range attributes {
+		result = append(result, *a)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].AttributeName < result[j].AttributeName
+	})
+
+	return result, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,165 @@
+package fusion
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/diwise/api-transportation/internal/pkg/database"
+	"github.com/diwise/api-transportation/internal/pkg/env"
+	"github.com/diwise/api-transportation/internal/pkg/messaging"
+	"github.com/diwise/api-transportation/internal/pkg/messaging/commands"
+	"github.com/diwise/ngsi-ld-golang/pkg/datamodels/diwise"
+	"github.com/diwise/ngsi-ld-golang/pkg/datamodels/fiware"
+	ngsitypes "github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/types"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//Config controls how observations are matched to road segments and fused
+type Config struct {
+	// Window is how far back in time observations are taken into account
+	Window time.Duration
+	// MaxDistance is the maximum distance, in meters, between an observation and a road
+	// segment for the observation to be matched to the segment
+	MaxDistance uint64
+	Strategy    Strategy
+}
+
+//LoadConfiguration reads the fusion configuration from the environment, falling back to
+//a weighted vote among the observations from the last 30 minutes within 25 meters
+func LoadConfiguration() (*Config, error) {
+	window, err := time.ParseDuration(env.GetVariableOrDefault("TRANSPORTATION_FUSION_WINDOW", "30m"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse fusion window: %s", err.Error())
+	}
+
+	maxDistance, err := strconv.ParseUint(env.GetVariableOrDefault("TRANSPORTATION_FUSION_MAX_DISTANCE", "25"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse fusion max distance: %s", err.Error())
+	}
+
+	strategy, err := NewStrategy(env.GetVariableOrDefault("TRANSPORTATION_FUSION_STRATEGY", "weighted"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Config{Window: window, MaxDistance: maxDistance, Strategy: strategy}, nil
+}
+
+//Fuser matches road surface observations to road segments and combines the recent
+//observations of a segment into an update of the segment's surface type
+type Fuser interface {
+	MapMatch(rso *diwise.RoadSurfaceObserved) (string, bool)
+	FuseSegment(segmentID string, now time.Time) error
+}
+
+//fusionClient is the client that fused predictions are submitted by
+const fusionClient string = "api-transportation"
+
+type fuserImpl struct {
+	db     database.Datastore
+	msg    messaging.MessagingContext
+	config Config
+}
+
+//NewFuser creates a Fuser that issues UpdateRoadSegmentSurface commands to msg
+func NewFuser(db database.Datastore, msg messaging.MessagingContext, config Config) Fuser {
+	return &fuserImpl{db: db, msg: msg, config: config}
+}
+
+//MapMatch links an observation to the closest road segment within the configured max distance,
+//unless the observation already refers to a road segment. It returns the id of the segment
+//and a flag indicating if the observation could be matched.
+func (f *fuserImpl) MapMatch(rso *diwise.RoadSurfaceObserved) (string, bool) {
+	if rso.RefRoadSegment != nil && len(rso.RefRoadSegment.Object) > 0 {
+		return strings.TrimPrefix(rso.RefRoadSegment.Object[0], fiware.RoadSegmentIDPrefix), true
+	}
+
+	pt := rso.Location.GetAsPoint()
+	lon, lat := pt.Coordinates[0], pt.Coordinates[1]
+
+	segments, err := f.db.GetSegmentsNearPoint(lat, lon, f.config.MaxDistance)
+	if err != nil || len(segments) == 0 {
+		return "", false
+	}
+
+	observedAt := database.NewPoint(lat, lon)
+	closest := segments[0]
+
+	for _, s := range segments[1:] {
+		distance := s.DistanceFromPoint(observedAt)
+		if distance < closest.DistanceFromPoint(observedAt) ||
+			(distance == closest.DistanceFromPoint(observedAt) && s.ID() < closest.ID()) {
+			closest = s
+		}
+	}
+
+	ref := ngsitypes.NewMultiObjectRelationship([]string{fiware.RoadSegmentIDPrefix + closest.ID()})
+	rso.RefRoadSegment = &ref
+
+	return closest.ID(), true
+}
+
+//FuseSegment combines the observations of a road segment within the configured time window
+//and enqueues a command to update the segment's surface if the fused result differs from
+//the current surface
+func (f *fuserImpl) FuseSegment(segmentID string, now time.Time) error {
+	segment, err := f.db.GetRoadSegmentByID(segmentID)
+	if err != nil {
+		return err
+	}
+
+	roadSurfaces, err := f.db.QueryRoadSurfacesObserved(database.ObservationQuery{
+		From:           now.Add(-f.config.Window),
+		RoadSegmentIDs: []string{segmentID},
+	})
+	if err != nil {
+		return err
+	}
+
+	observations := []Observation{}
+	latest := time.Time{}
+
+	for _, rso := range roadSurfaces {
+		observations = append(observations, Observation{
+			SurfaceType:  rso.SurfaceType,
+			Probability:  rso.Probability,
+			DateObserved: rso.Timestamp,
+		})
+
+		if rso.Timestamp.After(latest) {
+			latest = rso.Timestamp
+		}
+	}
+
+	surfaceType, probability, ok := f.config.Strategy.Fuse(observations)
+	if !ok {
+		return nil
+	}
+
+	provenance := database.Provenance{Source: database.SourceFusion, Model: f.config.Strategy.Name(), Client: fusionClient}
+
+	// Other datasets may have made more recent predictions, so the fused result is compared
+	// with the latest fused prediction of the segment
+	current := segment.SurfaceDataset(provenance.DatasetID())
+	if current != nil && current.SurfaceType == surfaceType && current.Probability == probability {
+		return nil
+	}
+
+	log.Infof("fused %d observations of segment %s into %s (%f)", len(observations), segmentID, surfaceType, probability)
+
+	//Enqueue a command to a replica of this service, to persist the road surface update
+	command := &commands.UpdateRoadSegmentSurface{
+		ID:          segmentID,
+		SurfaceType: surfaceType,
+		Probability: probability,
+		Timestamp:   latest.UTC().Format(time.RFC3339),
+		Source:      provenance.Source,
+		Model:       provenance.Model,
+		Client:      provenance.Client,
+	}
+
+	return f.msg.NoteToSelf(command)
+}
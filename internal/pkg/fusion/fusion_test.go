@@ -0,0 +1,110 @@
+package fusion_test
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diwise/api-transportation/internal/pkg/database"
+	"github.com/diwise/api-transportation/internal/pkg/fusion"
+	"github.com/diwise/api-transportation/internal/pkg/messaging/commands"
+	"github.com/diwise/messaging-golang/pkg/messaging"
+	"github.com/diwise/ngsi-ld-golang/pkg/datamodels/diwise"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/matryer/is"
+)
+
+func TestMain(m *testing.M) {
+	log.SetFormatter(&log.JSONFormatter{})
+	os.Exit(m.Run())
+}
+
+const seedData string = "21277:153930;21277:153930;62.389109;17.310863;62.389084;17.310852\n"
+
+func TestThatWeightedVoteFavoursTheMostProbableSurfaceType(t *testing.T) {
+	is := is.New(t)
+
+	strategy, _ := fusion.NewStrategy("weighted")
+	surfaceType, probability, ok := strategy.Fuse([]fusion.Observation{
+		{SurfaceType: "snow", Probability: 0.6},
+		{SurfaceType: "snow", Probability: 0.6},
+		{SurfaceType: "tarmac", Probability: 0.8},
+	})
+
+	is.True(ok)
+	is.Equal(surfaceType, "snow")  // the combined weight of the snow observations should win
+	is.Equal(probability, 1.2/2.0) // unexpected fused probability
+}
+
+func TestThatHighestProbabilityPicksTheMostConfidentObservation(t *testing.T) {
+	is := is.New(t)
+
+	strategy, _ := fusion.NewStrategy("highest")
+	surfaceType, probability, ok := strategy.Fuse([]fusion.Observation{
+		{SurfaceType: "snow", Probability: 0.6},
+		{SurfaceType: "snow", Probability: 0.6},
+		{SurfaceType: "tarmac", Probability: 0.8},
+	})
+
+	is.True(ok)
+	is.Equal(surfaceType, "tarmac")
+	is.Equal(probability, 0.8)
+}
+
+func TestThatObservationsAreMapMatchedAndFusedIntoACommand(t *testing.T) {
+	is := is.New(t)
+
+	db, err := database.NewDatabaseConnection(database.NewSQLiteConnector(), strings.NewReader(seedData))
+	is.NoErr(err)
+
+	msg := &messagingMock{}
+	strategy, _ := fusion.NewStrategy("weighted")
+	fuser := fusion.NewFuser(db, msg, fusion.Config{Window: time.Hour, MaxDistance: 25, Strategy: strategy})
+
+	for _, surfaceType := range []string{"snow", "snow", "tarmac"} {
+		rso := diwise.NewRoadSurfaceObserved("obs", surfaceType, 0.5, 62.389100, 17.310860)
+
+		segmentID, ok := fuser.MapMatch(rso)
+		is.True(ok)                         // observation should have been matched to a segment
+		is.Equal(segmentID, "21277:153930") // observation matched to the wrong segment
+
+		_, err = db.CreateRoadSurfaceObserved(rso)
+		is.NoErr(err)
+	}
+
+	err = fuser.FuseSegment("21277:153930", time.Now().UTC())
+	is.NoErr(err)
+
+	is.Equal(len(msg.commands), 1) // expected a single update command
+	cmd := msg.commands[0].(*commands.UpdateRoadSegmentSurface)
+	is.Equal(cmd.ID, "21277:153930")
+	is.Equal(cmd.SurfaceType, "snow")
+	is.Equal(cmd.Source, database.SourceFusion) // fused predictions should be marked as such
+	is.Equal(cmd.Model, "weighted")
+}
+
+func TestThatDistantObservationsAreNotMapMatched(t *testing.T) {
+	is := is.New(t)
+
+	db, _ := database.NewDatabaseConnection(database.NewSQLiteConnector(), strings.NewReader(seedData))
+	strategy, _ := fusion.NewStrategy("weighted")
+	fuser := fusion.NewFuser(db, &messagingMock{}, fusion.Config{Window: time.Hour, MaxDistance: 25, Strategy: strategy})
+
+	_, ok := fuser.MapMatch(diwise.NewRoadSurfaceObserved("obs", "snow", 0.5, 62.4, 17.4))
+	is.True(!ok) // observation far from any segment should not be matched
+}
+
+type messagingMock struct {
+	commands []messaging.CommandMessage
+}
+
+func (m *messagingMock) PublishOnTopic(message messaging.TopicMessage) error {
+	return nil
+}
+
+func (m *messagingMock) NoteToSelf(message messaging.CommandMessage) error {
+	m.commands = append(m.commands, message)
+	return nil
+}
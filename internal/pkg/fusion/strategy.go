@@ -0,0 +1,90 @@
+package fusion
+
+import (
+	"fmt"
+	"time"
+)
+
+//Observation is a single observation of the surface of a road segment
+type Observation struct {
+	SurfaceType  string
+	Probability  float64
+	DateObserved time.Time
+}
+
+//Strategy combines a set of observations of a road segment into a single surface type
+//and the probability of that surface type being correct
+type Strategy interface {
+	Fuse(observations []Observation) (string, float64, bool)
+	Name() string
+}
+
+//NewStrategy returns the strategy with the given name
+func NewStrategy(name string) (Strategy, error) {
+	if name == "weighted" {
+		return &weightedVoteStrategy{}, nil
+	} else if name == "highest" {
+		return &highestProbabilityStrategy{}, nil
+	}
+
+	return nil, fmt.Errorf("unknown fusion strategy %s", name)
+}
+
+//weightedVoteStrategy lets every observation vote for its surface type with a weight that
+//equals its probability. The surface type with the highest total weight wins, and its
+//probability is its share of the total weight of all observations.
+type weightedVoteStrategy struct{}
+
+func (s *weightedVoteStrategy) Name() string {
+	return "weighted"
+}
+
+func (s *weightedVoteStrategy) Fuse(observations []Observation) (string, float64, bool) {
+	weights := map[string]float64{}
+	totalWeight := 0.0
+
+	for _, o := range observations {
+		weights[o.SurfaceType] += o.Probability
+		totalWeight += o.Probability
+	}
+
+	if totalWeight <= 0 {
+		return "", 0, false
+	}
+
+	surfaceType, weight := "", 0.0
+	for st, w := range weights {
+		// Break ties by name to keep the result independent of map iteration order
+		if w > weight || (w == weight && st < surfaceType) {
+			surfaceType, weight = st, w
+		}
+	}
+
+	return surfaceType, weight / totalWeight, true
+}
+
+//highestProbabilityStrategy trusts the single observation with the highest probability,
+//preferring the most recent observation when several are equally probable
+type highestProbabilityStrategy struct{}
+
+func (s *highestProbabilityStrategy) Name() string {
+	return "highest"
+}
+
+func (s *highestProbabilityStrategy) Fuse(observations []Observation) (string, float64, bool) {
+	var best *Observation
+
+	for idx := range observations {
+		o := &observations[idx]
+		if best == nil || o.Probability > best.Probability ||
+			(o.Probability == best.Probability && o.DateObserved.After(best.DateObserved)) {
+			best = o
+		}
+	}
+
+	if best == nil {
+		return "", 0, false
+	}
+
+	return best.SurfaceType, best.Probability, true
+}
@@ -0,0 +1,447 @@
+package importer
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/diwise/api-transportation/internal/pkg/database"
+	"github.com/diwise/api-transportation/internal/pkg/env"
+	"github.com/diwise/ngsi-ld-golang/pkg/datamodels/fiware"
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/geojson"
+	ngsitypes "github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/types"
+	"github.com/google/uuid"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//Config controls how imported observations are stored and reported
+type Config struct {
+	// BatchSize is the number of rows that are inserted in a single transaction
+	BatchSize int
+	// MaxDistance is the maximum distance, in meters, between an observation and a road segment
+	// for the observation to be matched to the segment when it lacks a refRoadSegment
+	MaxDistance uint64
+	// MaxErrors is the number of rejected rows that are described in a report
+	MaxErrors int
+}
+
+//LoadConfiguration reads the import configuration from the environment, falling back to
+//inserting 500 rows at a time, matching observations to road segments within 25 meters and
+//describing the first 100 rejected rows
+func LoadConfiguration() (*Config, error) {
+	batchSize, err := strconv.Atoi(env.GetVariableOrDefault("TRANSPORTATION_IMPORT_BATCH_SIZE", "500"))
+	if err != nil || batchSize <= 0 {
+		return nil, fmt.Errorf("the import batch size must be a positive integer")
+	}
+
+	maxDistance, err := strconv.ParseUint(env.GetVariableOrDefault("TRANSPORTATION_IMPORT_MAX_DISTANCE", "25"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse import max distance: %s", err.Error())
+	}
+
+	maxErrors, err := strconv.Atoi(env.GetVariableOrDefault("TRANSPORTATION_IMPORT_MAX_ERRORS", "100"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse import max errors: %s", err.Error())
+	}
+
+	return &Config{BatchSize: batchSize, MaxDistance: maxDistance, MaxErrors: maxErrors}, nil
+}
+
+//attributes are the TrafficFlowObserved attributes that can be imported. Unless mapped to other
+//columns, they are read from the columns with the same names.
+var attributes = []string{
+	"id", "dateObserved", "dateObservedFrom", "dateObservedTo", "laneID", "intensity",
+	"averageVehicleSpeed", "latitude", "longitude", "refRoadSegment", "refDevice", "occupancy",
+	"congested", "averageHeadwayTime", "averageGapDistance", "averageVehicleLength",
+	"vehicleType", "vehicleSubType", "laneDirection", "reversedLane",
+}
+
+//requiredAttributes must be present in every imported file
+var requiredAttributes = []string{"dateObserved", "laneID", "intensity"}
+
+//Mapping describes how the columns of a CSV file map onto TrafficFlowObserved attributes, and
+//how its times and numbers are formatted
+type Mapping struct {
+	// Columns maps attribute names to the headers of the columns that hold them
+	Columns map[string]string
+	// Location is the time zone of times that lack an offset of their own
+	Location *time.Location
+	// TimeLayout is the layout of the times, as used by time.Parse
+	TimeLayout string
+	Comma      rune
+}
+
+//NewMapping creates a mapping from a comma separated list of attribute:column pairs, the name of
+//a time zone (defaulting to UTC), a time layout (defaulting to RFC3339) and a column delimiter
+//(defaulting to a comma)
+func NewMapping(columns, timeZone, timeLayout, delimiter string) (*Mapping, error) {
+	mapping := &Mapping{
+		Columns:    map[string]string{},
+		Location:   time.UTC,
+		TimeLayout: time.RFC3339,
+		Comma:      ',',
+	}
+
+	for _, attribute := range attributes {
+		mapping.Columns[attribute] = attribute
+	}
+
+	if columns != "" {
+		for _, pair := range strings.Split(columns, ",") {
+			kv := strings.SplitN(pair, ":", 2)
+			if len(kv) != 2 || kv[1] == "" {
+				return nil, fmt.Errorf("column mappings must be of the form attribute:column, not %s", pair)
+			}
+
+			if _, ok := mapping.Columns[kv[0]]; !ok {
+				return nil, fmt.Errorf("%s is not an attribute that can be imported", kv[0])
+			}
+
+			mapping.Columns[kv[0]] = kv[1]
+		}
+	}
+
+	if timeZone != "" {
+		location, err := time.LoadLocation(timeZone)
+		if err != nil {
+			return nil, fmt.Errorf("unknown time zone %s", timeZone)
+		}
+		mapping.Location = location
+	}
+
+	if timeLayout != "" {
+		mapping.TimeLayout = timeLayout
+	}
+
+	if delimiter != "" {
+		comma, size := utf8.DecodeRuneInString(delimiter)
+		if size != len(delimiter) || comma == '"' || comma == '\r' || comma == '\n' {
+			return nil, fmt.Errorf("invalid delimiter %s", delimiter)
+		}
+		mapping.Comma = comma
+	}
+
+	return mapping, nil
+}
+
+//RowError describes why a row was rejected. Lines are numbered from one, including the header.
+type RowError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+//Report summarizes the outcome of an import
+type Report struct {
+	Rows       int `json:"rows"`
+	Imported   int `json:"imported"`
+	Duplicates int `json:"duplicates"`
+	Rejected   int `json:"rejected"`
+	// MapMatched is the number of rows that lacked a refRoadSegment and were matched to the
+	// closest road segment
+	MapMatched int        `json:"mapMatched"`
+	Errors     []RowError `json:"errors"`
+	Duration   string     `json:"duration"`
+}
+
+//reject counts a rejected row and keeps the errors of the first maxErrors rejected lines. Rows
+//that fail validation in the datastore are rejected after the rows of later lines that could not
+//be parsed, so the errors are kept in line order rather than in the order they are rejected.
+func (r *Report) reject(line int, err error, maxErrors int) {
+	r.Rejected++
+
+	idx := sort.Search(len(r.Errors), func(i int) bool { return r.Errors[i].Line > line })
+	if idx >= maxErrors {
+		return
+	}
+
+	r.Errors = append(r.Errors, RowError{})
+	copy(r.Errors[idx+1:], r.Errors[idx:])
+	r.Errors[idx] = RowError{Line: line, Error: err.Error()}
+
+	if len(r.Errors) > maxErrors {
+		r.Errors = r.Errors[:maxErrors]
+	}
+}
+
+//Importer streams historical traffic counts from CSV files into TrafficFlowObserved
+type Importer interface {
+	ImportTrafficFlowsObserved(r io.Reader, mapping Mapping) (*Report, error)
+}
+
+type importerImpl struct {
+	db     database.Datastore
+	config Config
+}
+
+//NewImporter creates an Importer that stores the imported observations in db
+func NewImporter(db database.Datastore, config Config) Importer {
+	return &importerImpl{db: db, config: config}
+}
+
+//ImportTrafficFlowsObserved reads the rows of a CSV file one batch at a time and stores them as
+//traffic flow observations. Rows that can not be parsed or fail validation are rejected and
+//described in the report, while the rest of the file is imported. An error is only returned if
+//the file can not be read at all, or if a batch could not be stored, in which case the report
+//covers the rows up until that batch.
+func (imp *importerImpl) ImportTrafficFlowsObserved(r io.Reader, mapping Mapping) (*Report, error) {
+	start := time.Now()
+	report := &Report{Errors: []RowError{}}
+
+	reader := csv.NewReader(r)
+	reader.Comma = mapping.Comma
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the header of the file: %s", err.Error())
+	}
+
+	// Spreadsheets tend to start their exports with a byte order mark
+	columns := map[string]int{}
+	for idx, name := range header {
+		columns[strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))] = idx
+	}
+
+	indices := map[string]int{}
+	for attribute, column := range mapping.Columns {
+		if idx, ok := columns[column]; ok {
+			indices[attribute] = idx
+		}
+	}
+
+	for _, attribute := range requiredAttributes {
+		if _, ok := indices[attribute]; !ok {
+			return nil, fmt.Errorf("the file lacks a %s column", mapping.Columns[attribute])
+		}
+	}
+
+	batch := []database.ImportedTrafficFlowObserved{}
+	lines := []int{}
+	line := 1
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		result, err := imp.db.ImportTrafficFlowsObserved(batch)
+		if err != nil {
+			return fmt.Errorf("failed to store the rows up until line %d: %s", line, err.Error())
+		}
+
+		report.Imported += result.Imported
+		report.Duplicates += result.Duplicates
+		rejected := []int{}
+		for idx := range result.Errors {
+			rejected = append(rejected, idx)
+		}
+		sort.Ints(rejected)
+
+		for _, idx := range rejected {
+			report.reject(lines[idx], result.Errors[idx], imp.config.MaxErrors)
+		}
+
+		log.Infof("imported %d of %d traffic flow rows so far (%d duplicates, %d rejected)",
+			report.Imported, report.Rows, report.Duplicates, report.Rejected)
+
+		batch, lines = batch[:0], lines[:0]
+		return nil
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+
+		line++
+
+		if err != nil {
+			if _, ok := err.(*csv.ParseError); !ok {
+				return report, fmt.Errorf("failed to read line %d: %s", line, err.Error())
+			}
+			report.Rows++
+			report.reject(line, err, imp.config.MaxErrors)
+			continue
+		}
+
+		report.Rows++
+
+		row := func(attribute string) string {
+			if idx, ok := indices[attribute]; ok && idx < len(record) {
+				return strings.TrimSpace(record[idx])
+			}
+			return ""
+		}
+
+		imported, err := newObservation(row, mapping)
+		if err != nil {
+			report.reject(line, err, imp.config.MaxErrors)
+			continue
+		}
+
+		if imp.mapMatch(imported.Observation) {
+			report.MapMatched++
+		}
+
+		batch = append(batch, *imported)
+		lines = append(lines, line)
+
+		if len(batch) >= imp.config.BatchSize {
+			if err = flush(); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	if err = flush(); err != nil {
+		return report, err
+	}
+
+	report.Duration = time.Since(start).Round(time.Millisecond).String()
+
+	return report, nil
+}
+
+//mapMatch links an observation to the closest road segment within the configured max distance,
+//unless the observation already refers to a road segment or lacks a location. It returns true if
+//the observation was matched.
+func (imp *importerImpl) mapMatch(tfo *fiware.TrafficFlowObserved) bool {
+	if tfo.RefRoadSegment != nil || tfo.Location == nil {
+		return false
+	}
+
+	pt := tfo.Location.GetAsPoint()
+	lon, lat := pt.Longitude(), pt.Latitude()
+
+	segments, err := imp.db.GetSegmentsNearPoint(lat, lon, imp.config.MaxDistance)
+	if err != nil || len(segments) == 0 {
+		return false
+	}
+
+	observedAt := database.NewPoint(lat, lon)
+	closest := segments[0]
+
+	for _, s := range segments[1:] {
+		distance := s.DistanceFromPoint(observedAt)
+		if distance < closest.DistanceFromPoint(observedAt) ||
+			(distance == closest.DistanceFromPoint(observedAt) && s.ID() < closest.ID()) {
+			closest = s
+		}
+	}
+
+	tfo.RefRoadSegment = ngsitypes.NewSingleObjectRelationship(fiware.RoadSegmentIDPrefix + closest.ID())
+
+	return true
+}
+
+//newObservation creates a traffic flow observation from the values of a row, leaving the
+//validation of the values to the datastore
+func newObservation(row func(string) string, mapping Mapping) (*database.ImportedTrafficFlowObserved, error) {
+	dateObserved, err := parseTime(row("dateObserved"), mapping)
+	if err != nil {
+		return nil, fmt.Errorf("dateObserved: %s", err.Error())
+	}
+
+	laneID, err := strconv.Atoi(row("laneID"))
+	if err != nil {
+		return nil, fmt.Errorf("laneID: %s is not an integer", row("laneID"))
+	}
+
+	intensity, err := strconv.Atoi(row("intensity"))
+	if err != nil {
+		return nil, fmt.Errorf("intensity: %s is not an integer", row("intensity"))
+	}
+
+	id := row("id")
+	if id == "" {
+		id = uuid.New().String()
+	}
+
+	tfo := fiware.NewTrafficFlowObserved(id, dateObserved, laneID, intensity)
+	details := database.TrafficFlowObservedDetails{
+		SourceDevice:   row("refDevice"),
+		VehicleType:    row("vehicleType"),
+		VehicleSubType: row("vehicleSubType"),
+		LaneDirection:  row("laneDirection"),
+	}
+
+	for attribute, property := range map[string]**ngsitypes.DateTimeProperty{
+		"dateObservedFrom": &tfo.DateObservedFrom,
+		"dateObservedTo":   &tfo.DateObservedTo,
+	} {
+		if row(attribute) != "" {
+			value, err := parseTime(row(attribute), mapping)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", attribute, err.Error())
+			}
+			*property = ngsitypes.CreateDateTimeProperty(value)
+		}
+	}
+
+	numbers := map[string]*float64{}
+	for _, attribute := range []string{"averageVehicleSpeed", "latitude", "longitude", "occupancy", "averageHeadwayTime", "averageGapDistance", "averageVehicleLength"} {
+		if row(attribute) != "" {
+			// Decimal commas are common in exports from spreadsheets
+			value, err := strconv.ParseFloat(strings.Replace(row(attribute), ",", ".", 1), 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s is not a number", attribute, row(attribute))
+			}
+			numbers[attribute] = &value
+		}
+	}
+
+	booleans := map[string]*bool{}
+	for _, attribute := range []string{"congested", "reversedLane"} {
+		if row(attribute) != "" {
+			value, err := strconv.ParseBool(row(attribute))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s is not a boolean", attribute, row(attribute))
+			}
+			booleans[attribute] = &value
+		}
+	}
+
+	if speed, ok := numbers["averageVehicleSpeed"]; ok {
+		tfo.AverageVehicleSpeed = ngsitypes.NewNumberProperty(*speed)
+	}
+
+	lat, hasLat := numbers["latitude"]
+	lon, hasLon := numbers["longitude"]
+	if hasLat != hasLon {
+		return nil, fmt.Errorf("a location needs both a latitude and a longitude")
+	} else if hasLat {
+		tfo.Location = geojson.CreateGeoJSONPropertyFromWGS84(*lon, *lat)
+	}
+
+	if segmentID := row("refRoadSegment"); segmentID != "" {
+		tfo.RefRoadSegment = ngsitypes.NewSingleObjectRelationship(fiware.RoadSegmentIDPrefix + strings.TrimPrefix(segmentID, fiware.RoadSegmentIDPrefix))
+	}
+
+	details.Occupancy = numbers["occupancy"]
+	details.AverageHeadwayTime = numbers["averageHeadwayTime"]
+	details.AverageGapDistance = numbers["averageGapDistance"]
+	details.AverageVehicleLength = numbers["averageVehicleLength"]
+	details.Congested = booleans["congested"]
+	details.ReversedLane = booleans["reversedLane"]
+
+	return &database.ImportedTrafficFlowObserved{Observation: tfo, Details: details}, nil
+}
+
+//parseTime parses a time in the layout and time zone of the mapping, and formats it in UTC
+//as expected by the datastore
+func parseTime(value string, mapping Mapping) (string, error) {
+	t, err := time.ParseInLocation(mapping.TimeLayout, value, mapping.Location)
+	if err != nil {
+		return "", fmt.Errorf("%s does not match the layout %s", value, mapping.TimeLayout)
+	}
+
+	return t.UTC().Format("2006-01-02T15:04:05Z"), nil
+}
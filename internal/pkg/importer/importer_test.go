@@ -0,0 +1,143 @@
+package importer_test
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diwise/api-transportation/internal/pkg/database"
+	"github.com/diwise/api-transportation/internal/pkg/importer"
+	"github.com/diwise/api-transportation/internal/pkg/retention"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/matryer/is"
+)
+
+func TestMain(m *testing.M) {
+	log.SetFormatter(&log.JSONFormatter{})
+	os.Exit(m.Run())
+}
+
+const seedData string = "21277:153930;21277:153930;62.389109;17.310863;62.389084;17.310852\n"
+
+const counts string = `Tid;Körfält;Antal;Hastighet;Lat;Lon;Detektor
+2021-07-01 10:00;1;42;48,5;62,389100;17,310860;loop-1
+2021-07-01 10:00;1;42;48,5;62,389100;17,310860;loop-1
+2021-07-01 10:05;2;38;;62,389100;17,310860;loop-1
+2021-07-01 10:10;x;12;;62,389100;17,310860;loop-1
+2021-07-01 10:15;1;17;;12,0;17,310860;loop-1
+2021-07-01 10:20;2;9;51;;;loop-1
+`
+
+func TestThatCSVRowsAreMappedMatchedAndImportedInBatches(t *testing.T) {
+	is := is.New(t)
+
+	db, err := database.NewDatabaseConnection(database.NewSQLiteConnector(), strings.NewReader(seedData))
+	is.NoErr(err)
+
+	mapping, err := importer.NewMapping(
+		"dateObserved:Tid,laneID:Körfält,intensity:Antal,averageVehicleSpeed:Hastighet,latitude:Lat,longitude:Lon,refDevice:Detektor",
+		"Europe/Stockholm", "2006-01-02 15:04", ";",
+	)
+	is.NoErr(err)
+
+	imp := importer.NewImporter(db, importer.Config{BatchSize: 2, MaxDistance: 25, MaxErrors: 10})
+	report, err := imp.ImportTrafficFlowsObserved(strings.NewReader(counts), *mapping)
+	is.NoErr(err)
+
+	is.Equal(report.Rows, 6)
+	is.Equal(report.Imported, 3)   // the first, third and last rows should be imported
+	is.Equal(report.Duplicates, 1) // the second row repeats the first
+	is.Equal(report.Rejected, 2)   // the lane of the fourth row and the latitude of the fifth are invalid
+	is.Equal(report.MapMatched, 3) // rows near the seeded segment should be matched to it
+	is.Equal(report.Errors[0].Line, 5)
+	is.Equal(report.Errors[1].Line, 6)
+
+	tfos, err := db.QueryTrafficFlowsObserved(database.ObservationQuery{RoadSegmentIDs: []string{"21277:153930"}})
+	is.NoErr(err)
+	is.Equal(len(tfos), 2) // the observations with a location should refer to the matched segment
+	is.Equal(tfos[0].DateObserved.UTC().Format("15:04"), "08:00")
+	is.Equal(tfos[0].AverageVehicleSpeed, 48.5)
+}
+
+func TestThatRowsThatHaveBeenRolledUpAreNotImportedAgain(t *testing.T) {
+	is := is.New(t)
+
+	db, err := database.NewDatabaseConnection(database.NewSQLiteConnector(), strings.NewReader(seedData))
+	is.NoErr(err)
+
+	mapping, err := importer.NewMapping(
+		"dateObserved:Tid,laneID:Körfält,intensity:Antal,averageVehicleSpeed:Hastighet,latitude:Lat,longitude:Lon,refDevice:Detektor",
+		"Europe/Stockholm", "2006-01-02 15:04", ";",
+	)
+	is.NoErr(err)
+
+	imp := importer.NewImporter(db, importer.Config{BatchSize: 2, MaxDistance: 25, MaxErrors: 10})
+	_, err = imp.ImportTrafficFlowsObserved(strings.NewReader(counts), *mapping)
+	is.NoErr(err)
+
+	policy, err := retention.NewConfiguration(time.Hour, time.Hour, 24*time.Hour)
+	is.NoErr(err)
+	is.NoErr(retention.Apply(db, *policy, time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC)))
+
+	report, err := imp.ImportTrafficFlowsObserved(strings.NewReader(counts), *mapping)
+	is.NoErr(err)
+	is.Equal(report.Imported, 0)   // the rows have already been rolled up into hourly aggregates
+	is.Equal(report.Duplicates, 4) // every valid row should be reported as a duplicate
+
+	intensity := 0
+	tfos, err := db.QueryTrafficFlowsObserved(database.ObservationQuery{})
+	is.NoErr(err)
+	for _, tfo := range tfos {
+		intensity += tfo.Intensity
+	}
+	is.Equal(intensity, 42+38+9) // the imported rows should only be counted once
+}
+
+func TestThatRejectedRowsAreReportedInLineOrder(t *testing.T) {
+	is := is.New(t)
+
+	db, err := database.NewDatabaseConnection(database.NewSQLiteConnector(), strings.NewReader(seedData))
+	is.NoErr(err)
+
+	mapping, err := importer.NewMapping("dateObserved:Tid,laneID:Körfält,intensity:Antal,latitude:Lat,longitude:Lon", "", "2006-01-02 15:04", ";")
+	is.NoErr(err)
+
+	rows := `Tid;Körfält;Antal;Lat;Lon
+2021-07-01 10:00;1;42;12,0;17,310860
+2021-07-01 10:05;1;38;13,0;17,310860
+2021-07-01 10:10;x;12;62,389100;17,310860
+2021-07-01 10:15;1;17;14,0;17,310860
+`
+
+	imp := importer.NewImporter(db, importer.Config{BatchSize: 10, MaxErrors: 3})
+	report, err := imp.ImportTrafficFlowsObserved(strings.NewReader(rows), *mapping)
+	is.NoErr(err)
+
+	is.Equal(report.Rejected, 4)
+	is.Equal(len(report.Errors), 3) // only the first three rejected lines should be described
+	for idx, rowError := range report.Errors {
+		is.Equal(rowError.Line, idx+2) // errors should be reported in line order
+	}
+}
+
+func TestThatFilesWithoutTheRequiredColumnsAreRefused(t *testing.T) {
+	is := is.New(t)
+
+	db, err := database.NewDatabaseConnection(database.NewSQLiteConnector(), nil)
+	is.NoErr(err)
+
+	mapping, err := importer.NewMapping("", "", "", "")
+	is.NoErr(err)
+
+	imp := importer.NewImporter(db, importer.Config{BatchSize: 10, MaxErrors: 10})
+	_, err = imp.ImportTrafficFlowsObserved(strings.NewReader("dateObserved,intensity\n2021-07-01T10:00:00Z,12\n"), *mapping)
+	is.True(err != nil) // a file without lanes should be refused
+
+	_, err = importer.NewMapping("speed:Hastighet", "", "", "")
+	is.True(err != nil) // unknown attributes should not be mappable
+
+	_, err = importer.NewMapping("", "Europe/Nowhere", "", "")
+	is.True(err != nil) // unknown time zones should be refused
+}
@@ -3,14 +3,27 @@ package commands
 const (
 	//UpdateRoadSegmentSurfaceContentType is the content type for ...
 	UpdateRoadSegmentSurfaceContentType = "application/vnd-diwise-updateroadsegmentsurface+json"
+	//CreateTrafficFlowObservedContentType is the content type of commands that carry a
+	//TrafficFlowObserved entity, in the same form as it would be posted to the NGSI-LD API
+	CreateTrafficFlowObservedContentType = "application/vnd-diwise-createtrafficflowobserved+json"
+	//CreateRoadSurfaceObservedContentType is the content type of commands that carry a
+	//RoadSurfaceObserved entity, in the same form as it would be posted to the NGSI-LD API
+	CreateRoadSurfaceObservedContentType = "application/vnd-diwise-createroadsurfaceobserved+json"
 )
 
 //UpdateRoadSegmentSurface is a command that takes info about a road surface update and enqueues it for persistence
 type UpdateRoadSegmentSurface struct {
-	ID          string  `json:"id"`
-	SurfaceType string  `json:"surfaceType"`
-	Probability float64 `json:"probability"`
-	Timestamp   string  `json:"timestamp"`
+	ID           string             `json:"id"`
+	SurfaceType  string             `json:"surfaceType"`
+	Probability  float64            `json:"probability"`
+	Distribution map[string]float64 `json:"distribution,omitempty"`
+	Timestamp    string             `json:"timestamp"`
+
+	// Source, Model, ModelVersion and Client describe where the surface prediction came from
+	Source       string `json:"source,omitempty"`
+	Model        string `json:"model,omitempty"`
+	ModelVersion string `json:"modelVersion,omitempty"`
+	Client       string `json:"client,omitempty"`
 }
 
 //ContentType returns the content type that this event will be sent as
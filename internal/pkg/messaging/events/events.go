@@ -2,18 +2,168 @@ package events
 
 //RoadSegmentSurfaceUpdated is an event that notifies that a road surface type has changed
 type RoadSegmentSurfaceUpdated struct {
+	ID           string             `json:"id"`
+	SurfaceType  string             `json:"surfaceType"`
+	Probability  float64            `json:"probability"`
+	Distribution map[string]float64 `json:"distribution,omitempty"`
+	Timestamp    string             `json:"timestamp"`
+
+	// Source, Model, ModelVersion and Client describe where the surface prediction came from
+	Source       string `json:"source,omitempty"`
+	Model        string `json:"model,omitempty"`
+	ModelVersion string `json:"modelVersion,omitempty"`
+	Client       string `json:"client,omitempty"`
+}
+
+//TopicName returns the name of the topic that this event should be posted to
+func (rssu *RoadSegmentSurfaceUpdated) TopicName() string {
+	return "events.transportation.roadsegmentsurfaceupdated"
+}
+
+//ContentType returns the content type that this event will be sent as
+func (rssu *RoadSegmentSurfaceUpdated) ContentType() string {
+	return "application/json"
+}
+
+//RoadSegmentSurfaceExpired is an event that notifies that the surface condition of a road
+//segment has become too old to be trusted, and that the condition is now unknown
+type RoadSegmentSurfaceExpired struct {
 	ID          string  `json:"id"`
 	SurfaceType string  `json:"surfaceType"`
 	Probability float64 `json:"probability"`
+	ObservedAt  string  `json:"observedAt"`
 	Timestamp   string  `json:"timestamp"`
 }
 
 //TopicName returns the name of the topic that this event should be posted to
-func (rssu *RoadSegmentSurfaceUpdated) TopicName() string {
-	return "events.transportation.roadsegmentsurfaceupdated"
+func (rsse *RoadSegmentSurfaceExpired) TopicName() string {
+	return "events.transportation.roadsegmentsurfaceexpired"
 }
 
 //ContentType returns the content type that this event will be sent as
-func (rssu *RoadSegmentSurfaceUpdated) ContentType() string {
+func (rsse *RoadSegmentSurfaceExpired) ContentType() string {
+	return "application/json"
+}
+
+//AlertUpdated is an event that notifies that an alert about a hazardous road surface has
+//been issued or closed
+type AlertUpdated struct {
+	ID          string  `json:"id"`
+	RoadSegment string  `json:"roadSegment"`
+	Status      string  `json:"status"`
+	Severity    string  `json:"severity"`
+	SubCategory string  `json:"subCategory"`
+	Description string  `json:"description"`
+	SurfaceType string  `json:"surfaceType"`
+	Probability float64 `json:"probability"`
+	ValidFrom   string  `json:"validFrom"`
+	ValidTo     string  `json:"validTo,omitempty"`
+	Timestamp   string  `json:"timestamp"`
+}
+
+//TopicName returns the name of the topic that this event should be posted to
+func (au *AlertUpdated) TopicName() string {
+	return "events.transportation.alertupdated"
+}
+
+//ContentType returns the content type that this event will be sent as
+func (au *AlertUpdated) ContentType() string {
+	return "application/json"
+}
+
+//TrafficFlowAnomalyDetected is an event that notifies that a traffic flow observation deviated
+//strongly from the baseline of its road segment and lane, e.g. due to an incident or a stuck sensor
+type TrafficFlowAnomalyDetected struct {
+	ID           string  `json:"id"`
+	RoadSegment  string  `json:"roadSegment"`
+	LaneID       int     `json:"laneID"`
+	Kind         string  `json:"kind"`
+	Intensity    int     `json:"intensity"`
+	Expected     float64 `json:"expected"`
+	Score        float64 `json:"score"`
+	DateObserved string  `json:"dateObserved"`
+	Timestamp    string  `json:"timestamp"`
+}
+
+//TopicName returns the name of the topic that this event should be posted to
+func (tfad *TrafficFlowAnomalyDetected) TopicName() string {
+	return "events.transportation.trafficflowanomalydetected"
+}
+
+//ContentType returns the content type that this event will be sent as
+func (tfad *TrafficFlowAnomalyDetected) ContentType() string {
+	return "application/json"
+}
+
+//RoadSegmentCongestionUpdated is an event that notifies that the congestion level of a road
+//segment has changed, as derived from the traffic flows observed on it
+type RoadSegmentCongestionUpdated struct {
+	ID                  string  `json:"id"`
+	Level               string  `json:"level"`
+	PreviousLevel       string  `json:"previousLevel,omitempty"`
+	AverageVehicleSpeed float64 `json:"averageVehicleSpeed"`
+	SpeedRatio          float64 `json:"speedRatio"`
+	Intensity           int     `json:"intensity"`
+	ObservedAt          string  `json:"observedAt"`
+	Timestamp           string  `json:"timestamp"`
+}
+
+//TopicName returns the name of the topic that this event should be posted to
+func (rscu *RoadSegmentCongestionUpdated) TopicName() string {
+	return "events.transportation.roadsegmentcongestionupdated"
+}
+
+//ContentType returns the content type that this event will be sent as
+func (rscu *RoadSegmentCongestionUpdated) ContentType() string {
+	return "application/json"
+}
+
+//TrafficFlowObservedCreated is an event that notifies that a new traffic flow observation has
+//been stored. Retried observations that were suppressed as duplicates are not notified again.
+type TrafficFlowObservedCreated struct {
+	ID                  string  `json:"id"`
+	RoadSegment         string  `json:"roadSegment,omitempty"`
+	RefDevice           string  `json:"refDevice,omitempty"`
+	LaneID              int     `json:"laneID"`
+	Intensity           int     `json:"intensity"`
+	AverageVehicleSpeed float64 `json:"averageVehicleSpeed,omitempty"`
+	Latitude            float64 `json:"latitude,omitempty"`
+	Longitude           float64 `json:"longitude,omitempty"`
+	DateObserved        string  `json:"dateObserved"`
+	DateObservedFrom    string  `json:"dateObservedFrom"`
+	DateObservedTo      string  `json:"dateObservedTo"`
+	Timestamp           string  `json:"timestamp"`
+}
+
+//TopicName returns the name of the topic that this event should be posted to
+func (tfoc *TrafficFlowObservedCreated) TopicName() string {
+	return "events.transportation.trafficflowobservedcreated"
+}
+
+//ContentType returns the content type that this event will be sent as
+func (tfoc *TrafficFlowObservedCreated) ContentType() string {
+	return "application/json"
+}
+
+//RoadSurfaceObservedCreated is an event that notifies that a new road surface observation has
+//been stored, together with the road segment that it was matched to, if any
+type RoadSurfaceObservedCreated struct {
+	ID           string  `json:"id"`
+	RoadSegment  string  `json:"roadSegment,omitempty"`
+	SurfaceType  string  `json:"surfaceType"`
+	Probability  float64 `json:"probability"`
+	Latitude     float64 `json:"latitude"`
+	Longitude    float64 `json:"longitude"`
+	DateObserved string  `json:"dateObserved"`
+	Timestamp    string  `json:"timestamp"`
+}
+
+//TopicName returns the name of the topic that this event should be posted to
+func (rsoc *RoadSurfaceObservedCreated) TopicName() string {
+	return "events.transportation.roadsurfaceobservedcreated"
+}
+
+//ContentType returns the content type that this event will be sent as
+func (rsoc *RoadSurfaceObservedCreated) ContentType() string {
 	return "application/json"
 }
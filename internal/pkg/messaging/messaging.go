@@ -7,9 +7,11 @@ import (
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/diwise/api-transportation/internal/pkg/alerts"
 	"github.com/diwise/api-transportation/internal/pkg/database"
 	"github.com/diwise/api-transportation/internal/pkg/messaging/commands"
 	"github.com/diwise/api-transportation/internal/pkg/messaging/events"
+	"github.com/diwise/api-transportation/internal/pkg/surface"
 	"github.com/diwise/messaging-golang/pkg/messaging"
 	"github.com/streadway/amqp"
 )
@@ -39,7 +41,15 @@ func CreateRoadSegmentSurfaceUpdatedReceiver(db database.Datastore) messaging.To
 			return
 		}
 
-		err = db.RoadSegmentSurfaceUpdated(evt.ID, evt.SurfaceType, evt.Probability, ts)
+		prediction := newSurfacePrediction(evt.SurfaceType, evt.Probability, evt.Distribution, ts)
+		prediction.Provenance = database.Provenance{
+			Source:       evt.Source,
+			Model:        evt.Model,
+			ModelVersion: evt.ModelVersion,
+			Client:       evt.Client,
+		}
+
+		err = db.RoadSegmentSurfacePredictionUpdated(evt.ID, prediction)
 
 		if err != nil {
 			log.Errorf("failed to update road segment surface: %s", err.Error())
@@ -48,8 +58,9 @@ func CreateRoadSegmentSurfaceUpdatedReceiver(db database.Datastore) messaging.To
 	}
 }
 
-//CreateUpdateRoadSegmentSurfaceCommandHandler returns a handler for commands
-func CreateUpdateRoadSegmentSurfaceCommandHandler(db database.Datastore, msg MessagingContext) messaging.CommandHandler {
+//CreateUpdateRoadSegmentSurfaceCommandHandler returns a handler for commands. Commands are only
+//handled by a single replica, so this is also where the alert rules are evaluated.
+func CreateUpdateRoadSegmentSurfaceCommandHandler(db database.Datastore, msg MessagingContext, alertEngine alerts.Engine) messaging.CommandHandler {
 	return func(wrapper messaging.CommandMessageWrapper) error {
 		cmd := &commands.UpdateRoadSegmentSurface{}
 		err := json.Unmarshal(wrapper.Body(), cmd)
@@ -62,20 +73,161 @@ func CreateUpdateRoadSegmentSurfaceCommandHandler(db database.Datastore, msg Mes
 			return fmt.Errorf("failed to parse command timestamp %s", cmd.Timestamp)
 		}
 
-		err = db.UpdateRoadSegmentSurface(cmd.ID, cmd.SurfaceType, cmd.Probability, ts)
+		err = db.SurfaceVocabulary().Validate(cmd.SurfaceType, cmd.Probability)
+		if err == nil && len(cmd.Distribution) > 0 {
+			err = db.SurfaceVocabulary().ValidateDistribution(cmd.Distribution)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid road segment surface: %s", err.Error())
+		}
+
+		prediction := newSurfacePrediction(cmd.SurfaceType, cmd.Probability, cmd.Distribution, ts)
+		prediction.Provenance = database.Provenance{
+			Source:       cmd.Source,
+			Model:        cmd.Model,
+			ModelVersion: cmd.ModelVersion,
+			Client:       cmd.Client,
+		}
+
+		err = db.UpdateRoadSegmentSurfacePrediction(cmd.ID, prediction)
 		if err != nil {
 			return fmt.Errorf("failed to update road segment surface: %s", err.Error())
 		}
 
-		//Post an event stating that a roadsegment's surface has been updated
+		//Post an event stating that a roadsegment's surface has been updated. The event carries the
+		//time of the prediction, so that every replica ages the prediction from when it was made.
 		event := &events.RoadSegmentSurfaceUpdated{
-			ID:          cmd.ID,
-			SurfaceType: cmd.SurfaceType,
-			Probability: cmd.Probability,
-			Timestamp:   time.Now().UTC().Format(time.RFC3339),
+			ID:           cmd.ID,
+			SurfaceType:  prediction.SurfaceType,
+			Probability:  prediction.Probability,
+			Distribution: prediction.Distribution,
+			Timestamp:    ts.UTC().Format(time.RFC3339),
+			Source:       cmd.Source,
+			Model:        cmd.Model,
+			ModelVersion: cmd.ModelVersion,
+			Client:       cmd.Client,
 		}
 		msg.PublishOnTopic(event)
 
+		// The alert rules are evaluated against the prediction that the dataset policy selects
+		// for the segment, which may come from another dataset than the command
+		selected, err := db.SelectRoadSegmentSurfacePrediction(cmd.ID, prediction)
+		if err == nil {
+			err = alertEngine.SurfaceUpdated(newSelectedSurfaceEvent(event, selected))
+		}
+		if err != nil {
+			log.Errorf("failed to evaluate alert rules for road segment %s: %s", cmd.ID, err.Error())
+		}
+
 		return nil
 	}
 }
+
+//newSelectedSurfaceEvent describes the selected surface prediction of a road segment, at the
+//time of an update of one of its datasets
+func newSelectedSurfaceEvent(updated *events.RoadSegmentSurfaceUpdated, selected *database.SurfacePrediction) *events.RoadSegmentSurfaceUpdated {
+	return &events.RoadSegmentSurfaceUpdated{
+		ID:           updated.ID,
+		SurfaceType:  selected.SurfaceType,
+		Probability:  selected.Probability,
+		Distribution: selected.Distribution,
+		Timestamp:    updated.Timestamp,
+		Source:       selected.Provenance.Source,
+		Model:        selected.Provenance.Model,
+		ModelVersion: selected.Provenance.ModelVersion,
+		Client:       selected.Provenance.Client,
+	}
+}
+
+//newSurfacePrediction creates a prediction from the surface type and probability of a command
+//or an event, with the optional distribution of surface types that they were picked from
+func newSurfacePrediction(surfaceType string, probability float64, distribution map[string]float64, timestamp time.Time) database.SurfacePrediction {
+	surfaceType = surface.Normalize(surfaceType)
+
+	if len(distribution) == 0 {
+		return database.NewSurfacePrediction(surfaceType, probability, timestamp)
+	}
+
+	normalized := map[string]float64{}
+	for st, p := range distribution {
+		normalized[surface.Normalize(st)] = p
+	}
+
+	prediction := database.NewSurfacePredictionFromDistribution(normalized, timestamp)
+	prediction.SurfaceType = surfaceType
+	prediction.Probability = probability
+
+	return prediction
+}
+
+//PublishExpiredRoadSegmentSurfaces publishes a RoadSegmentSurfaceExpired event for every road
+//segment with a surface condition that has become stale since the last call, and closes any
+//alerts about the expired conditions. Every replica finds the same expired conditions, so the
+//alerts are only closed by the replica that claims the expiry.
+func PublishExpiredRoadSegmentSurfaces(db database.Datastore, msg MessagingContext, alertEngine alerts.Engine, now time.Time) {
+	for _, segment := range db.ExpireRoadSegmentSurfaces(now) {
+		condition := segment.SurfaceCondition()
+
+		event := &events.RoadSegmentSurfaceExpired{
+			ID:          segment.ID(),
+			SurfaceType: condition.SurfaceType,
+			Probability: condition.Probability,
+			ObservedAt:  condition.Timestamp.UTC().Format(time.RFC3339),
+			Timestamp:   now.UTC().Format(time.RFC3339),
+		}
+
+		err := msg.PublishOnTopic(event)
+		if err != nil {
+			log.Errorf("failed to publish surface expiry of road segment %s: %s", segment.ID(), err.Error())
+		}
+
+		closeExpiredAlerts(db, alertEngine, event)
+	}
+}
+
+func closeExpiredAlerts(db database.Datastore, alertEngine alerts.Engine, event *events.RoadSegmentSurfaceExpired) {
+	key := fmt.Sprintf("%s:%s:%s", event.TopicName(), event.ID, event.ObservedAt)
+
+	claimed, err := db.ClaimMessage(key)
+	if err != nil {
+		log.Errorf("failed to claim surface expiry of road segment %s: %s", event.ID, err.Error())
+		return
+	} else if !claimed {
+		log.Debugf("skipping surface expiry %s that has already been claimed by another replica", key)
+		return
+	}
+
+	err = alertEngine.SurfaceExpired(event)
+	if err != nil {
+		log.Errorf("failed to close alerts for road segment %s: %s", event.ID, err.Error())
+
+		err = db.ReleaseMessage(key)
+		if err != nil {
+			log.Errorf("failed to release surface expiry %s: %s", key, err.Error())
+		}
+	}
+}
+
+//StartRoadSegmentSurfaceExpiryWatcher checks for expired road segment surface conditions at
+//the given interval, until the returned stop function is called. The first check also reports
+//the conditions that became stale while the service was down.
+func StartRoadSegmentSurfaceExpiryWatcher(db database.Datastore, msg MessagingContext, alertEngine alerts.Engine, interval time.Duration) func() {
+	ticker := time.NewTicker(interval)
+	done := make(chan bool)
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case t := <-ticker.C:
+				PublishExpiredRoadSegmentSurfaces(db, msg, alertEngine, t.UTC())
+			}
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		done <- true
+	}
+}
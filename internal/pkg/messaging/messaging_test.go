@@ -0,0 +1,156 @@
+package messaging_test
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diwise/api-transportation/internal/pkg/alerts"
+	"github.com/diwise/api-transportation/internal/pkg/database"
+	intmsg "github.com/diwise/api-transportation/internal/pkg/messaging"
+	"github.com/diwise/api-transportation/internal/pkg/messaging/commands"
+	"github.com/diwise/api-transportation/internal/pkg/messaging/events"
+	"github.com/diwise/messaging-golang/pkg/messaging"
+	"github.com/streadway/amqp"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"github.com/matryer/is"
+)
+
+func TestThatAlertsFollowTheSurfacePredictionSelectedByTheDatasetPolicy(t *testing.T) {
+	is := is.New(t)
+
+	os.Setenv("TRANSPORTATION_DATASET_POLICY", "confidence")
+	defer os.Unsetenv("TRANSPORTATION_DATASET_POLICY")
+
+	db, err := database.NewDatabaseConnection(database.NewSQLiteConnector(), strings.NewReader(seedData))
+	is.NoErr(err)
+
+	config, err := alerts.NewConfiguration("ice:high", 0.7)
+	is.NoErr(err)
+
+	// Surface updates are published to every replica, this one included
+	msg := &messagingMock{receiver: intmsg.CreateRoadSegmentSurfaceUpdatedReceiver(db)}
+	handler := intmsg.CreateUpdateRoadSegmentSurfaceCommandHandler(db, msg, alerts.NewEngine(db, msg, *config))
+
+	now := time.Now().UTC()
+	camera := updateSurface("ice", 0.9, "roadcam", now.Add(-time.Minute))
+	is.NoErr(handler(&commandWrapper{body: camera}))
+
+	active, err := db.GetActiveAlertForSegment("21277:153930")
+	is.NoErr(err)
+	is.True(active != nil) // the ice predicted by the camera should issue an alert
+
+	friction := updateSurface("dry", 0.8, "friction", now)
+	is.NoErr(handler(&commandWrapper{body: friction}))
+
+	active, err = db.GetActiveAlertForSegment("21277:153930")
+	is.NoErr(err)
+	is.True(active != nil) // the less confident friction dataset should not clear the alert
+
+	alertUpdates := 0
+	for _, event := range msg.events {
+		if _, ok := event.(*events.AlertUpdated); ok {
+			alertUpdates++
+		}
+	}
+	is.Equal(alertUpdates, 1) // only the issued alert should have been published
+}
+
+func TestThatSurfaceUpdatesArePublishedWithTheTimeOfThePrediction(t *testing.T) {
+	is := is.New(t)
+
+	db, err := database.NewDatabaseConnection(database.NewSQLiteConnector(), strings.NewReader(seedData))
+	is.NoErr(err)
+
+	config, err := alerts.NewConfiguration("ice:high", 0.7)
+	is.NoErr(err)
+
+	msg := &messagingMock{receiver: intmsg.CreateRoadSegmentSurfaceUpdatedReceiver(db)}
+	handler := intmsg.CreateUpdateRoadSegmentSurfaceCommandHandler(db, msg, alerts.NewEngine(db, msg, *config))
+
+	observedAt := time.Now().UTC().Add(-2 * time.Hour).Truncate(time.Second)
+	is.NoErr(handler(&commandWrapper{body: updateSurface("snow", 0.9, "roadcam", observedAt)}))
+
+	is.Equal(len(msg.events), 1)
+	updated := msg.events[0].(*events.RoadSegmentSurfaceUpdated)
+	is.Equal(updated.Timestamp, observedAt.Format(time.RFC3339)) // a late prediction should not be published as a new one
+}
+
+func TestThatExpiredAlertsAreOnlyClosedByOneReplica(t *testing.T) {
+	is := is.New(t)
+
+	dbfile := t.TempDir() + "/transportation.db"
+	connector := func() (*gorm.DB, error) {
+		return gorm.Open(sqlite.Open(dbfile), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	}
+
+	setup, err := database.NewDatabaseConnection(connector, strings.NewReader(seedData))
+	is.NoErr(err)
+
+	now := time.Now().UTC()
+	stale := now.Add(-13 * time.Hour)
+	is.NoErr(setup.UpdateRoadSegmentSurface("21277:153930", "ice", 0.9, stale))
+
+	// Both replicas restore the stale ice from the database
+	db, err := database.NewDatabaseConnection(connector, strings.NewReader(seedData))
+	is.NoErr(err)
+	replica, err := database.NewDatabaseConnection(connector, strings.NewReader(seedData))
+	is.NoErr(err)
+
+	config, err := alerts.NewConfiguration("ice:high", 0.7)
+	is.NoErr(err)
+
+	msg := &messagingMock{}
+	engine := alerts.NewEngine(db, msg, *config)
+	iced := func(timestamp time.Time) *events.RoadSegmentSurfaceUpdated {
+		return &events.RoadSegmentSurfaceUpdated{ID: "21277:153930", SurfaceType: "ice", Probability: 0.9, Timestamp: timestamp.Format(time.RFC3339)}
+	}
+
+	is.NoErr(engine.SurfaceUpdated(iced(stale)))
+	intmsg.PublishExpiredRoadSegmentSurfaces(db, msg, engine, now)
+
+	// New ice issues a new alert before the other replica gets to check for expired conditions
+	is.NoErr(engine.SurfaceUpdated(iced(now)))
+	intmsg.PublishExpiredRoadSegmentSurfaces(replica, msg, alerts.NewEngine(replica, msg, *config), now)
+
+	active, err := db.GetActiveAlertForSegment("21277:153930")
+	is.NoErr(err)
+	is.True(active != nil) // the expiry of the stale ice should only be handled once
+}
+
+func updateSurface(surfaceType string, probability float64, model string, timestamp time.Time) []byte {
+	body, _ := json.Marshal(&commands.UpdateRoadSegmentSurface{
+		ID:          "21277:153930",
+		SurfaceType: surfaceType,
+		Probability: probability,
+		Timestamp:   timestamp.Format(time.RFC3339),
+		Source:      database.SourceModel,
+		Model:       model,
+	})
+	return body
+}
+
+type messagingMock struct {
+	events   []messaging.TopicMessage
+	receiver messaging.TopicMessageHandler
+}
+
+func (m *messagingMock) PublishOnTopic(message messaging.TopicMessage) error {
+	m.events = append(m.events, message)
+
+	if _, ok := message.(*events.RoadSegmentSurfaceUpdated); ok {
+		body, _ := json.Marshal(message)
+		m.receiver(amqp.Delivery{RoutingKey: message.TopicName(), Body: body})
+	}
+
+	return nil
+}
+
+func (m *messagingMock) NoteToSelf(message messaging.CommandMessage) error {
+	return nil
+}
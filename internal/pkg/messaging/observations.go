@@ -0,0 +1,125 @@
+package messaging
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/diwise/api-transportation/internal/pkg/database"
+	"github.com/diwise/messaging-golang/pkg/messaging"
+	ngsi "github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld"
+	"github.com/streadway/amqp"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	//TrafficFlowObservedTopic is the topic that sensor pipelines can publish TrafficFlowObserved
+	//entities on, instead of posting them to the NGSI-LD API
+	TrafficFlowObservedTopic string = "observations.transportation.trafficflowobserved"
+	//RoadSurfaceObservedTopic is the topic that sensor pipelines can publish RoadSurfaceObserved
+	//entities on, instead of posting them to the NGSI-LD API
+	RoadSurfaceObservedTopic string = "observations.transportation.roadsurfaceobserved"
+)
+
+//EntityCreator is an interface that allows mocking of the context source that validates and
+//stores the entities that are posted to the NGSI-LD API
+type EntityCreator interface {
+	CreateEntity(typeName, entityID string, req ngsi.Request) error
+}
+
+//CreateObservationCommandHandler returns a handler for commands that carry an observation of
+//the given type. Commands are only handled by a single replica, and the observation is stored
+//just as if it had been posted to the NGSI-LD API.
+func CreateObservationCommandHandler(creator EntityCreator, typeName string) messaging.CommandHandler {
+	return func(wrapper messaging.CommandMessageWrapper) error {
+		return createObservation(creator, typeName, wrapper.Body())
+	}
+}
+
+//CreateObservationReceiver returns a handler for observations of the given type that are published
+//on a topic. Every replica receives the messages on a topic, so a replica has to claim a message
+//before it stores the observation that the message carries. The claim is released again if the
+//observation could not be stored.
+func CreateObservationReceiver(db database.Datastore, creator EntityCreator, typeName string) messaging.TopicMessageHandler {
+	return func(msg amqp.Delivery) {
+		key := messageKey(msg)
+
+		claimed, err := db.ClaimMessage(key)
+		if err != nil {
+			log.Errorf("failed to claim message from topic %s: %s", msg.RoutingKey, err.Error())
+			return
+		} else if !claimed {
+			log.Debugf("skipping message %s that has already been claimed by another replica", key)
+			return
+		}
+
+		err = createObservation(creator, typeName, msg.Body)
+		if err != nil {
+			log.Errorf("failed to create %s from topic %s: %s", typeName, msg.RoutingKey, err.Error())
+
+			err = db.ReleaseMessage(key)
+			if err != nil {
+				log.Errorf("failed to release message %s: %s", key, err.Error())
+			}
+		}
+	}
+}
+
+//messageKey identifies a message by its id, or by the digest of its body if the publisher did
+//not give it an id
+func messageKey(msg amqp.Delivery) string {
+	if msg.MessageId != "" {
+		return msg.RoutingKey + ":" + msg.MessageId
+	}
+
+	digest := sha256.Sum256(msg.Body)
+	return msg.RoutingKey + ":" + hex.EncodeToString(digest[:])
+}
+
+func createObservation(creator EntityCreator, typeName string, body []byte) error {
+	entity := struct {
+		Type string `json:"type"`
+	}{}
+
+	err := json.Unmarshal(body, &entity)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal observation: %s", err.Error())
+	}
+
+	if entity.Type != typeName {
+		return fmt.Errorf("expected an entity of type %s, not %s", typeName, entity.Type)
+	}
+
+	return creator.CreateEntity(typeName, "", newEntityRequest(body))
+}
+
+//entityRequest wraps the body of a message as the request that would have posted it to the
+//NGSI-LD API
+type entityRequest struct {
+	request *http.Request
+	body    []byte
+}
+
+func newEntityRequest(body []byte) ngsi.Request {
+	req, _ := http.NewRequest(http.MethodPost, "/ngsi-ld/v1/entities", bytes.NewReader(body))
+	req.Header.Add("Content-Type", "application/ld+json")
+
+	return &entityRequest{request: req, body: body}
+}
+
+func (r *entityRequest) BodyReader() io.Reader {
+	return bytes.NewReader(r.body)
+}
+
+func (r *entityRequest) DecodeBodyInto(v interface{}) error {
+	return json.Unmarshal(r.body, v)
+}
+
+func (r *entityRequest) Request() *http.Request {
+	return r.request
+}
@@ -0,0 +1,95 @@
+package messaging_test
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/diwise/api-transportation/internal/pkg/database"
+	fiwarecontext "github.com/diwise/api-transportation/internal/pkg/fiware/context"
+	intmsg "github.com/diwise/api-transportation/internal/pkg/messaging"
+	"github.com/diwise/messaging-golang/pkg/messaging"
+	"github.com/diwise/ngsi-ld-golang/pkg/datamodels/diwise"
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+
+	"github.com/matryer/is"
+)
+
+func TestMain(m *testing.M) {
+	log.SetFormatter(&log.JSONFormatter{})
+	os.Exit(m.Run())
+}
+
+const seedData string = "21277:153930;21277:153930;62.389109;17.310863;62.389084;17.310852\n"
+
+const trafficFlow string = `{"type":"TrafficFlowObserved","dateObserved":{"type":"Property","value":"2016-12-07T11:10:00Z"},` +
+	`"laneID":{"type":"Property","value":1},"intensity":{"type":"Property","value":12}}`
+
+func TestThatObservationsFromATopicAreOnlyStoredByOneReplica(t *testing.T) {
+	is := is.New(t)
+
+	db, err := database.NewDatabaseConnection(database.NewSQLiteConnector(), strings.NewReader(seedData))
+	is.NoErr(err)
+
+	// Every replica receives the message, but they share the datastore
+	for replica := 0; replica < 3; replica++ {
+		receiver := intmsg.CreateObservationReceiver(db, fiwarecontext.CreateSource(db, nil, nil), "TrafficFlowObserved")
+		receiver(amqp.Delivery{RoutingKey: intmsg.TrafficFlowObservedTopic, Body: []byte(trafficFlow)})
+	}
+
+	count, err := db.CountTrafficFlowsObserved(database.ObservationQuery{})
+	is.NoErr(err)
+	is.Equal(count, uint64(1)) // the observation should only be stored once
+}
+
+func TestThatMessagesAreReleasedWhenTheirObservationCanNotBeStored(t *testing.T) {
+	is := is.New(t)
+
+	db, err := database.NewDatabaseConnection(database.NewSQLiteConnector(), strings.NewReader(seedData))
+	is.NoErr(err)
+
+	outOfBounds, _ := json.Marshal(diwise.NewRoadSurfaceObserved("far", "snow", 0.75, 12.0, 17.310863))
+	receiver := intmsg.CreateObservationReceiver(db, fiwarecontext.CreateSource(db, nil, nil), "RoadSurfaceObserved")
+	receiver(amqp.Delivery{RoutingKey: intmsg.RoadSurfaceObservedTopic, MessageId: "rso-1", Body: outOfBounds})
+
+	claimed, err := db.ClaimMessage(intmsg.RoadSurfaceObservedTopic + ":rso-1")
+	is.NoErr(err)
+	is.True(claimed) // the failed message should not stay claimed
+}
+
+func TestThatObservationCommandsAreValidatedAndStored(t *testing.T) {
+	is := is.New(t)
+
+	db, err := database.NewDatabaseConnection(database.NewSQLiteConnector(), strings.NewReader(seedData))
+	is.NoErr(err)
+	ctxSource := fiwarecontext.CreateSource(db, nil, nil)
+
+	rso, _ := json.Marshal(diwise.NewRoadSurfaceObserved("rso", "snow", 0.75, 62.389109, 17.310863))
+	handler := intmsg.CreateObservationCommandHandler(ctxSource, "RoadSurfaceObserved")
+	is.NoErr(handler(&commandWrapper{body: rso}))
+
+	surfaces, err := db.QueryRoadSurfacesObserved(database.ObservationQuery{})
+	is.NoErr(err)
+	is.Equal(len(surfaces), 1)
+	is.Equal(surfaces[0].SurfaceType, "snow")
+
+	outOfBounds, _ := json.Marshal(diwise.NewRoadSurfaceObserved("far", "snow", 0.75, 12.0, 17.310863))
+	is.True(handler(&commandWrapper{body: outOfBounds}) != nil) // observations should be validated as if they were posted
+
+	handler = intmsg.CreateObservationCommandHandler(ctxSource, "TrafficFlowObserved")
+	is.True(handler(&commandWrapper{body: rso}) != nil) // the entity should be of the expected type
+}
+
+type commandWrapper struct {
+	body []byte
+}
+
+func (w *commandWrapper) Body() []byte {
+	return w.body
+}
+
+func (w *commandWrapper) RespondWith(messaging.CommandMessage) error {
+	return nil
+}
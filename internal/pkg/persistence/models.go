@@ -19,6 +19,20 @@ type RoadSegment struct {
 	SegmentID              string `gorm:"unique"`
 	RoadID                 uint
 	SurfaceTypePredictions []SurfaceTypePrediction
+	// MaximumAllowedSpeed is the speed limit of the segment in km/h, if known
+	MaximumAllowedSpeed *float64
+}
+
+//RoadSegmentCongestion is the most recent congestion level of a road segment, decided from the
+//traffic flows that were observed on it during a window that ended at ObservedAt
+type RoadSegmentCongestion struct {
+	gorm.Model
+	SegmentID           string `gorm:"unique"`
+	Level               string
+	AverageVehicleSpeed float64
+	SpeedRatio          float64
+	Intensity           int
+	ObservedAt          time.Time
 }
 
 //SurfaceTypePrediction is a model for a temporary table until a better schema is designed
@@ -28,9 +42,55 @@ type SurfaceTypePrediction struct {
 	SurfaceType   string
 	Probability   float64
 	Timestamp     time.Time
+	Distribution  []SurfaceTypeProbability
+
+	// Source, ModelName, ModelVersion and Client describe where the prediction came from
+	Source       string
+	ModelName    string
+	ModelVersion string
+	Client       string
+}
+
+//SurfaceTypeProbability is the probability of one of the surface types in a prediction
+type SurfaceTypeProbability struct {
+	gorm.Model
+	SurfaceTypePredictionID uint
+	SurfaceType             string
+	Probability             float64
+}
+
+//SurfaceLabel is a verified ground-truth surface type of a road segment at a certain time,
+//e.g. from an inspection or a confirmation by a plow driver
+type SurfaceLabel struct {
+	gorm.Model
+	RoadSegmentID uint
+	SurfaceType   string
+	Timestamp     time.Time
+	Source        string
+	Client        string
+}
+
+//Alert is a warning about a hazardous surface on a road segment. The location of an alert is
+//the middle of the segment, and ValidTo is set when the alert is closed.
+type Alert struct {
+	gorm.Model
+	AlertID     string `gorm:"unique"`
+	SegmentID   string
+	Status      string
+	SubCategory string
+	Severity    string
+	Description string
+	SurfaceType string
+	Probability float64
+	Latitude    float64
+	Longitude   float64
+	DateIssued  time.Time
+	ValidFrom   time.Time
+	ValidTo     *time.Time
 }
 
-//RoadSurfaceObserved is a model for a temporary table until a better schema is designed
+//RoadSurfaceObserved is a model for a temporary table until a better schema is designed.
+//Timestamp holds the time of the observation, and CreatedAt the time it was stored.
 type RoadSurfaceObserved struct {
 	gorm.Model
 	RoadSegmentID         uint
@@ -46,12 +106,90 @@ type TrafficFlowObserved struct {
 	gorm.Model
 	TrafficFlowObservedID string
 	DateObserved          time.Time
-	DateObservedTo        time.Time
+	DateObservedTo        time.Time `gorm:"uniqueIndex:idx_traffic_flow_natural_key"`
+	DateObservedFrom      time.Time `gorm:"uniqueIndex:idx_traffic_flow_natural_key"`
+	Latitude              float64
+	Longitude             float64
+	LaneID                int `gorm:"uniqueIndex:idx_traffic_flow_natural_key"`
+	AverageVehicleSpeed   float64
+	Intensity             int
+	RoadSegmentID         uint
+	// SegmentID is the identity of the road segment that RoadSegmentID refers to. It is not
+	// persisted, but filled in when observations are queried.
+	SegmentID string `gorm:"-"`
+	// SourceDevice is nil when the device is unknown, which leaves the observation out of the
+	// natural key since NULLs never collide in a unique index
+	SourceDevice *string `gorm:"uniqueIndex:idx_traffic_flow_natural_key"`
+	// Duplicates counts how many times the observation has been received again and updated
+	Duplicates int
+
+	// The remaining Smart Data Models attributes are optional, hence the pointers
+	Occupancy            *float64
+	Congested            *bool
+	AverageHeadwayTime   *float64
+	AverageGapDistance   *float64
+	AverageVehicleLength *float64
+	VehicleType          string
+	VehicleSubType       string
+	LaneDirection        string
+	ReversedLane         *bool
+}
+
+//TrafficFlowAnomaly is a traffic flow observation that deviated strongly from the baseline of
+//its road segment and lane at that hour of the week
+type TrafficFlowAnomaly struct {
+	gorm.Model
+	TrafficFlowObservedID string `gorm:"unique"`
+	SegmentID             string
+	LaneID                int
+	DateObserved          time.Time
+	Kind                  string
+	Intensity             int
+	Expected              float64
+	StdDev                float64
+	Score                 float64
+	Samples               int
+}
+
+//HourlyTrafficFlowObserved summarizes the raw traffic flow observations of a lane at a location
+//during one hour, after the raw observations have been purged by the retention policy
+type HourlyTrafficFlowObserved struct {
+	gorm.Model
+	TrafficFlowObservedID string `gorm:"unique"`
 	DateObservedFrom      time.Time
+	DateObservedTo        time.Time
 	Latitude              float64
 	Longitude             float64
 	LaneID                int
-	AverageVehicleSpeed   float64
+	RoadSegmentID         uint
+	SourceDevice          *string
+	Observations          int
 	Intensity             int
+	AverageVehicleSpeed   float64
+	// SpeedIntensity is the intensity of the observations that had an average vehicle speed,
+	// which is needed to weigh the average speed when more observations are added to the hour
+	SpeedIntensity int
+}
+
+//HourlyRoadSurfaceObserved summarizes the raw road surface observations of a surface type
+//within a small area during one hour, after the raw observations have been purged by the
+//retention policy. The location is the mean location of the observations.
+type HourlyRoadSurfaceObserved struct {
+	gorm.Model
+	RoadSurfaceObservedID string `gorm:"unique"`
 	RoadSegmentID         uint
+	SurfaceType           string
+	Timestamp             time.Time
+	Latitude              float64
+	Longitude             float64
+	Observations          int
+	Probability           float64
+}
+
+//MessageClaim records that a replica of the service has taken on a message from a topic. Every
+//replica receives the messages that are published on a topic, but only the replica that manages
+//to claim a message handles it.
+type MessageClaim struct {
+	gorm.Model
+	MessageKey string `gorm:"unique"`
 }
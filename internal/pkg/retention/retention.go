@@ -0,0 +1,123 @@
+package retention
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/diwise/api-transportation/internal/pkg/database"
+	"github.com/diwise/api-transportation/internal/pkg/env"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//Config holds the retention policy for stored observations
+type Config struct {
+	// Interval is how often the retention policy is applied
+	Interval time.Duration
+	// Raw is how long raw observations are kept before they are rolled up into hourly aggregates
+	Raw time.Duration
+	// Aggregates is how long the hourly aggregates are kept
+	Aggregates time.Duration
+}
+
+//messageClaimRetention is how long the claims on messages from topics are kept. Messages are
+//delivered to every replica at about the same time, so a day leaves plenty of margin.
+const messageClaimRetention time.Duration = 24 * time.Hour
+
+//LoadConfiguration reads the retention policy from the environment, falling back to keeping raw
+//observations for 90 days and hourly aggregates for five years, applied once an hour
+func LoadConfiguration() (*Config, error) {
+	interval, err := time.ParseDuration(env.GetVariableOrDefault("TRANSPORTATION_RETENTION_INTERVAL", "1h"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse retention interval: %s", err.Error())
+	}
+
+	raw, err := time.ParseDuration(env.GetVariableOrDefault("TRANSPORTATION_RETENTION_RAW", "2160h"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse raw retention: %s", err.Error())
+	}
+
+	aggregates, err := time.ParseDuration(env.GetVariableOrDefault("TRANSPORTATION_RETENTION_AGGREGATES", "43800h"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse aggregate retention: %s", err.Error())
+	}
+
+	return NewConfiguration(interval, raw, aggregates)
+}
+
+//NewConfiguration validates a retention policy
+func NewConfiguration(interval, raw, aggregates time.Duration) (*Config, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("the retention interval must be positive")
+	}
+
+	// Raw observations are rolled up by the hour, so they must be kept until their hour has passed
+	if raw < time.Hour {
+		return nil, fmt.Errorf("raw observations must be kept for at least an hour")
+	}
+
+	if aggregates < raw {
+		return nil, fmt.Errorf("aggregates must be kept at least as long as raw observations")
+	}
+
+	return &Config{Interval: interval, Raw: raw, Aggregates: aggregates}, nil
+}
+
+//Apply rolls the raw observations that are older than the retention policy allows up into hourly
+//aggregates, and deletes the aggregates and message claims that are too old to be kept
+func Apply(db database.Datastore, config Config, now time.Time) error {
+	// Only whole hours are rolled up, so that aggregates are never split between runs
+	rawBefore := now.Add(-config.Raw).UTC().Truncate(time.Hour)
+
+	trafficFlows, err := db.DownsampleTrafficFlowsObserved(rawBefore)
+	if err != nil {
+		return fmt.Errorf("failed to downsample traffic flows: %s", err.Error())
+	}
+
+	roadSurfaces, err := db.DownsampleRoadSurfacesObserved(rawBefore)
+	if err != nil {
+		return fmt.Errorf("failed to downsample road surfaces: %s", err.Error())
+	}
+
+	aggregates, err := db.PurgeObservationAggregates(now.Add(-config.Aggregates).UTC())
+	if err != nil {
+		return fmt.Errorf("failed to purge aggregates: %s", err.Error())
+	}
+
+	_, err = db.PurgeMessageClaims(now.Add(-messageClaimRetention).UTC())
+	if err != nil {
+		return fmt.Errorf("failed to purge message claims: %s", err.Error())
+	}
+
+	if trafficFlows+roadSurfaces+aggregates > 0 {
+		log.Infof("rolled up %d traffic flows and %d road surfaces observed before %s, and purged %d aggregates",
+			trafficFlows, roadSurfaces, rawBefore.Format(time.RFC3339), aggregates)
+	}
+
+	return nil
+}
+
+//StartJob applies the retention policy at the configured interval, until the returned stop
+//function is called
+func StartJob(db database.Datastore, config Config) func() {
+	ticker := time.NewTicker(config.Interval)
+	done := make(chan bool)
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case t := <-ticker.C:
+				if err := Apply(db, config, t); err != nil {
+					log.Errorf("failed to apply the retention policy: %s", err.Error())
+				}
+			}
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		done <- true
+	}
+}
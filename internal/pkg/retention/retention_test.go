@@ -0,0 +1,55 @@
+package retention_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/diwise/api-transportation/internal/pkg/database"
+	"github.com/diwise/api-transportation/internal/pkg/retention"
+	"github.com/diwise/ngsi-ld-golang/pkg/datamodels/fiware"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/matryer/is"
+)
+
+func TestMain(m *testing.M) {
+	log.SetFormatter(&log.JSONFormatter{})
+	os.Exit(m.Run())
+}
+
+func TestThatObservationsOlderThanTheRawRetentionAreRolledUp(t *testing.T) {
+	is := is.New(t)
+
+	db, err := database.NewDatabaseConnection(database.NewSQLiteConnector(), nil)
+	is.NoErr(err)
+
+	now := time.Date(2021, 11, 10, 12, 30, 0, 0, time.UTC)
+
+	for _, observedAt := range []string{"2021-11-01T10:10:00Z", "2021-11-01T10:50:00Z", "2021-11-09T12:10:00Z"} {
+		_, err := db.CreateTrafficFlowObserved(fiware.NewTrafficFlowObserved(observedAt, observedAt, 1, 10))
+		is.NoErr(err)
+	}
+
+	config, err := retention.NewConfiguration(time.Hour, 7*24*time.Hour, 365*24*time.Hour)
+	is.NoErr(err)
+	is.NoErr(retention.Apply(db, *config, now))
+
+	tfos, err := db.QueryTrafficFlowsObserved(database.ObservationQuery{})
+	is.NoErr(err)
+	is.Equal(len(tfos), 2)          // the old observations should be rolled up into one aggregate
+	is.Equal(tfos[0].Intensity, 20) // unexpected intensity of the aggregate
+
+	count, _ := db.CountTrafficFlowsObserved(database.ObservationQuery{
+		From: time.Date(2021, 11, 1, 0, 0, 0, 0, time.UTC),
+		To:   time.Date(2021, 11, 2, 0, 0, 0, 0, time.UTC),
+	})
+	is.Equal(count, uint64(1)) // temporal queries for old ranges should fall back to the aggregate
+}
+
+func TestThatAggregatesMustOutliveRawObservations(t *testing.T) {
+	is := is.New(t)
+
+	_, err := retention.NewConfiguration(time.Hour, 30*24*time.Hour, 7*24*time.Hour)
+	is.True(err != nil) // aggregates that are purged before the raw observations are useless
+}
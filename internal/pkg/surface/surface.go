@@ -0,0 +1,190 @@
+package surface
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/diwise/api-transportation/internal/pkg/env"
+)
+
+const (
+	//Material is the kind of surface types that describe what a road is paved with
+	Material = "material"
+	//Condition is the kind of surface types that describe the current, weather dependent,
+	//state of a road's surface
+	Condition = "condition"
+
+	//Unknown is the surface type that is reported for conditions that have become stale
+	Unknown = "unknown"
+)
+
+//DefaultMaterials is the list of surface materials that is used if none are configured
+const DefaultMaterials string = "asphalt,cobblestone,concrete,grass,gravel,tarmac"
+
+//DefaultConditions is the list of surface conditions that is used if none are configured
+const DefaultConditions string = "dry,frost,ice,slush,snow,wet"
+
+//Vocabulary holds the surface types that are known to the service, divided into
+//surface materials and surface conditions
+type Vocabulary struct {
+	kinds map[string]string
+}
+
+//LoadVocabulary creates a vocabulary from the comma separated lists of surface types in the
+//environment variables TRANSPORTATION_SURFACE_MATERIALS and TRANSPORTATION_SURFACE_CONDITIONS
+func LoadVocabulary() (*Vocabulary, error) {
+	return NewVocabulary(
+		strings.Split(env.GetVariableOrDefault("TRANSPORTATION_SURFACE_MATERIALS", DefaultMaterials), ","),
+		strings.Split(env.GetVariableOrDefault("TRANSPORTATION_SURFACE_CONDITIONS", DefaultConditions), ","),
+	)
+}
+
+//NewVocabulary creates a vocabulary from lists of surface materials and conditions. A surface
+//type may not be both a material and a condition.
+func NewVocabulary(materials, conditions []string) (*Vocabulary, error) {
+	v := &Vocabulary{kinds: map[string]string{}}
+
+	for _, m := range materials {
+		if err := v.add(m, Material); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, c := range conditions {
+		if err := v.add(c, Condition); err != nil {
+			return nil, err
+		}
+	}
+
+	return v, nil
+}
+
+func (v *Vocabulary) add(surfaceType, kind string) error {
+	surfaceType = Normalize(surfaceType)
+	if surfaceType == "" {
+		return nil
+	}
+
+	if existingKind, ok := v.kinds[surfaceType]; ok && existingKind != kind {
+		return fmt.Errorf("surface type %s can not be both a %s and a %s", surfaceType, existingKind, kind)
+	}
+
+	v.kinds[surfaceType] = kind
+	return nil
+}
+
+//Normalize returns the canonical form of a surface type
+func Normalize(surfaceType string) string {
+	return strings.ToLower(strings.TrimSpace(surfaceType))
+}
+
+//Kind returns the kind of a surface type, Material or Condition, or an empty string if
+//the surface type is unknown
+func (v *Vocabulary) Kind(surfaceType string) string {
+	return v.kinds[Normalize(surfaceType)]
+}
+
+//Validate returns an error if the surface type is unknown, or if the probability is not
+//within the range (0, 1.0]
+func (v *Vocabulary) Validate(surfaceType string, probability float64) error {
+	if v.Kind(surfaceType) == "" {
+		return fmt.Errorf("surfaceType %s does not match any known types", surfaceType)
+	}
+
+	if probability <= 0 || probability > 1 {
+		return fmt.Errorf("probability %f is not within acceptable range: (0, 1.0]", probability)
+	}
+
+	return nil
+}
+
+//ValidateDistribution returns an error if any of the surface types in a distribution is
+//unknown or has an invalid probability, or if the probabilities sum to more than one
+func (v *Vocabulary) ValidateDistribution(distribution map[string]float64) error {
+	sum := 0.0
+
+	for surfaceType, probability := range distribution {
+		if err := v.Validate(surfaceType, probability); err != nil {
+			return err
+		}
+		sum += probability
+	}
+
+	// Allow for some rounding errors in the classifiers' output
+	if sum > 1.001 {
+		return fmt.Errorf("probabilities of the surface type distribution sum to %f, which is more than 1.0", sum)
+	}
+
+	return nil
+}
+
+//MostProbable returns the most probable surface type in a distribution. Ties are broken by
+//the name of the surface type to keep the result deterministic.
+func MostProbable(distribution map[string]float64) (string, float64) {
+	surfaceType, probability := "", 0.0
+
+	for st, p := range distribution {
+		if p > probability || (p == probability && st < surfaceType) {
+			surfaceType, probability = st, p
+		}
+	}
+
+	return surfaceType, probability
+}
+
+//Freshness describes how predictions of transient surface conditions lose confidence over
+//time. Surface materials are considered permanent and are not affected.
+type Freshness struct {
+	// HalfLife is the time it takes for the probability of a condition to be halved
+	HalfLife time.Duration
+	// MaxAge is the age after which a condition is considered stale and unknown
+	MaxAge time.Duration
+}
+
+//LoadFreshness reads the half-life and max age of surface conditions from the environment
+//variables TRANSPORTATION_SURFACE_HALF_LIFE and TRANSPORTATION_SURFACE_MAX_AGE. A zero
+//duration disables decay or expiry respectively.
+func LoadFreshness() (*Freshness, error) {
+	halfLife, err := time.ParseDuration(env.GetVariableOrDefault("TRANSPORTATION_SURFACE_HALF_LIFE", "2h"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse surface half-life: %s", err.Error())
+	}
+
+	maxAge, err := time.ParseDuration(env.GetVariableOrDefault("TRANSPORTATION_SURFACE_MAX_AGE", "12h"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse surface max age: %s", err.Error())
+	}
+
+	return &Freshness{HalfLife: halfLife, MaxAge: maxAge}, nil
+}
+
+//EffectiveProbability returns the probability of a prediction of a given kind, made at a
+//certain time, after it has decayed until now
+func (f *Freshness) EffectiveProbability(kind string, probability float64, timestamp, now time.Time) float64 {
+	if f.IsStale(kind, timestamp, now) {
+		return 0
+	}
+
+	if kind == Material || f.HalfLife <= 0 {
+		return probability
+	}
+
+	age := now.Sub(timestamp)
+	if age <= 0 {
+		return probability
+	}
+
+	return probability * math.Pow(0.5, float64(age)/float64(f.HalfLife))
+}
+
+//IsStale returns true if a prediction of a given kind, made at a certain time, has become
+//too old to be trusted
+func (f *Freshness) IsStale(kind string, timestamp, now time.Time) bool {
+	if kind == Material || f.MaxAge <= 0 {
+		return false
+	}
+
+	return now.Sub(timestamp) > f.MaxAge
+}
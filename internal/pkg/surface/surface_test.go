@@ -0,0 +1,65 @@
+package surface_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/diwise/api-transportation/internal/pkg/surface"
+	"github.com/matryer/is"
+)
+
+func TestThatDefaultVocabularySeparatesMaterialsFromConditions(t *testing.T) {
+	is := is.New(t)
+
+	v, err := surface.LoadVocabulary()
+	is.NoErr(err)
+
+	is.Equal(v.Kind("asphalt"), surface.Material)
+	is.Equal(v.Kind("Ice"), surface.Condition)
+	is.Equal(v.Kind("lava"), "") // unknown surface types should not have a kind
+}
+
+func TestThatValidateRejectsUnknownTypesAndBadProbabilities(t *testing.T) {
+	is := is.New(t)
+
+	v, _ := surface.NewVocabulary([]string{"tarmac"}, []string{"slush"})
+
+	is.NoErr(v.Validate("slush", 0.5))
+	is.True(v.Validate("snow", 0.5) != nil)   // snow is not part of this vocabulary
+	is.True(v.Validate("tarmac", 0) != nil)   // a probability of zero should be rejected
+	is.True(v.Validate("tarmac", 1.5) != nil) // a probability above one should be rejected
+}
+
+func TestThatVocabularyCanBeConfiguredFromTheEnvironment(t *testing.T) {
+	is := is.New(t)
+
+	os.Setenv("TRANSPORTATION_SURFACE_CONDITIONS", "dry,aquaplaning")
+	defer os.Unsetenv("TRANSPORTATION_SURFACE_CONDITIONS")
+
+	v, err := surface.LoadVocabulary()
+	is.NoErr(err)
+	is.Equal(v.Kind("aquaplaning"), surface.Condition)
+	is.Equal(v.Kind("snow"), "") // snow should no longer be a known condition
+}
+
+func TestThatASurfaceTypeCanNotBeBothMaterialAndCondition(t *testing.T) {
+	is := is.New(t)
+
+	_, err := surface.NewVocabulary([]string{"gravel"}, []string{"gravel"})
+	is.True(err != nil) // expected an error for an ambiguous surface type
+}
+
+func TestThatConditionsDecayAndExpireButMaterialsDoNot(t *testing.T) {
+	is := is.New(t)
+
+	f := &surface.Freshness{HalfLife: time.Hour, MaxAge: 3 * time.Hour}
+	now := time.Now()
+
+	is.Equal(f.EffectiveProbability(surface.Condition, 0.8, now.Add(-time.Hour), now), 0.4) // expected the probability to be halved after one half-life
+	is.Equal(f.EffectiveProbability(surface.Condition, 0.8, now.Add(-4*time.Hour), now), 0.0)
+	is.True(f.IsStale(surface.Condition, now.Add(-4*time.Hour), now)) // expected the condition to have expired
+
+	is.Equal(f.EffectiveProbability(surface.Material, 0.8, now.Add(-4*time.Hour), now), 0.8) // materials should not decay
+	is.True(!f.IsStale(surface.Material, now.Add(-4*time.Hour), now))                        // materials should never expire
+}
@@ -0,0 +1,130 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/diwise/api-transportation/internal/pkg/accuracy"
+	"github.com/diwise/api-transportation/internal/pkg/database"
+	"github.com/diwise/api-transportation/internal/pkg/surface"
+	"github.com/diwise/ngsi-ld-golang/pkg/datamodels/fiware"
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/errors"
+)
+
+func (router *RequestRouter) addAccuracyHandlers(db database.Datastore) {
+	router.Post("/api/surfacelabels", newCreateSurfaceLabelHandler(db))
+	router.Get("/api/reports/surfaceaccuracy", newSurfaceAccuracyReportHandler(db))
+}
+
+//surfaceLabel is a verified ground-truth surface type of a road segment, as posted by a client
+type surfaceLabel struct {
+	RoadSegment  string `json:"roadSegment"`
+	SurfaceType  string `json:"surfaceType"`
+	DateObserved string `json:"dateObserved"`
+	Source       string `json:"source"`
+	ObservedBy   string `json:"observedBy"`
+}
+
+//newCreateSurfaceLabelHandler stores a ground-truth label that surface predictions can be
+//compared with
+func newCreateSurfaceLabelHandler(db database.Datastore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		label := &surfaceLabel{}
+		err := json.NewDecoder(r.Body).Decode(label)
+		if err != nil {
+			errors.ReportNewBadRequestData(w, "failed to decode surface label: "+err.Error())
+			return
+		}
+
+		timestamp, err := time.Parse(time.RFC3339, label.DateObserved)
+		if err != nil {
+			errors.ReportNewBadRequestData(w, "failed to parse dateObserved "+label.DateObserved)
+			return
+		}
+
+		segmentID := strings.TrimPrefix(label.RoadSegment, fiware.RoadSegmentIDPrefix)
+		_, err = db.GetRoadSegmentByID(segmentID)
+		if err != nil {
+			errors.ReportNewBadRequestData(w, "unknown road segment "+label.RoadSegment)
+			return
+		}
+
+		if db.SurfaceVocabulary().Kind(surface.Normalize(label.SurfaceType)) == "" {
+			errors.ReportNewBadRequestData(w, "surfaceType "+label.SurfaceType+" does not match any known types")
+			return
+		}
+
+		_, err = db.CreateSurfaceLabel(database.SurfaceLabel{
+			SegmentID:   segmentID,
+			SurfaceType: label.SurfaceType,
+			Timestamp:   timestamp,
+			Source:      label.Source,
+			Client:      label.ObservedBy,
+		})
+		if err != nil {
+			reportInternalError(w, "failed to store surface label: "+err.Error())
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+//newSurfaceAccuracyReportHandler matches the labels within a time range (from= and to=,
+//defaulting to the last seven days) with predictions and reports how accurate and well
+//calibrated the predictions of every source and model were
+func newSurfaceAccuracyReportHandler(db database.Datastore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		to, err := parseTimeParameter(r, "to", time.Now().UTC())
+		if err != nil {
+			errors.ReportNewBadRequestData(w, err.Error())
+			return
+		}
+
+		from, err := parseTimeParameter(r, "from", to.Add(-7*24*time.Hour))
+		if err != nil {
+			errors.ReportNewBadRequestData(w, err.Error())
+			return
+		}
+
+		labelled, err := db.GetLabelledSurfacePredictions(from, to)
+		if err != nil {
+			reportInternalError(w, "failed to match predictions with labels: "+err.Error())
+			return
+		}
+
+		samples := []accuracy.Sample{}
+		for _, lp := range labelled {
+			samples = append(samples, accuracy.Sample{
+				Source:       lp.Prediction.Source,
+				Model:        lp.Prediction.ModelName,
+				ModelVersion: lp.Prediction.ModelVersion,
+				Predicted:    lp.Prediction.SurfaceType,
+				Probability:  lp.Prediction.Probability,
+				Label:        lp.Label.SurfaceType,
+			})
+		}
+
+		writeJSONResponse(w, map[string]interface{}{
+			"from":    from.Format(time.RFC3339),
+			"to":      to.Format(time.RFC3339),
+			"reports": accuracy.NewReports(samples),
+		})
+	}
+}
+
+func parseTimeParameter(r *http.Request, name string, fallback time.Time) (time.Time, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+
+	timestamp, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return timestamp.UTC(), nil
+}
@@ -0,0 +1,175 @@
+package handler
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/diwise/api-transportation/internal/pkg/database"
+	"github.com/diwise/ngsi-ld-golang/pkg/datamodels/fiware"
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/errors"
+)
+
+func (router *RequestRouter) addAggregationHandlers(db database.Datastore) {
+	router.Get("/api/aggregates/trafficflowobserved", newTrafficFlowAggregationHandler(db))
+}
+
+//defaultPercentiles are the percentiles of the intensity that are reported unless the client
+//asks for others
+const defaultPercentiles string = "50,90,95"
+
+//trafficFlowAggregate is the json representation of a database.TrafficFlowAggregate
+type trafficFlowAggregate struct {
+	DateObservedFrom    string   `json:"dateObservedFrom"`
+	DateObservedTo      string   `json:"dateObservedTo"`
+	LaneID              *int     `json:"laneID,omitempty"`
+	RefRoadSegment      string   `json:"refRoadSegment,omitempty"`
+	Observations        int64    `json:"observations"`
+	AverageVehicleSpeed *float64 `json:"averageVehicleSpeed,omitempty"`
+
+	Intensity struct {
+		Sum         int64            `json:"sum"`
+		Mean        float64          `json:"mean"`
+		Percentiles map[string]int64 `json:"percentiles,omitempty"`
+	} `json:"intensity"`
+}
+
+//newTrafficFlowAggregationHandler groups the traffic flow observations within a time range
+//(from= and to=, defaulting to the last seven days) into time buckets (bucket=15min, hour, day
+//or week) that are split per lane and road segment unless groupBy= says otherwise. The
+//observations can be limited to a road segment with refRoadSegment= and to a lane with laneID=.
+func newTrafficFlowAggregationHandler(db database.Datastore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+
+		bucket, err := database.ParseTimeBucket(getParameter(r, "bucket", string(database.BucketHour)))
+		if err != nil {
+			errors.ReportNewBadRequestData(w, err.Error())
+			return
+		}
+
+		to, err := parseTimeParameter(r, "to", time.Now().UTC())
+		if err != nil {
+			errors.ReportNewBadRequestData(w, err.Error())
+			return
+		}
+
+		from, err := parseTimeParameter(r, "from", to.Add(-7*24*time.Hour))
+		if err != nil {
+			errors.ReportNewBadRequestData(w, err.Error())
+			return
+		}
+
+		aggregation := database.TrafficFlowAggregation{Bucket: bucket}
+
+		groupBy := "laneID,refRoadSegment"
+		if _, ok := params["groupBy"]; ok {
+			groupBy = params.Get("groupBy")
+		}
+
+		for _, property := range splitParameter(groupBy) {
+			if property == "laneID" {
+				aggregation.GroupByLane = true
+			} else if property == "refRoadSegment" {
+				aggregation.GroupByRoadSegment = true
+			} else {
+				errors.ReportNewBadRequestData(w, "unable to group by unknown property "+property)
+				return
+			}
+		}
+
+		percentiles := splitParameter(getParameter(r, "percentiles", defaultPercentiles))
+		for _, p := range percentiles {
+			value, err := strconv.ParseFloat(p, 64)
+			if err != nil || math.IsNaN(value) || value <= 0 || value > 100 {
+				errors.ReportNewBadRequestData(w, "percentile "+p+" is not a number within (0, 100]")
+				return
+			}
+			aggregation.Percentiles = append(aggregation.Percentiles, value)
+		}
+
+		query := database.ObservationQuery{From: from, To: to}
+
+		if segmentID := params.Get("refRoadSegment"); segmentID != "" {
+			query.RoadSegmentIDs = []string{strings.TrimPrefix(segmentID, fiware.RoadSegmentIDPrefix)}
+		}
+
+		if lane := params.Get("laneID"); lane != "" {
+			laneID, err := strconv.Atoi(lane)
+			if err != nil {
+				errors.ReportNewBadRequestData(w, "failed to parse laneID "+lane)
+				return
+			}
+			query.Filters = append(query.Filters, database.PropertyFilter{Property: "laneID", Operator: "==", Value: laneID})
+		}
+
+		aggregates, err := db.AggregateTrafficFlowsObserved(query, aggregation)
+		if err != nil {
+			reportInternalError(w, "failed to aggregate traffic flows: "+err.Error())
+			return
+		}
+
+		response := []trafficFlowAggregate{}
+		for _, a := range aggregates {
+			response = append(response, newTrafficFlowAggregate(a, bucket, percentiles))
+		}
+
+		writeJSONResponse(w, map[string]interface{}{
+			"bucket":     bucket,
+			"from":       from.Format(time.RFC3339),
+			"to":         to.Format(time.RFC3339),
+			"aggregates": response,
+		})
+	}
+}
+
+func newTrafficFlowAggregate(a database.TrafficFlowAggregate, bucket database.TimeBucket, percentiles []string) trafficFlowAggregate {
+	aggregate := trafficFlowAggregate{
+		DateObservedFrom:    a.BucketStart.Format(time.RFC3339),
+		DateObservedTo:      bucket.End(a.BucketStart).Format(time.RFC3339),
+		LaneID:              a.LaneID,
+		Observations:        a.Observations,
+		AverageVehicleSpeed: a.AverageSpeed,
+	}
+
+	if a.RoadSegmentID != nil && *a.RoadSegmentID != "" {
+		aggregate.RefRoadSegment = fiware.RoadSegmentIDPrefix + *a.RoadSegmentID
+	}
+
+	aggregate.Intensity.Sum = a.IntensitySum
+	aggregate.Intensity.Mean = a.IntensityMean
+
+	if len(percentiles) > 0 {
+		aggregate.Intensity.Percentiles = map[string]int64{}
+		for idx, p := range percentiles {
+			aggregate.Intensity.Percentiles[fmt.Sprintf("p%s", p)] = a.Percentiles[idx]
+		}
+	}
+
+	return aggregate
+}
+
+func getParameter(r *http.Request, name, fallback string) string {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return fallback
+	}
+
+	return value
+}
+
+//splitParameter splits a comma separated parameter value and drops any empty values
+func splitParameter(value string) []string {
+	values := []string{}
+
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+
+	return values
+}
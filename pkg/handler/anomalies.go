@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/diwise/api-transportation/internal/pkg/database"
+	"github.com/diwise/ngsi-ld-golang/pkg/datamodels/fiware"
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/errors"
+)
+
+func (router *RequestRouter) addAnomalyHandlers(db database.Datastore) {
+	router.Get("/api/anomalies/trafficflowobserved", newTrafficFlowAnomaliesHandler(db))
+}
+
+//trafficFlowAnomaly is a traffic flow observation that deviated strongly from its baseline
+type trafficFlowAnomaly struct {
+	RefTrafficFlowObserved string  `json:"refTrafficFlowObserved"`
+	RefRoadSegment         string  `json:"refRoadSegment"`
+	LaneID                 int     `json:"laneID"`
+	DateObserved           string  `json:"dateObserved"`
+	Kind                   string  `json:"kind"`
+	Intensity              int     `json:"intensity"`
+	Expected               float64 `json:"expected"`
+	StdDev                 float64 `json:"stdDev"`
+	Score                  float64 `json:"score"`
+	Samples                int     `json:"samples"`
+	DateDetected           string  `json:"dateDetected"`
+}
+
+//newTrafficFlowAnomaliesHandler lists the anomalous traffic flows that were observed within a
+//time range (from= and to=, defaulting to the last seven days), most recent first, optionally
+//limited to a single road segment (refRoadSegment=)
+func newTrafficFlowAnomaliesHandler(db database.Datastore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		to, err := parseTimeParameter(r, "to", time.Now().UTC())
+		if err != nil {
+			errors.ReportNewBadRequestData(w, err.Error())
+			return
+		}
+
+		from, err := parseTimeParameter(r, "from", to.Add(-7*24*time.Hour))
+		if err != nil {
+			errors.ReportNewBadRequestData(w, err.Error())
+			return
+		}
+
+		segmentID := strings.TrimPrefix(r.URL.Query().Get("refRoadSegment"), fiware.RoadSegmentIDPrefix)
+
+		anomalies, err := db.GetTrafficFlowAnomalies(from, to, segmentID)
+		if err != nil {
+			reportInternalError(w, "failed to retrieve anomalies: "+err.Error())
+			return
+		}
+
+		result := []trafficFlowAnomaly{}
+
+		for _, a := range anomalies {
+			result = append(result, trafficFlowAnomaly{
+				RefTrafficFlowObserved: a.TrafficFlowObservedID,
+				RefRoadSegment:         fiware.RoadSegmentIDPrefix + a.SegmentID,
+				LaneID:                 a.LaneID,
+				DateObserved:           a.DateObserved.UTC().Format(time.RFC3339),
+				Kind:                   a.Kind,
+				Intensity:              a.Intensity,
+				Expected:               a.Expected,
+				StdDev:                 a.StdDev,
+				Score:                  a.Score,
+				Samples:                a.Samples,
+				DateDetected:           a.CreatedAt.UTC().Format(time.RFC3339),
+			})
+		}
+
+		writeJSONResponse(w, map[string]interface{}{
+			"from":      from.Format(time.RFC3339),
+			"to":        to.Format(time.RFC3339),
+			"anomalies": result,
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	fiwarecontext "github.com/diwise/api-transportation/internal/pkg/fiware/context"
+	"github.com/go-chi/chi"
+	"github.com/google/uuid"
+)
+
+func (router *RequestRouter) addDiscoveryHandlers(ctxSource fiwarecontext.ContextSource) {
+	router.Get("/ngsi-ld/v1/types", newRetrieveTypesHandler(ctxSource))
+	router.Get("/ngsi-ld/v1/types/{type}", newRetrieveTypeHandler(ctxSource))
+	router.Get("/ngsi-ld/v1/attributes", newRetrieveAttributesHandler(ctxSource))
+	router.Get("/ngsi-ld/v1/attributes/{attr}", newRetrieveAttributeHandler(ctxSource))
+}
+
+//newRetrieveTypesHandler returns an EntityTypeList, or a list of detailed EntityType
+//descriptions if the client asks for details=true
+func newRetrieveTypesHandler(ctxSource fiwarecontext.ContextSource) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entityTypes, err := ctxSource.GetEntityTypes()
+		if err != nil {
+			reportInternalError(w, "failed to retrieve entity types: "+err.Error())
+			return
+		}
+
+		if r.URL.Query().Get("details") == "true" {
+			writeJSONResponse(w, entityTypes)
+			return
+		}
+
+		typeList := []string{}
+		for _, et := range entityTypes {
+			typeList = append(typeList, et.TypeName)
+		}
+
+		writeJSONResponse(w, map[string]interface{}{
+			"id":       "urn:ngsi-ld:EntityTypeList:" + uuid.New().String(),
+			"type":     "EntityTypeList",
+			"typeList": typeList,
+		})
+	}
+}
+
+//newRetrieveTypeHandler returns an EntityTypeInfo about a single entity type
+func newRetrieveTypeHandler(ctxSource fiwarecontext.ContextSource) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		typeName := chi.URLParam(r, "type")
+
+		entityTypes, err := ctxSource.GetEntityTypes()
+		if err != nil {
+			reportInternalError(w, "failed to retrieve entity types: "+err.Error())
+			return
+		}
+
+		attributes, err := ctxSource.GetAttributes()
+		if err != nil {
+			reportInternalError(w, "failed to retrieve attributes: "+err.Error())
+			return
+		}
+
+		for _, et := range entityTypes {
+			if et.TypeName != typeName {
+				continue
+			}
+
+			attributeDetails := []fiwarecontext.Attribute{}
+			for _, attr := range attributes {
+				for _, tn := range attr.TypeNames {
+					if tn == typeName {
+						attr.TypeNames = nil
+						attributeDetails = append(attributeDetails, attr)
+						break
+					}
+				}
+			}
+
+			writeJSONResponse(w, map[string]interface{}{
+				"id":               et.ID,
+				"type":             "EntityTypeInfo",
+				"typeName":         et.TypeName,
+				"entityCount":      et.EntityCount,
+				"bbox":             et.BBox,
+				"attributeDetails": attributeDetails,
+			})
+			return
+		}
+
+		reportResourceNotFound(w, "no entity type named "+typeName)
+	}
+}
+
+//newRetrieveAttributesHandler returns an AttributeList, or a list of detailed Attribute
+//descriptions if the client asks for details=true
+func newRetrieveAttributesHandler(ctxSource fiwarecontext.ContextSource) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		attributes, err := ctxSource.GetAttributes()
+		if err != nil {
+			reportInternalError(w, "failed to retrieve attributes: "+err.Error())
+			return
+		}
+
+		if r.URL.Query().Get("details") == "true" {
+			writeJSONResponse(w, attributes)
+			return
+		}
+
+		attributeList := []string{}
+		for _, attr := range attributes {
+			attributeList = append(attributeList, attr.AttributeName)
+		}
+
+		writeJSONResponse(w, map[string]interface{}{
+			"id":            "urn:ngsi-ld:AttributeList:" + uuid.New().String(),
+			"type":          "AttributeList",
+			"attributeList": attributeList,
+		})
+	}
+}
+
+//newRetrieveAttributeHandler returns a detailed description of a single attribute
+func newRetrieveAttributeHandler(ctxSource fiwarecontext.ContextSource) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		attributeName := chi.URLParam(r, "attr")
+
+		attributes, err := ctxSource.GetAttributes()
+		if err != nil {
+			reportInternalError(w, "failed to retrieve attributes: "+err.Error())
+			return
+		}
+
+		for _, attr := range attributes {
+			if attr.AttributeName == attributeName {
+				writeJSONResponse(w, attr)
+				return
+			}
+		}
+
+		reportResourceNotFound(w, "no attribute named "+attributeName)
+	}
+}
+
+func writeJSONResponse(w http.ResponseWriter, body interface{}) {
+	bytes, err := json.MarshalIndent(body, "", "  ")
+	if err != nil {
+		reportInternalError(w, "Failed to encode response.")
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/ld+json;charset=utf-8")
+	w.Write(bytes)
+}
@@ -7,8 +7,9 @@ import (
 
 	"github.com/diwise/api-transportation/internal/pkg/database"
 	fiwarecontext "github.com/diwise/api-transportation/internal/pkg/fiware/context"
-	"github.com/diwise/messaging-golang/pkg/messaging"
+	"github.com/diwise/api-transportation/internal/pkg/importer"
 	ngsi "github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld"
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/errors"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 
@@ -23,7 +24,7 @@ type RequestRouter struct {
 }
 
 func (router *RequestRouter) addNGSIHandlers(contextRegistry ngsi.ContextRegistry) {
-	router.Get("/ngsi-ld/v1/entities", ngsi.NewQueryEntitiesHandler(contextRegistry))
+	router.Get("/ngsi-ld/v1/entities", newQueryValidatingHandler(newPaginatingHandler(ngsi.NewQueryEntitiesHandler(contextRegistry))))
 	router.Post("/ngsi-ld/v1/entities", ngsi.NewCreateEntityHandler(contextRegistry))
 	router.Patch("/ngsi-ld/v1/entities/{entity}/attrs/", ngsi.NewUpdateEntityAttributesHandler(contextRegistry))
 }
@@ -63,29 +64,75 @@ func newRequestRouter() *RequestRouter {
 	return router
 }
 
-func createRequestRouter(contextRegistry ngsi.ContextRegistry) *RequestRouter {
+func createRequestRouter(contextRegistry ngsi.ContextRegistry, ctxSource fiwarecontext.ContextSource, db database.Datastore) *RequestRouter {
 	router := newRequestRouter()
 
 	router.addProbeHandlers()
 	router.addNGSIHandlers(contextRegistry)
+	router.addDiscoveryHandlers(ctxSource)
+	router.addAccuracyHandlers(db)
+	router.addAggregationHandlers(db)
+	router.addIngestionHandlers(db)
+	router.addAnomalyHandlers(db)
 
 	return router
 }
 
-//MessagingContext is an interface that allows mocking of messaging.Context parameters
-type MessagingContext interface {
-	PublishOnTopic(message messaging.TopicMessage) error
-	NoteToSelf(message messaging.CommandMessage) error
+//newQueryValidatingHandler refuses queries with parameters that the context source does not
+//support, before they are passed on to the query handler that would report them as internal errors
+func newQueryValidatingHandler(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		timeProperty := r.URL.Query().Get(ngsi.TemporalRelationTimeProperty)
+		if timeProperty != "" {
+			err := fiwarecontext.ValidateTimeProperty(timeProperty)
+			if err != nil {
+				errors.ReportNewBadRequestData(w, err.Error())
+				return
+			}
+		}
+
+		next(w, r)
+	}
+}
+
+//contextRegistry wraps the default ngsi-ld context registry and makes sure that a context
+//source is only asked once for entities, even when it provides several of the requested types
+type contextRegistry struct {
+	ngsi.ContextRegistry
+}
+
+func newContextRegistry() ngsi.ContextRegistry {
+	return &contextRegistry{ContextRegistry: ngsi.NewContextRegistry()}
+}
+
+func (r *contextRegistry) GetContextSourcesForQuery(query ngsi.Query) []ngsi.ContextSource {
+	uniqueSources := []ngsi.ContextSource{}
+
+	for _, src := range r.ContextRegistry.GetContextSourcesForQuery(query) {
+		isDuplicate := false
+		for _, unique := range uniqueSources {
+			if unique == src {
+				isDuplicate = true
+				break
+			}
+		}
+
+		if !isDuplicate {
+			uniqueSources = append(uniqueSources, src)
+		}
+	}
+
+	return uniqueSources
 }
 
 //CreateRouterAndStartServing creates a request router, registers all handlers and starts serving requests.
-func CreateRouterAndStartServing(messenger MessagingContext, db database.Datastore) {
+func CreateRouterAndStartServing(ctxSource fiwarecontext.ContextSource, db database.Datastore, imp importer.Importer) {
 
-	contextRegistry := ngsi.NewContextRegistry()
-	ctxSource := fiwarecontext.CreateSource(db, messenger)
+	contextRegistry := newContextRegistry()
 	contextRegistry.Register(ctxSource)
 
-	router := createRequestRouter(contextRegistry)
+	router := createRequestRouter(contextRegistry, ctxSource, db)
+	router.addImportHandlers(imp)
 
 	port := os.Getenv("TRANSPORTATION_API_PORT")
 	if port == "" {
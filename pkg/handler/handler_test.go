@@ -0,0 +1,333 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diwise/api-transportation/internal/pkg/accuracy"
+	"github.com/diwise/api-transportation/internal/pkg/database"
+	fiwarecontext "github.com/diwise/api-transportation/internal/pkg/fiware/context"
+	"github.com/diwise/api-transportation/internal/pkg/importer"
+	"github.com/diwise/api-transportation/internal/pkg/persistence"
+	"github.com/diwise/ngsi-ld-golang/pkg/datamodels/diwise"
+	"github.com/diwise/ngsi-ld-golang/pkg/datamodels/fiware"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/matryer/is"
+)
+
+func TestMain(m *testing.M) {
+	log.SetFormatter(&log.JSONFormatter{})
+	os.Exit(m.Run())
+}
+
+func TestThatSeveralTypesCanBeQueriedAndPagedTogether(t *testing.T) {
+	is := is.New(t)
+
+	router := newTestRouter(t)
+
+	w := get(router, "/ngsi-ld/v1/entities?type=RoadSurfaceObserved,TrafficFlowObserved&orderBy=dateObserved&limit=2&offset=1&count=true")
+	is.Equal(w.Code, http.StatusOK) // unexpected response code
+
+	entities := []map[string]interface{}{}
+	is.NoErr(json.Unmarshal(w.Body.Bytes(), &entities))
+	is.Equal(len(entities), 2) // expected a page of two entities
+
+	is.Equal(entities[0]["id"], fiware.TrafficFlowObservedIDPrefix+"second") // results returned in the wrong order
+	is.Equal(entities[1]["type"], "RoadSurfaceObserved")                     // results returned in the wrong order
+
+	is.Equal(w.Header().Get(ResultsCountHeader), "3") // unexpected total number of entities
+	is.True(w.Header().Get("Link") != "")             // expected a link to the previous page
+}
+
+func TestThatIDPatternFiltersAcrossTypes(t *testing.T) {
+	is := is.New(t)
+
+	router := newTestRouter(t)
+
+	w := get(router, "/ngsi-ld/v1/entities?type=RoadSurfaceObserved,TrafficFlowObserved&idPattern=^.*:first$")
+	is.Equal(w.Code, http.StatusOK) // unexpected response code
+
+	entities := []map[string]interface{}{}
+	is.NoErr(json.Unmarshal(w.Body.Bytes(), &entities))
+	is.Equal(len(entities), 1) // expected a single matching entity
+	is.Equal(entities[0]["id"], fiware.TrafficFlowObservedIDPrefix+"first")
+}
+
+func TestThatIdentitiesOfOtherTypesMatchNoObservations(t *testing.T) {
+	is := is.New(t)
+
+	router := newTestRouter(t)
+
+	w := get(router, "/ngsi-ld/v1/entities?type=TrafficFlowObserved&id="+diwise.RoadSurfaceObservedIDPrefix+"x")
+	is.Equal(w.Code, http.StatusOK) // unexpected response code
+
+	entities := []map[string]interface{}{}
+	is.NoErr(json.Unmarshal(w.Body.Bytes(), &entities))
+	is.Equal(len(entities), 0) // the id of a RoadSurfaceObserved should not match any traffic flows
+}
+
+func TestThatUnknownTimePropertiesAreRefused(t *testing.T) {
+	is := is.New(t)
+
+	router := newTestRouter(t)
+
+	w := get(router, "/ngsi-ld/v1/entities?type=TrafficFlowObserved&timerel=after&timeAt=2016-12-07T00:00:00Z&timeproperty=dateObservedFrom")
+	is.Equal(w.Code, http.StatusOK) // dateObservedFrom is a time property of traffic flows
+
+	w = get(router, "/ngsi-ld/v1/entities?type=TrafficFlowObserved&timerel=after&timeAt=2016-12-07T00:00:00Z&timeproperty=dateFrozen")
+	is.Equal(w.Code, http.StatusBadRequest) // dateFrozen is not a time property of any type
+}
+
+func TestThatProvidedTypesAndAttributesCanBeDiscovered(t *testing.T) {
+	is := is.New(t)
+
+	router := newTestRouter(t)
+
+	w := get(router, "/ngsi-ld/v1/types")
+	is.Equal(w.Code, http.StatusOK) // unexpected response code
+
+	typeList := struct {
+		Type     string   `json:"type"`
+		TypeList []string `json:"typeList"`
+	}{}
+	is.NoErr(json.Unmarshal(w.Body.Bytes(), &typeList))
+	is.Equal(typeList.Type, "EntityTypeList")
+	is.True(len(typeList.TypeList) > 0) // expected the provided types to be listed
+
+	w = get(router, "/ngsi-ld/v1/types/TrafficFlowObserved")
+	is.Equal(w.Code, http.StatusOK) // unexpected response code
+
+	typeInfo := struct {
+		TypeName         string                    `json:"typeName"`
+		EntityCount      uint64                    `json:"entityCount"`
+		AttributeDetails []fiwarecontext.Attribute `json:"attributeDetails"`
+	}{}
+	is.NoErr(json.Unmarshal(w.Body.Bytes(), &typeInfo))
+	is.Equal(typeInfo.TypeName, "TrafficFlowObserved")
+	is.Equal(typeInfo.EntityCount, uint64(2))   // the test router is seeded with two traffic flows
+	is.True(len(typeInfo.AttributeDetails) > 0) // expected the attributes of the type
+
+	w = get(router, "/ngsi-ld/v1/attributes")
+	is.Equal(w.Code, http.StatusOK) // unexpected response code
+
+	attributeList := struct {
+		AttributeList []string `json:"attributeList"`
+	}{}
+	is.NoErr(json.Unmarshal(w.Body.Bytes(), &attributeList))
+	is.True(len(attributeList.AttributeList) > 0) // expected the provided attributes to be listed
+
+	w = get(router, "/ngsi-ld/v1/attributes/intensity")
+	is.Equal(w.Code, http.StatusOK) // unexpected response code
+}
+
+func TestThatUnknownTypesAndAttributesAreNotFound(t *testing.T) {
+	is := is.New(t)
+
+	router := newTestRouter(t)
+
+	for _, path := range []string{"/ngsi-ld/v1/types/Spaceship", "/ngsi-ld/v1/attributes/warpSpeed"} {
+		w := get(router, path)
+		is.Equal(w.Code, http.StatusNotFound) // unexpected response code
+		is.Equal(w.Header().Get("Content-Type"), "application/problem+json")
+
+		problem := map[string]string{}
+		is.NoErr(json.Unmarshal(w.Body.Bytes(), &problem))
+		is.Equal(problem["type"], "https://uri.etsi.org/ngsi-ld/errors/ResourceNotFound")
+	}
+}
+
+func TestThatLabelsCanBePostedAndReportedOn(t *testing.T) {
+	is := is.New(t)
+
+	seed := "21277:153930;21277:153930;62.389109;17.310863;62.389084;17.310852\n"
+	db, err := database.NewDatabaseConnection(database.NewSQLiteConnector(), strings.NewReader(seed))
+	is.NoErr(err)
+
+	prediction := database.NewSurfacePrediction("snow", 0.8, time.Date(2021, 1, 15, 11, 0, 0, 0, time.UTC))
+	prediction.Provenance = database.Provenance{Source: database.SourceModel, Model: "roadcam", ModelVersion: "1.2"}
+	is.NoErr(db.UpdateRoadSegmentSurfacePrediction("21277:153930", prediction))
+
+	router := createRequestRouter(newContextRegistry(), fiwarecontext.CreateSource(db, nil, nil), db)
+
+	label := `{"roadSegment":"urn:ngsi-ld:RoadSegment:21277:153930","surfaceType":"ice","dateObserved":"2021-01-15T12:00:00Z","source":"inspection"}`
+	req, _ := http.NewRequest("POST", "/api/surfacelabels", strings.NewReader(label))
+	w := httptest.NewRecorder()
+	router.impl.ServeHTTP(w, req)
+	is.Equal(w.Code, http.StatusCreated) // the label should have been stored
+
+	req, _ = http.NewRequest("POST", "/api/surfacelabels", strings.NewReader(strings.Replace(label, `"ice"`, `"lava"`, 1)))
+	w = httptest.NewRecorder()
+	router.impl.ServeHTTP(w, req)
+	is.Equal(w.Code, http.StatusBadRequest) // labels with unknown surface types should be refused
+
+	w = get(router, "/api/reports/surfaceaccuracy?from=2021-01-15T00:00:00Z&to=2021-01-16T00:00:00Z")
+	is.Equal(w.Code, http.StatusOK) // unexpected response code
+
+	report := struct {
+		Reports []accuracy.Report `json:"reports"`
+	}{}
+	is.NoErr(json.Unmarshal(w.Body.Bytes(), &report))
+	is.Equal(len(report.Reports), 1) // expected a report for the roadcam model
+	is.Equal(report.Reports[0].ModelVersion, "1.2")
+	is.Equal(report.Reports[0].Accuracy, 0.0) // the snow prediction was wrong
+	is.Equal(report.Reports[0].ConfusionMatrix["ice"]["snow"], 1)
+}
+
+func TestThatTrafficFlowsCanBeAggregated(t *testing.T) {
+	is := is.New(t)
+
+	router := newTestRouter(t)
+
+	w := get(router, "/api/aggregates/trafficflowobserved?bucket=day&from=2016-12-07T00:00:00Z&to=2016-12-08T00:00:00Z&groupBy=laneID&percentiles=50")
+	is.Equal(w.Code, http.StatusOK) // unexpected response code
+
+	response := struct {
+		Aggregates []trafficFlowAggregate `json:"aggregates"`
+	}{}
+	is.NoErr(json.Unmarshal(w.Body.Bytes(), &response))
+	is.Equal(len(response.Aggregates), 1) // both observations should be in the same day and lane
+	is.Equal(response.Aggregates[0].DateObservedTo, "2016-12-08T00:00:00Z")
+	is.Equal(response.Aggregates[0].Intensity.Sum, int64(70))
+	is.Equal(response.Aggregates[0].Intensity.Percentiles["p50"], int64(35))
+
+	w = get(router, "/api/aggregates/trafficflowobserved?bucket=month")
+	is.Equal(w.Code, http.StatusBadRequest) // month is not a supported bucket
+
+	w = get(router, "/api/aggregates/trafficflowobserved?percentiles=NaN")
+	is.Equal(w.Code, http.StatusBadRequest) // NaN is not a valid percentile
+}
+
+func TestThatRetriedTrafficFlowsAreSuppressedAndReported(t *testing.T) {
+	is := is.New(t)
+
+	router := newTestRouter(t)
+
+	tfo := `{"type":"TrafficFlowObserved","dateObserved":{"type":"Property","value":"2016-12-08T10:00:00Z"},"dateObservedFrom":{"type":"Property","value":{"@type":"DateTime","@value":"2016-12-08T09:55:00Z"}},"dateObservedTo":{"type":"Property","value":{"@type":"DateTime","@value":"2016-12-08T10:00:00Z"}},"laneID":{"type":"Property","value":2},"intensity":{"type":"Property","value":17},"refDevice":{"type":"Relationship","object":"urn:ngsi-ld:Device:counter-1"}}`
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("POST", "/ngsi-ld/v1/entities", strings.NewReader(tfo))
+		w := httptest.NewRecorder()
+		router.impl.ServeHTTP(w, req)
+		is.Equal(w.Code, http.StatusCreated) // a retried observation should still be accepted
+	}
+
+	w := get(router, "/ngsi-ld/v1/entities?type=TrafficFlowObserved&q=laneID==2")
+	entities := []map[string]interface{}{}
+	is.NoErr(json.Unmarshal(w.Body.Bytes(), &entities))
+	is.Equal(len(entities), 1) // the retries should not be stored as new observations
+
+	w = get(router, "/api/reports/trafficflowduplicates?from=2016-12-08T00:00:00Z&to=2016-12-09T00:00:00Z")
+	report := struct {
+		Suppressed int64              `json:"suppressed"`
+		Devices    []deviceDuplicates `json:"devices"`
+	}{}
+	is.NoErr(json.Unmarshal(w.Body.Bytes(), &report))
+	is.Equal(report.Suppressed, int64(2))
+	is.Equal(report.Devices[0].RefDevice, "urn:ngsi-ld:Device:counter-1")
+}
+
+func TestThatTrafficFlowAnomaliesCanBeListedPerRoadSegment(t *testing.T) {
+	is := is.New(t)
+
+	db, _ := database.NewDatabaseConnection(database.NewSQLiteConnector(), nil)
+	for idx, segmentID := range []string{"21277:153930", "21277:153931"} {
+		_, _, err := db.CreateTrafficFlowAnomaly(persistence.TrafficFlowAnomaly{
+			TrafficFlowObservedID: fiware.TrafficFlowObservedIDPrefix + segmentID,
+			SegmentID:             segmentID,
+			LaneID:                1,
+			DateObserved:          time.Date(2016, 12, 7, 11, 10+idx, 0, 0, time.UTC),
+			Kind:                  "drop",
+			Intensity:             5,
+			Expected:              100,
+		})
+		is.NoErr(err)
+	}
+
+	registry := newContextRegistry()
+	ctxSource := fiwarecontext.CreateSource(db, nil, nil)
+	router := createRequestRouter(registry, ctxSource, db)
+
+	w := get(router, "/api/anomalies/trafficflowobserved?from=2016-12-07T00:00:00Z&to=2016-12-08T00:00:00Z&refRoadSegment=urn:ngsi-ld:RoadSegment:21277:153930")
+	is.Equal(w.Code, http.StatusOK)
+
+	response := struct {
+		Anomalies []trafficFlowAnomaly `json:"anomalies"`
+	}{}
+	is.NoErr(json.Unmarshal(w.Body.Bytes(), &response))
+	is.Equal(len(response.Anomalies), 1) // only the anomaly of the requested road segment should be listed
+	is.Equal(response.Anomalies[0].RefRoadSegment, "urn:ngsi-ld:RoadSegment:21277:153930")
+	is.Equal(response.Anomalies[0].Kind, "drop")
+}
+
+func TestThatTrafficFlowCountsCanBeImportedFromCSV(t *testing.T) {
+	is := is.New(t)
+
+	db, _ := database.NewDatabaseConnection(database.NewSQLiteConnector(), nil)
+	registry := newContextRegistry()
+	ctxSource := fiwarecontext.CreateSource(db, nil, nil)
+	registry.Register(ctxSource)
+
+	router := createRequestRouter(registry, ctxSource, db)
+	router.addImportHandlers(importer.NewImporter(db, importer.Config{BatchSize: 100, MaxErrors: 10}))
+
+	csv := "time;lane;count\n2016-12-09 10:00;3;27\n2016-12-09 10:05;3;-\n"
+	req, _ := http.NewRequest("POST", "/api/import/trafficflowobserved?columns=dateObserved:time,laneID:lane,intensity:count&timezone=Europe/Stockholm&timeformat=2006-01-02%2015:04&delimiter=%3B", strings.NewReader(csv))
+	w := httptest.NewRecorder()
+	router.impl.ServeHTTP(w, req)
+	is.Equal(w.Code, http.StatusOK) // unexpected response code
+
+	report := importer.Report{}
+	is.NoErr(json.Unmarshal(w.Body.Bytes(), &report))
+	is.Equal(report.Imported, 1)
+	is.Equal(report.Rejected, 1) // the count of the second row is not a number
+	is.Equal(report.Errors[0].Line, 3)
+
+	w = get(router, "/ngsi-ld/v1/entities?type=TrafficFlowObserved&q=laneID==3")
+	entities := []map[string]interface{}{}
+	is.NoErr(json.Unmarshal(w.Body.Bytes(), &entities))
+	is.Equal(len(entities), 1)
+	is.Equal(entities[0]["dateObserved"].(map[string]interface{})["value"], "2016-12-09T09:00:00Z") // the local time should be stored in UTC
+
+	req, _ = http.NewRequest("POST", "/api/import/trafficflowobserved?timezone=Mars/Olympus", strings.NewReader(csv))
+	w = httptest.NewRecorder()
+	router.impl.ServeHTTP(w, req)
+	is.Equal(w.Code, http.StatusBadRequest) // unknown time zones should be refused
+}
+
+func newTestRouter(t *testing.T) *RequestRouter {
+	db, err := database.NewDatabaseConnection(database.NewSQLiteConnector(), nil)
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+
+	tfo1 := fiware.NewTrafficFlowObserved("first", "2016-12-07T11:10:00Z", 1, 35)
+	tfo2 := fiware.NewTrafficFlowObserved("second", "2016-12-07T12:10:00Z", 1, 35)
+	for _, tfo := range []*fiware.TrafficFlowObserved{tfo1, tfo2} {
+		if _, err := db.CreateTrafficFlowObserved(tfo); err != nil {
+			t.Fatalf("failed to create traffic flow: %s", err.Error())
+		}
+	}
+
+	rso := diwise.NewRoadSurfaceObserved("rso", "snow", 0.75, 62.389109, 17.310863)
+	if _, err := db.CreateRoadSurfaceObserved(rso); err != nil {
+		t.Fatalf("failed to create road surface observation: %s", err.Error())
+	}
+
+	registry := newContextRegistry()
+	ctxSource := fiwarecontext.CreateSource(db, nil, nil)
+	registry.Register(ctxSource)
+
+	return createRequestRouter(registry, ctxSource, db)
+}
+
+func get(router *RequestRouter, path string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", path, nil)
+	w := httptest.NewRecorder()
+	router.impl.ServeHTTP(w, req)
+	return w
+}
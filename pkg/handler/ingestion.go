@@ -0,0 +1,99 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/diwise/api-transportation/internal/pkg/database"
+	"github.com/diwise/api-transportation/internal/pkg/importer"
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/errors"
+)
+
+func (router *RequestRouter) addIngestionHandlers(db database.Datastore) {
+	router.Get("/api/reports/trafficflowduplicates", newTrafficFlowDuplicatesReportHandler(db))
+}
+
+func (router *RequestRouter) addImportHandlers(imp importer.Importer) {
+	router.Post("/api/import/trafficflowobserved", newTrafficFlowImportHandler(imp))
+}
+
+//deviceDuplicates is the number of suppressed duplicates of a single source device
+type deviceDuplicates struct {
+	RefDevice    string `json:"refDevice"`
+	Observations int64  `json:"observations"`
+	Duplicates   int64  `json:"duplicates"`
+}
+
+//newTrafficFlowDuplicatesReportHandler reports how many retried or replayed traffic flow
+//observations were suppressed within a time range (from= and to=, defaulting to the last
+//seven days), in total and per source device
+func newTrafficFlowDuplicatesReportHandler(db database.Datastore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		to, err := parseTimeParameter(r, "to", time.Now().UTC())
+		if err != nil {
+			errors.ReportNewBadRequestData(w, err.Error())
+			return
+		}
+
+		from, err := parseTimeParameter(r, "from", to.Add(-7*24*time.Hour))
+		if err != nil {
+			errors.ReportNewBadRequestData(w, err.Error())
+			return
+		}
+
+		duplicates, err := db.GetTrafficFlowDuplicates(from, to)
+		if err != nil {
+			reportInternalError(w, "failed to count duplicates: "+err.Error())
+			return
+		}
+
+		total := int64(0)
+		devices := []deviceDuplicates{}
+
+		for _, d := range duplicates {
+			total += d.Duplicates
+			devices = append(devices, deviceDuplicates{
+				RefDevice:    d.SourceDevice,
+				Observations: d.Observations,
+				Duplicates:   d.Duplicates,
+			})
+		}
+
+		writeJSONResponse(w, map[string]interface{}{
+			"from":       from.Format(time.RFC3339),
+			"to":         to.Format(time.RFC3339),
+			"suppressed": total,
+			"devices":    devices,
+		})
+	}
+}
+
+//newTrafficFlowImportHandler streams a CSV file of historical traffic counts from the request body
+//into TrafficFlowObserved, and responds with a report of how many rows were imported and why the
+//others were rejected. The columns that hold the attributes (columns=attribute:column,...), the
+//time zone (timezone=), the layout of the times (timeformat=) and the delimiter (delimiter=) are
+//taken from the query.
+func newTrafficFlowImportHandler(imp importer.Importer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		mapping, err := importer.NewMapping(query.Get("columns"), query.Get("timezone"), query.Get("timeformat"), query.Get("delimiter"))
+		if err != nil {
+			errors.ReportNewBadRequestData(w, err.Error())
+			return
+		}
+
+		report, err := imp.ImportTrafficFlowsObserved(r.Body, *mapping)
+		if err != nil {
+			if report == nil {
+				errors.ReportNewBadRequestData(w, err.Error())
+			} else {
+				reportInternalError(w, fmt.Sprintf("%s (%d rows imported)", err.Error(), report.Imported))
+			}
+			return
+		}
+
+		writeJSONResponse(w, report)
+	}
+}
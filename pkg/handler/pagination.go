@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	fiwarecontext "github.com/diwise/api-transportation/internal/pkg/fiware/context"
+	ngsi "github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld"
+)
+
+//ResultsCountHeader is the header that reports the total number of matching entities
+//when a client queries for entities with count=true
+const ResultsCountHeader string = "NGSILD-Results-Count"
+
+//newPaginatingHandler wraps a query handler and decorates successful responses with
+//RFC 8288 Link headers to the previous and next pages, as well as the total number
+//of matching entities if the client asked for it
+func newPaginatingHandler(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r, resultCount := fiwarecontext.NewRequestWithResultCount(r)
+
+		pw := &paginatingResponseWriter{
+			ResponseWriter: w,
+			request:        r,
+			resultCount:    resultCount,
+		}
+
+		next(pw, r)
+	}
+}
+
+type paginatingResponseWriter struct {
+	http.ResponseWriter
+	request     *http.Request
+	resultCount *fiwarecontext.ResultCount
+	wroteHeader bool
+}
+
+func (pw *paginatingResponseWriter) WriteHeader(statusCode int) {
+	if !pw.wroteHeader {
+		pw.wroteHeader = true
+		if statusCode == http.StatusOK {
+			pw.addPaginationHeaders()
+		}
+	}
+
+	pw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (pw *paginatingResponseWriter) Write(b []byte) (int, error) {
+	if !pw.wroteHeader {
+		pw.WriteHeader(http.StatusOK)
+	}
+
+	return pw.ResponseWriter.Write(b)
+}
+
+func (pw *paginatingResponseWriter) addPaginationHeaders() {
+	params := pw.request.URL.Query()
+
+	limit := ngsi.QueryDefaultPaginationLimit
+	if l, err := strconv.ParseUint(params.Get("limit"), 10, 64); err == nil && l > 0 {
+		limit = l
+	}
+
+	offset := uint64(0)
+	if o, err := strconv.ParseUint(params.Get("offset"), 10, 64); err == nil {
+		offset = o
+	}
+
+	total, known := pw.resultCount.Total()
+
+	if known && params.Get("count") == "true" {
+		pw.Header().Set(ResultsCountHeader, strconv.FormatUint(total, 10))
+	}
+
+	links := []string{}
+
+	if offset > 0 {
+		prevOffset := uint64(0)
+		if offset > limit {
+			prevOffset = offset - limit
+		}
+		links = append(links, newPageLink(pw.request.URL, params, prevOffset, limit, "prev"))
+	}
+
+	if known && offset+limit < total {
+		links = append(links, newPageLink(pw.request.URL, params, offset+limit, limit, "next"))
+	}
+
+	if len(links) > 0 {
+		pw.Header().Set("Link", strings.Join(links, ", "))
+	}
+}
+
+func newPageLink(requestURL *url.URL, params url.Values, offset, limit uint64, rel string) string {
+	pageParams := url.Values{}
+	for key, values := range params {
+		pageParams[key] = values
+	}
+
+	pageParams.Set("offset", strconv.FormatUint(offset, 10))
+	pageParams.Set("limit", strconv.FormatUint(limit, 10))
+
+	pageURL := url.URL{Path: requestURL.Path, RawQuery: pageParams.Encode()}
+
+	return fmt.Sprintf("<%s>; rel=\"%s\"", pageURL.String(), rel)
+}
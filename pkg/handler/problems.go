@@ -0,0 +1,34 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/errors"
+)
+
+//reportInternalError reports an errors.InternalError with a 500 status code, as the errors
+//package reports every problem except unauthorized requests as a bad request
+func reportInternalError(w http.ResponseWriter, detail string) {
+	writeProblemResponse(w, http.StatusInternalServerError, errors.NewInternalError(detail))
+}
+
+//reportResourceNotFound reports that the resource that a request refers to does not exist
+func reportResourceNotFound(w http.ResponseWriter, detail string) {
+	writeProblemResponse(w, http.StatusNotFound, map[string]string{
+		"type":   "https://uri.etsi.org/ngsi-ld/errors/ResourceNotFound",
+		"title":  "Resource Not Found",
+		"detail": detail,
+	})
+}
+
+func writeProblemResponse(w http.ResponseWriter, statusCode int, problem interface{}) {
+	w.Header().Add("Content-Type", errors.ProblemReportContentType)
+	w.Header().Add("Content-Language", "en")
+	w.WriteHeader(statusCode)
+
+	bytes, err := json.MarshalIndent(problem, "", "  ")
+	if err == nil {
+		w.Write(bytes)
+	}
+}